@@ -0,0 +1,376 @@
+// Alert evaluation: every committed measurement is checked against the alert rules of its sensor,
+// silent rules also periodically against the time since the latest reading
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/maintenance"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxPending bounds the measurements waiting for evaluation, the oldest are dropped when it falls behind
+const maxPending = 100_000
+
+// a failed evaluation is retried after this delay, its measurements stay queued
+const retryDelay = 5 * time.Second
+
+// pending alerts are checked this often, so they fire after For even if the sensor stopped reporting
+const pendingCheck = 10 * time.Second
+
+// Engine evaluates in the background, in commit order. Enqueue never blocks the insert path.
+// Rules, states and sensor types are read from the database for every batch, so changed rules
+// and a restored backup take effect at once. Evaluations pause while a backup is restored.
+type Engine struct {
+	db           *database.Database
+	mode         *maintenance.Mode
+	silenceCheck time.Duration
+
+	mu        sync.Mutex
+	pending   []database.Measurement
+	dropped   int // measurements dropped from pending since the last evaluation
+	wake      chan struct{}
+	listeners []func(database.AlertEvent)
+}
+
+// NewEngine checks the silent rules every silenceCheck, 0 disables them
+func NewEngine(db *database.Database, mode *maintenance.Mode, silenceCheck time.Duration) *Engine {
+	return &Engine{db: db, mode: mode, silenceCheck: silenceCheck, wake: make(chan struct{}, 1)}
+}
+
+// OnChange registers fn to be called with every saved state change, from the evaluating goroutine
+func (e *Engine) OnChange(fn func(database.AlertEvent)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.listeners = append(e.listeners, fn)
+}
+
+// Enqueue is registered with database.OnInsert
+func (e *Engine) Enqueue(measurements []database.Measurement) {
+	e.mu.Lock()
+	e.pending = append(e.pending, measurements...)
+	e.trim()
+	e.mu.Unlock()
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// trim drops the oldest pending measurements beyond maxPending, e.mu must be held
+func (e *Engine) trim() {
+	if over := len(e.pending) - maxPending; over > 0 {
+		e.pending = append(e.pending[:0:0], e.pending[over:]...)
+		e.dropped += over
+	}
+}
+
+// Run evaluates the queued measurements, checks the pending alerts and the silent rules until ctx is done,
+// all in this goroutine so they do not race for the alert states
+func (e *Engine) Run(ctx context.Context) {
+	var silence <-chan time.Time
+	if e.silenceCheck > 0 {
+		ticker := time.NewTicker(e.silenceCheck)
+		defer ticker.Stop()
+		silence = ticker.C
+	}
+	pending := time.NewTicker(pendingCheck)
+	defer pending.Stop()
+	var retry <-chan time.Time
+	for {
+		var events []database.AlertEvent
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.wake:
+			events, err = e.evaluateQueued()
+		case <-retry:
+			retry = nil
+			events, err = e.evaluateQueued()
+		case now := <-pending.C:
+			e.mode.Hold(func() { events, err = e.checkPending(now) })
+			if err != nil {
+				log.Printf("error checking pending alerts: %s", err)
+				continue
+			}
+		case now := <-silence:
+			e.mode.Hold(func() { events, err = e.checkSilence(now) })
+			if err != nil {
+				log.Printf("error checking silent sensors: %s", err)
+				continue
+			}
+		}
+		if err != nil {
+			log.Printf("error evaluating alerts: %s", err)
+			retry = time.After(retryDelay)
+			continue
+		}
+		e.mu.Lock()
+		listeners := e.listeners
+		e.mu.Unlock()
+		for _, event := range events {
+			for _, fn := range listeners {
+				fn(event)
+			}
+		}
+	}
+}
+
+// evaluateQueued evaluates the queued measurements. If that fails they are queued again in front of
+// the newer ones, so they are evaluated in commit order with the next attempt.
+func (e *Engine) evaluateQueued() ([]database.AlertEvent, error) {
+	e.mu.Lock()
+	batch, dropped := e.pending, e.dropped
+	e.pending, e.dropped = nil, 0
+	e.mu.Unlock()
+	if dropped > 0 {
+		log.Printf("alert evaluation fell behind, the %v oldest measurements were not evaluated", dropped)
+	}
+	if len(batch) == 0 {
+		return nil, nil
+	}
+
+	var events []database.AlertEvent
+	var err error
+	e.mode.Hold(func() { events, err = e.evaluate(batch) })
+	if err != nil {
+		e.mu.Lock()
+		e.pending = append(batch, e.pending...)
+		e.trim()
+		e.mu.Unlock()
+		return nil, fmt.Errorf("%v measurements queued again: %w", len(batch), err)
+	}
+	return events, nil
+}
+
+type alertKey struct {
+	rule, sensor int64
+}
+
+// evaluation collects the state changes of one batch, they are saved together
+type evaluation struct {
+	states  map[alertKey]database.AlertState
+	changed map[alertKey]database.AlertState
+	events  []database.AlertEvent
+}
+
+func (e *Engine) newEvaluation() (*evaluation, error) {
+	current, err := e.db.GetAlertStates("")
+	if err != nil {
+		return nil, err
+	}
+	ev := &evaluation{
+		states:  make(map[alertKey]database.AlertState, len(current)),
+		changed: make(map[alertKey]database.AlertState),
+	}
+	for _, s := range current {
+		ev.states[alertKey{s.RuleID, s.SensorID}] = s
+	}
+	return ev, nil
+}
+
+// observe moves the alert of the rule and the sensor of m on with x
+func (ev *evaluation) observe(rule *database.AlertRule, m database.Measurement, x float64) {
+	state := ev.states[alertKey{rule.ID, m.SensorsId}]
+	next, changes := step(rule, state, m, x)
+	if !changes {
+		return
+	}
+	next.RuleID, next.RuleName, next.SensorID = rule.ID, rule.Name, m.SensorsId
+	ev.change(state, next, m.ID, m.Timestamp)
+}
+
+// change records the move from state to next, caused by the measurement (or the check) at timestamp
+func (ev *evaluation) change(state, next database.AlertState, measurementID int64, timestamp database.Timestamp) {
+	key := alertKey{next.RuleID, next.SensorID}
+	next.UpdatedAt = time.Now().UTC().Format(time.DateTime)
+	ev.states[key] = next
+	ev.changed[key] = next
+	ev.events = append(ev.events, database.AlertEvent{
+		RuleID:        next.RuleID,
+		SensorID:      next.SensorID,
+		From:          state.State,
+		To:            next.State,
+		Value:         next.Value,
+		MeasurementID: measurementID,
+		Timestamp:     timestamp,
+		CreatedAt:     next.UpdatedAt,
+	})
+}
+
+// save stores the changes and returns the events
+func (e *Engine) save(ev *evaluation) ([]database.AlertEvent, error) {
+	if len(ev.events) == 0 {
+		return nil, nil
+	}
+	saved := make([]database.AlertState, 0, len(ev.changed))
+	for _, s := range ev.changed {
+		saved = append(saved, s)
+	}
+	if err := e.db.SaveAlertChanges(saved, ev.events); err != nil {
+		return nil, err
+	}
+	return ev.events, nil
+}
+
+func (e *Engine) evaluate(batch []database.Measurement) ([]database.AlertEvent, error) {
+	rules, err := e.db.GetAlertRules()
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+	sensorTypes, err := e.db.GetSensorTypes()
+	if err != nil {
+		return nil, err
+	}
+	ev, err := e.newEvaluation()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range batch {
+		//readings flagged bad on insert neither raise nor resolve alerts
+		if m.Quality == database.QualityBad {
+			continue
+		}
+		for i := range rules {
+			rule := &rules[i]
+			if !rule.AppliesTo(m.SensorsId, sensorTypes[m.SensorsId]) {
+				continue
+			}
+			x, ok, err := e.observe(rule, m)
+			if err != nil {
+				return nil, err
+			} else if !ok {
+				continue
+			}
+			ev.observe(rule, m, x)
+		}
+	}
+	return e.save(ev)
+}
+
+// checkSilence evaluates the silent rules with the time since the latest reading of each sensor that has an
+// expected interval, in intervals. Sensors that never reported are silent since monitoring began, those of
+// experiments that are not running count as not silent.
+func (e *Engine) checkSilence(now time.Time) ([]database.AlertEvent, error) {
+	rules, err := e.db.GetAlertRules()
+	if err != nil {
+		return nil, err
+	}
+	rules = slices.DeleteFunc(rules, func(rule database.AlertRule) bool { return rule.Condition != database.AlertSilent })
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	statuses, err := e.db.GetSensorStatuses(database.SensorStatusFilter{}, now)
+	if err != nil {
+		return nil, err
+	}
+	ev, err := e.newEvaluation()
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range statuses {
+		if status.ExpectedInterval == 0 || status.SilentFor == nil {
+			continue
+		}
+		silent := 0.0
+		if status.Status != database.SensorInactive {
+			silent = float64(*status.SilentFor) / float64(status.ExpectedInterval)
+		}
+		m := database.Measurement{SensorsId: int64(status.ID), Timestamp: database.NewTimestamp(now)}
+		for i := range rules {
+			if rules[i].AppliesTo(m.SensorsId, status.SensorType) {
+				ev.observe(&rules[i], m, silent)
+			}
+		}
+	}
+	return e.save(ev)
+}
+
+// checkPending fires the pending alerts whose breach has lasted For by now and whose last value is still
+// breached. Without it an alert of a sensor that stopped reporting would stay pending, because only the
+// next reading moves it on.
+func (e *Engine) checkPending(now time.Time) ([]database.AlertEvent, error) {
+	states, err := e.db.GetAlertStates(database.AlertPending)
+	if err != nil || len(states) == 0 {
+		return nil, err
+	}
+	rules, err := e.db.GetAlertRules()
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]*database.AlertRule, len(rules))
+	for i := range rules {
+		byID[rules[i].ID] = &rules[i]
+	}
+	ev, err := e.newEvaluation()
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range states {
+		rule, ok := byID[state.RuleID]
+		if !ok || !rule.Breached(state.Value) || now.Sub(state.Since.Time()) < time.Duration(rule.For) {
+			continue
+		}
+		next := state
+		next.State = database.AlertFiring
+		ev.change(state, next, state.MeasurementID, database.NewTimestamp(now))
+	}
+	return e.save(ev)
+}
+
+// observe returns what the rule compares: the value, the absolute change per second since the
+// previous reading for rate rules (false for the first reading of a sensor), or 0 silent intervals
+func (e *Engine) observe(rule *database.AlertRule, m database.Measurement) (float64, bool, error) {
+	//a reading ends the silence
+	if rule.Condition == database.AlertSilent {
+		return 0, true, nil
+	}
+	if rule.Condition != database.AlertRate {
+		return m.Value, true, nil
+	}
+	prev, err := e.db.PreviousMeasurement(m.SensorsId, m.Timestamp)
+	if err != nil || prev == nil {
+		return 0, false, err
+	}
+	seconds := m.Timestamp.Time().Sub(prev.Timestamp.Time()).Seconds()
+	return math.Abs(m.Value-prev.Value) / seconds, true, nil
+}
+
+// step is the state machine of one alert: a breach makes it pending (or firing without for-duration),
+// pending turns into firing once the breach lasted For and resolves with the first value that is not
+// breached, a firing alert resolves with a cleared value
+func step(rule *database.AlertRule, state database.AlertState, m database.Measurement, x float64) (database.AlertState, bool) {
+	next := state
+	next.Value, next.MeasurementID = x, m.ID
+	switch state.State {
+	case "", database.AlertResolved:
+		if !rule.Breached(x) {
+			return state, false
+		}
+		next.Since = m.Timestamp
+		next.State = database.AlertPending
+		if rule.For == 0 {
+			next.State = database.AlertFiring
+		}
+	case database.AlertPending:
+		if !rule.Breached(x) {
+			next.State, next.Since = database.AlertResolved, m.Timestamp
+		} else if m.Timestamp.Time().Sub(state.Since.Time()) >= time.Duration(rule.For) {
+			next.State = database.AlertFiring
+		} else {
+			return state, false
+		}
+	case database.AlertFiring:
+		if !rule.Cleared(x) {
+			return state, false
+		}
+		next.State, next.Since = database.AlertResolved, m.Timestamp
+	}
+	return next, true
+}
@@ -0,0 +1,215 @@
+// Backups of the database in a directory: create (optionally gzip compressed), list, prune and restore
+package backup
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"measurements-api-stdlib-docker/database"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const timeFormat = "20060102T150405Z"
+
+// names look like experiments-20261019T112233Z.db or .db.gz, nothing else in the directory is touched
+var namePattern = regexp.MustCompile(`^experiments-\d{8}T\d{6}Z\.db(\.gz)?$`)
+
+type Info struct {
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	Compressed bool   `json:"compressed"`
+	CreatedAt  string `json:"created_at"`
+}
+
+type Manager struct {
+	db  *database.Database
+	dir string
+}
+
+func NewManager(db *database.Database, dir string) *Manager {
+	return &Manager{db: db, dir: dir}
+}
+
+func (m *Manager) path(name string) (string, error) {
+	if !namePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid backup name %q", name)
+	}
+	return filepath.Join(m.dir, name), nil
+}
+
+func info(entry os.FileInfo) Info {
+	createdAt := entry.ModTime().UTC()
+	stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(entry.Name(), "experiments-"), ".gz"), ".db")
+	if parsed, err := time.Parse(timeFormat, stamp); err == nil {
+		createdAt = parsed
+	}
+	return Info{
+		Name:       entry.Name(),
+		Size:       entry.Size(),
+		Compressed: strings.HasSuffix(entry.Name(), ".gz"),
+		CreatedAt:  createdAt.Format(time.DateTime),
+	}
+}
+
+// Create takes a consistent snapshot of the running database
+func (m *Manager) Create(compress bool) (*Info, error) {
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating backup directory: %w", err)
+	}
+	name := "experiments-" + time.Now().UTC().Format(timeFormat) + ".db"
+	path := filepath.Join(m.dir, name)
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("backup %s already exists", name)
+	}
+
+	if !compress {
+		if err := m.db.Snapshot(path); err != nil {
+			return nil, err
+		}
+	} else {
+		//VACUUM INTO can only write a plain database file
+		tmpPath := path + ".tmp"
+		defer os.Remove(tmpPath)
+		if err := m.db.Snapshot(tmpPath); err != nil {
+			return nil, err
+		}
+		name += ".gz"
+		path += ".gz"
+		if err := gzipFile(tmpPath, path); err != nil {
+			os.Remove(path)
+			return nil, err
+		}
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading backup %s: %w", name, err)
+	}
+	backup := info(stat)
+	return &backup, nil
+}
+
+// List returns the backups, newest first
+func (m *Manager) List() ([]Info, error) {
+	entries, err := os.ReadDir(m.dir)
+	if os.IsNotExist(err) {
+		return []Info{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading backup directory: %w", err)
+	}
+
+	backups := []Info{}
+	for _, entry := range entries {
+		if entry.IsDir() || !namePattern.MatchString(entry.Name()) {
+			continue
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("error reading backup %s: %w", entry.Name(), err)
+		}
+		backups = append(backups, info(stat))
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt > backups[j].CreatedAt })
+	return backups, nil
+}
+
+func (m *Manager) Delete(name string) error {
+	path, err := m.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("error deleting backup %s: %w", name, err)
+	}
+	return nil
+}
+
+// Prune keeps the newest keep backups and deletes the rest, keep <= 0 keeps everything
+func (m *Manager) Prune(keep int) ([]string, error) {
+	if keep <= 0 {
+		return []string{}, nil
+	}
+	backups, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	pruned := []string{}
+	for i := keep; i < len(backups); i++ {
+		if err := m.Delete(backups[i].Name); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, backups[i].Name)
+	}
+	return pruned, nil
+}
+
+// Restore replaces the live database with the backup. Requests must be stopped by the caller (maintenance mode).
+func (m *Manager) Restore(name string) error {
+	path, err := m.path(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("backup %s not found: %w", name, err)
+	}
+
+	if strings.HasSuffix(name, ".gz") {
+		tmpPath := strings.TrimSuffix(path, ".gz") + ".restore.tmp"
+		defer os.Remove(tmpPath)
+		if err := gunzipFile(path, tmpPath); err != nil {
+			return err
+		}
+		path = tmpPath
+	}
+	return m.db.RestoreFrom(path)
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", src, err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", dst, err)
+	}
+	defer out.Close()
+
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		return fmt.Errorf("error compressing %s: %w", src, err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("error compressing %s: %w", src, err)
+	}
+	return out.Sync()
+}
+
+func gunzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", src, err)
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("error decompressing %s: %w", src, err)
+	}
+	defer zr.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", dst, err)
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, zr); err != nil {
+		return fmt.Errorf("error decompressing %s: %w", src, err)
+	}
+	return nil
+}
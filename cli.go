@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"measurements-api-stdlib-docker/backup"
+	"measurements-api-stdlib-docker/config"
+	"measurements-api-stdlib-docker/database"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const usage = `usage:
+  measurements-api                        start the server
+  measurements-api backup [-compress]     write a backup to BACKUP_DIR
+  measurements-api backups                list the backups in BACKUP_DIR
+  measurements-api prune [-keep n]        delete all but the newest n backups
+  measurements-api restore <name>         replace the database with a backup (stop the server first)
+  measurements-api bench [-writers n] [-readers n] [-duration d]
+                                          compare concurrent throughput of the default and the configured connection settings on scratch databases
+  measurements-api bench-range [-rows n]  time range queries of an experiment on a scratch database with n measurements
+  measurements-api explain                check that the range queries use the indexes (EXPLAIN QUERY PLAN)`
+
+// runCommand runs a maintenance command instead of the server
+func runCommand(cfg *config.Config, db *database.Database, backups *backup.Manager, args []string) error {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	compress := flags.Bool("compress", cfg.Backup.Compress, "gzip the backup")
+	keep := flags.Int("keep", cfg.Backup.Keep, "number of backups to keep")
+	writers := flags.Int("writers", 8, "concurrent writers")
+	readers := flags.Int("readers", 8, "concurrent readers")
+	duration := flags.Duration("duration", 5*time.Second, "duration of each run")
+	rows := flags.Int("rows", 10_000_000, "measurements in the scratch database")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "backup":
+		info, err := backups.Create(*compress)
+		if err != nil {
+			return err
+		}
+		log.Printf("backup %s created (%v bytes)", info.Name, info.Size)
+	case "backups":
+		list, err := backups.List()
+		if err != nil {
+			return err
+		}
+		for _, info := range list {
+			fmt.Printf("%s\t%s\t%v\n", info.Name, info.CreatedAt, info.Size)
+		}
+	case "prune":
+		pruned, err := backups.Prune(*keep)
+		if err != nil {
+			return err
+		}
+		log.Printf("pruned %v backups", len(pruned))
+	case "restore":
+		if flags.NArg() != 1 {
+			return fmt.Errorf("restore needs the name of a backup\n%s", usage)
+		}
+		if err := backups.Restore(flags.Arg(0)); err != nil {
+			return err
+		}
+		log.Printf("database restored from backup %s", flags.Arg(0))
+	case "bench":
+		//SQLite defaults (rollback journal, no busy timeout, one shared pool) against the configured settings
+		legacy := database.Options{JournalMode: "DELETE", Synchronous: "FULL"}
+		for _, opts := range []database.Options{legacy, dbOptions(cfg)} {
+			if err := benchmark(opts, *writers, *readers, *duration); err != nil {
+				return err
+			}
+		}
+	case "bench-range":
+		return benchmarkRanges(dbOptions(cfg), *rows)
+	case "explain":
+		plans, err := db.CheckQueryPlans()
+		for _, plan := range plans {
+			fmt.Printf("%s (index: %v)\n", plan.Name, plan.UsesIndex)
+			for _, step := range plan.Plan {
+				fmt.Printf("\t%s\n", step)
+			}
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+	return nil
+}
+
+// benchmark runs the throughput test on an empty database in a temporary directory
+func benchmark(opts database.Options, writers, readers int, duration time.Duration) error {
+	dir, err := os.MkdirTemp("", "measurements-bench")
+	if err != nil {
+		return fmt.Errorf("error creating benchmark directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts.Path = filepath.Join(dir, "bench.db")
+	db, err := database.InitDB(opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.MeasureConcurrentThroughput(writers, readers, duration)
+	return err
+}
+
+// benchmarkRanges seeds a scratch database with one measurement per second (round robin over the 4 sensors)
+// and reads ranges of experiment Exp1 that end in the middle of the data
+func benchmarkRanges(opts database.Options, rows int) error {
+	dir, err := os.MkdirTemp("", "measurements-bench")
+	if err != nil {
+		return fmt.Errorf("error creating benchmark directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts.Path = filepath.Join(dir, "bench.db")
+	db, err := database.InitDB(opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	start := time.Now()
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := db.SeedMeasurements(rows, 4, from, time.Second); err != nil {
+		return err
+	}
+	log.Printf("seeded %v measurements; time %s", rows, time.Since(start))
+
+	until := from.Add(time.Duration(rows/2) * time.Second)
+	spans := []time.Duration{time.Minute, time.Hour, 24 * time.Hour, 7 * 24 * time.Hour}
+	_, err = db.MeasureRangeQueries("Exp1", until, spans)
+	return err
+}
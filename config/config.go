@@ -0,0 +1,224 @@
+// Runtime configuration, read from environment variables so the docker image can be tuned without a rebuild
+package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Addr     string
+	DBPath   string
+	DBTuning DBTuningConfig
+	// reaction to a second measurement with the same sensor and timestamp: "" (store it), reject, ignore or overwrite
+	ConflictPolicy string
+	// how long responses of requests with an Idempotency-Key are replayed
+	IdempotencyTTL time.Duration
+	// requests with this X-API-Key may use admin features, empty disables them
+	AdminAPIKey string
+	// proxies whose X-Forwarded-For is trusted for the client IP, comma separated, empty trusts none
+	TrustedProxies []string
+	// PUT, PATCH and DELETE of a measurement without If-Match are rejected with 428
+	RequireIfMatch bool
+	RateLimit      RateLimitConfig
+	Trash          TrashConfig
+	// how often the retention rules are enforced, 0 disables the job
+	RetentionInterval time.Duration
+	// how often alert rules on silent sensors are checked, 0 disables them
+	SilenceCheckInterval time.Duration
+	Backup               BackupConfig
+	Ingest               IngestConfig
+	Stream               StreamConfig
+	Webhook              WebhookConfig
+	// how long a shutdown waits for running requests and the last group commit
+	ShutdownTimeout time.Duration
+}
+
+// SQLite connection settings, see database.Options
+type DBTuningConfig struct {
+	JournalMode string
+	Synchronous string
+	BusyTimeout time.Duration
+	CacheSizeKB int
+	ReadConns   int
+}
+
+// A rate of 0 disables the limiter of that route group, a quota of 0 disables the daily quota
+type RateLimitConfig struct {
+	ReadRPS    float64
+	ReadBurst  int
+	WriteRPS   float64
+	WriteBurst int
+	DailyQuota int
+}
+
+// soft deleted rows are hard deleted after Retention, checked every PurgeInterval (0 disables the job)
+type TrashConfig struct {
+	Retention     time.Duration
+	PurgeInterval time.Duration
+}
+
+// inserts are collected and committed together once BatchSize measurements are waiting or after MaxDelay,
+// more than QueueSize waiting measurements are rejected (0 disables the queue, every request commits on its own)
+type IngestConfig struct {
+	BatchSize int
+	MaxDelay  time.Duration
+	QueueSize int
+}
+
+// live streams buffer Buffer measurements per subscriber, a subscriber that falls further behind catches up
+// from the database. A comment line is sent every Heartbeat so proxies keep idle streams open.
+type StreamConfig struct {
+	Buffer    int
+	Heartbeat time.Duration
+}
+
+// a delivery is given up after MaxAttempts attempts, the wait before a retry starts at Backoff and doubles
+// with every failed attempt. Timeout limits one attempt.
+type WebhookConfig struct {
+	Timeout     time.Duration
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+// snapshots are written to Dir every Interval (0 disables the job), only the newest Keep are kept (0 keeps all)
+type BackupConfig struct {
+	Dir      string
+	Interval time.Duration
+	Keep     int
+	Compress bool
+}
+
+func Load() *Config {
+	cfg := &Config{
+		Addr:   getEnv("ADDR", ":8080"),
+		DBPath: getEnv("DB_PATH", "./experiments.db"),
+		DBTuning: DBTuningConfig{
+			JournalMode: getEnv("DB_JOURNAL_MODE", "WAL"),
+			Synchronous: getEnv("DB_SYNCHRONOUS", "FULL"),
+			BusyTimeout: getEnvDuration("DB_BUSY_TIMEOUT", 5*time.Second),
+			CacheSizeKB: getEnvInt("DB_CACHE_SIZE_KB", 16*1024),
+			ReadConns:   getEnvInt("DB_READ_CONNS", 4),
+		},
+		ConflictPolicy: getEnv("DEDUPE_POLICY", ""),
+		IdempotencyTTL: getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+		AdminAPIKey:    getEnv("ADMIN_API_KEY", ""),
+		TrustedProxies: getEnvList("TRUSTED_PROXIES"),
+		RequireIfMatch: getEnvBool("REQUIRE_IF_MATCH", false),
+		RateLimit: RateLimitConfig{
+			ReadRPS:    getEnvFloat("RATE_LIMIT_READ_RPS", 50),
+			ReadBurst:  getEnvInt("RATE_LIMIT_READ_BURST", 100),
+			WriteRPS:   getEnvFloat("RATE_LIMIT_WRITE_RPS", 10),
+			WriteBurst: getEnvInt("RATE_LIMIT_WRITE_BURST", 20),
+			DailyQuota: getEnvInt("INGEST_DAILY_QUOTA", 0),
+		},
+		RetentionInterval:    getEnvDuration("RETENTION_INTERVAL", time.Hour),
+		SilenceCheckInterval: getEnvDuration("SILENCE_CHECK_INTERVAL", 30*time.Second),
+		Trash: TrashConfig{
+			Retention:     getEnvDuration("TRASH_RETENTION", 30*24*time.Hour),
+			PurgeInterval: getEnvDuration("TRASH_PURGE_INTERVAL", time.Hour),
+		},
+		Backup: BackupConfig{
+			Dir:      getEnv("BACKUP_DIR", "./backups"),
+			Interval: getEnvDuration("BACKUP_INTERVAL", 0),
+			Keep:     getEnvInt("BACKUP_KEEP", 7),
+			Compress: getEnvBool("BACKUP_COMPRESS", true),
+		},
+		Ingest: IngestConfig{
+			BatchSize: getEnvInt("INGEST_BATCH_SIZE", 500),
+			MaxDelay:  getEnvDuration("INGEST_MAX_DELAY", 5*time.Millisecond),
+			QueueSize: getEnvInt("INGEST_QUEUE_SIZE", 20000),
+		},
+		Stream: StreamConfig{
+			Buffer:    getEnvInt("STREAM_BUFFER", 256),
+			Heartbeat: getEnvDuration("STREAM_HEARTBEAT", 15*time.Second),
+		},
+		Webhook: WebhookConfig{
+			Timeout:     getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+			MaxAttempts: getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8),
+			Backoff:     getEnvDuration("WEBHOOK_BACKOFF", time.Second),
+		},
+		ShutdownTimeout: getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+	}
+	//a queued insert is acknowledged after its commit, which must survive a power loss
+	if cfg.Ingest.QueueSize > 0 {
+		switch strings.ToUpper(cfg.DBTuning.Synchronous) {
+		case "OFF", "NORMAL":
+			log.Printf("DB_SYNCHRONOUS=%s is not durable, using FULL because the ingest queue acknowledges commits", cfg.DBTuning.Synchronous)
+			cfg.DBTuning.Synchronous = "FULL"
+		}
+	}
+	return cfg
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("invalid value for %s (%q), using default %v", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("invalid value for %s (%q), using default %v", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("invalid value for %s (%q), using default %v", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("invalid value for %s (%q), using default %v", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
@@ -0,0 +1,356 @@
+// alert rules on measurements, their current state per sensor and the history of state changes
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// conditions of alert rules, rate compares the change per second to the previous reading of the sensor,
+// silent the time since the latest reading in expected intervals of the sensor
+const (
+	AlertAbove   = ">"
+	AlertBelow   = "<"
+	AlertOutside = "outside"
+	AlertRate    = "rate"
+	AlertSilent  = "silent"
+)
+
+// states of an alert, a sensor without a state row never breached the rule
+const (
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// AlertRule applies to one sensor or to all sensors of a type. The alert is pending while the condition
+// holds for less than For and fires after that (at once if For is 0). A pending alert resolves when the
+// condition no longer holds, a firing one only once the value is back by Hysteresis on the safe side of the
+// threshold, so a value close to the threshold does not flap.
+type AlertRule struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	SensorID   *int64   `json:"sensor_id,omitempty"`
+	SensorType *string  `json:"sensor_type,omitempty"`
+	Condition  string   `json:"condition"`
+	Threshold  *float64 `json:"threshold,omitempty"` // for >, < and rate (per second), silent (intervals)
+	Low        *float64 `json:"low,omitempty"`       // the safe band for outside
+	High       *float64 `json:"high,omitempty"`
+	Hysteresis float64  `json:"hysteresis"`
+	For        Duration `json:"for"`
+	CreatedAt  string   `json:"created_at"`
+}
+
+type AlertState struct {
+	RuleID        int64     `json:"rule_id"`
+	RuleName      string    `json:"rule_name"`
+	SensorID      int64     `json:"sensor_id"`
+	State         string    `json:"state"`
+	Since         Timestamp `json:"since"` // timestamp of the measurement that started the state (pending for firing alerts)
+	Value         float64   `json:"value"` // value (rate, silent intervals) of the measurement of the last change
+	MeasurementID int64     `json:"measurement_id"`
+	UpdatedAt     string    `json:"updated_at"`
+}
+
+type AlertEvent struct {
+	ID            int64     `json:"id"`
+	RuleID        int64     `json:"rule_id"`
+	SensorID      int64     `json:"sensor_id"`
+	From          string    `json:"from"` // empty for the first state of a sensor
+	To            string    `json:"to"`
+	Value         float64   `json:"value"`
+	MeasurementID int64     `json:"measurement_id"`
+	Timestamp     Timestamp `json:"timestamp"`
+	CreatedAt     string    `json:"created_at"`
+}
+
+// AlertEventFilter fields are ignored when 0
+type AlertEventFilter struct {
+	RuleID   int64
+	SensorID int64
+	Limit    int
+	Offset   int
+}
+
+func (r *AlertRule) validate() error {
+	if (r.SensorID == nil) == (r.SensorType == nil) {
+		return fmt.Errorf("%w: a rule needs either sensor_id or sensor_type", ErrInvalidField)
+	}
+	if r.Name == "" {
+		return fmt.Errorf("%w: a rule needs a name", ErrInvalidField)
+	}
+	switch r.Condition {
+	case AlertAbove, AlertBelow, AlertRate, AlertSilent:
+		if r.Threshold == nil {
+			return fmt.Errorf("%w: condition %s needs a threshold", ErrInvalidField, r.Condition)
+		}
+		if r.Condition == AlertRate && *r.Threshold <= 0 {
+			return fmt.Errorf("%w: the threshold of a rate must be positive", ErrInvalidField)
+		}
+		if r.Condition == AlertSilent && *r.Threshold < 1 {
+			return fmt.Errorf("%w: the threshold of silent is a number of intervals, at least 1", ErrInvalidField)
+		}
+		if r.Condition == AlertSilent && r.Hysteresis >= *r.Threshold {
+			return fmt.Errorf("%w: the hysteresis must be less than the threshold, a reading resolves the alert", ErrInvalidField)
+		}
+	case AlertOutside:
+		if r.Low == nil || r.High == nil || *r.Low >= *r.High {
+			return fmt.Errorf("%w: condition outside needs low < high", ErrInvalidField)
+		}
+		if 2*r.Hysteresis >= *r.High-*r.Low {
+			return fmt.Errorf("%w: the hysteresis must be less than half of the band", ErrInvalidField)
+		}
+	default:
+		return fmt.Errorf("%w: condition must be >, <, outside, rate or silent", ErrInvalidField)
+	}
+	if r.Hysteresis < 0 {
+		return fmt.Errorf("%w: hysteresis must not be negative", ErrInvalidField)
+	}
+	if r.For < 0 {
+		return fmt.Errorf("%w: for must not be negative", ErrInvalidField)
+	}
+	return nil
+}
+
+// Breached is true if x (the value, the absolute rate for rate rules or the silent intervals) violates the rule
+func (r *AlertRule) Breached(x float64) bool {
+	switch r.Condition {
+	case AlertAbove, AlertSilent:
+		return x > *r.Threshold
+	case AlertBelow:
+		return x < *r.Threshold
+	case AlertOutside:
+		return x < *r.Low || x > *r.High
+	case AlertRate:
+		return x > *r.Threshold
+	}
+	return false
+}
+
+// Cleared is true if x is back on the safe side, beyond the hysteresis
+func (r *AlertRule) Cleared(x float64) bool {
+	switch r.Condition {
+	case AlertAbove, AlertRate, AlertSilent:
+		return x <= *r.Threshold-r.Hysteresis
+	case AlertBelow:
+		return x >= *r.Threshold+r.Hysteresis
+	case AlertOutside:
+		return x >= *r.Low+r.Hysteresis && x <= *r.High-r.Hysteresis
+	}
+	return true
+}
+
+// AppliesTo is true for the sensor of the rule or for sensors of its type
+func (r *AlertRule) AppliesTo(sensorID int64, sensorType string) bool {
+	if r.SensorID != nil {
+		return *r.SensorID == sensorID
+	}
+	return *r.SensorType == sensorType
+}
+
+func (d *Database) CreateAlertRule(rule *AlertRule, actor Actor) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	return d.WithTransaction(func(tx *sql.Tx) error {
+		return insertAlertRule(tx, rule, actor)
+	})
+}
+
+// insertAlertRule stores a validated rule
+func insertAlertRule(tx *sql.Tx, rule *AlertRule, actor Actor) error {
+	rule.CreatedAt = nowUTC()
+	res, err := tx.Exec(`INSERT INTO alert_rules
+	(name, sensor_id, sensor_type, condition, threshold, low, high, hysteresis, for_seconds, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`, rule.Name, rule.SensorID, rule.SensorType, rule.Condition,
+		rule.Threshold, rule.Low, rule.High, rule.Hysteresis, rule.For.seconds(), rule.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error inserting alert rule: %w", err)
+	}
+	if rule.ID, err = res.LastInsertId(); err != nil {
+		return fmt.Errorf("error retrieving last insert ID: %w", err)
+	}
+	return writeAudit(tx, actor, AuditInsert, "alert_rule", rule.ID, nil, rule)
+}
+
+// DeleteAlertRule removes the rule and the current states of its alerts, the history is kept
+func (d *Database) DeleteAlertRule(id int64, actor Actor) error {
+	return d.WithTransaction(func(tx *sql.Tx) error {
+		rules, err := getAlertRules(tx, ` WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		if len(rules) == 0 {
+			return fmt.Errorf("%w: alert rule %v", ErrRecordNotFound, id)
+		}
+		if _, err := tx.Exec(`DELETE FROM alert_states WHERE rule_id = ?;`, id); err != nil {
+			return fmt.Errorf("error deleting states of alert rule %v: %w", id, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM alert_rules WHERE id = ?;`, id); err != nil {
+			return fmt.Errorf("error deleting alert rule %v: %w", id, err)
+		}
+		return writeAudit(tx, actor, AuditDelete, "alert_rule", id, rules[0], nil)
+	})
+}
+
+func (d *Database) GetAlertRules() ([]AlertRule, error) {
+	return getAlertRules(d.readConn, "")
+}
+
+func getAlertRules(q querier, where string, args ...any) ([]AlertRule, error) {
+	rows, err := q.Query(`SELECT id, name, sensor_id, sensor_type, condition, threshold, low, high,
+	hysteresis, for_seconds, created_at
+	FROM alert_rules`+where+` ORDER BY id;`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying alert rules: %w", err)
+	}
+	defer rows.Close()
+
+	rules := []AlertRule{}
+	for rows.Next() {
+		var r AlertRule
+		var forSeconds int64
+		if err := rows.Scan(&r.ID, &r.Name, &r.SensorID, &r.SensorType, &r.Condition, &r.Threshold, &r.Low, &r.High,
+			&r.Hysteresis, &forSeconds, &r.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning alert rule: %w", err)
+		}
+		r.For = Duration(time.Duration(forSeconds) * time.Second)
+		rules = append(rules, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over alert rules: %w", err)
+	}
+	return rules, nil
+}
+
+// GetAlertStates returns the alerts of all rules and sensors, only those in state if it is not empty
+func (d *Database) GetAlertStates(state string) ([]AlertState, error) {
+	queryDB := `SELECT s.rule_id, r.name, s.sensor_id, s.state, s.since, s.value, s.measurement_id, s.updated_at
+	FROM alert_states s
+	INNER JOIN alert_rules r ON r.id = s.rule_id`
+	params := []any{}
+	if state != "" {
+		queryDB += ` WHERE s.state = ?`
+		params = append(params, state)
+	}
+	queryDB += ` ORDER BY s.rule_id, s.sensor_id;`
+
+	states := []AlertState{}
+	scan := func(row rowScanner) (AlertState, error) {
+		var s AlertState
+		err := row.Scan(&s.RuleID, &s.RuleName, &s.SensorID, &s.State, &s.Since, &s.Value, &s.MeasurementID, &s.UpdatedAt)
+		return s, err
+	}
+	for s, err := range queryRows(d.readConn, scan, queryDB, params...) {
+		if err != nil {
+			return nil, fmt.Errorf("error querying alert states: %w", err)
+		}
+		states = append(states, s)
+	}
+	return states, nil
+}
+
+// GetAlertEvents returns the state changes, newest first
+func (d *Database) GetAlertEvents(filter AlertEventFilter) ([]AlertEvent, error) {
+	queryDB := `SELECT id, rule_id, sensor_id, from_state, to_state, value, measurement_id, timestamp, created_at
+	FROM alert_events WHERE 1 = 1`
+	params := []any{}
+	if filter.RuleID != 0 {
+		queryDB += ` AND rule_id = ?`
+		params = append(params, filter.RuleID)
+	}
+	if filter.SensorID != 0 {
+		queryDB += ` AND sensor_id = ?`
+		params = append(params, filter.SensorID)
+	}
+	queryDB += ` ORDER BY id DESC LIMIT ? OFFSET ?;`
+	params = append(params, filter.Limit, filter.Offset)
+
+	events := make([]AlertEvent, 0, filter.Limit)
+	scan := func(row rowScanner) (AlertEvent, error) {
+		var e AlertEvent
+		err := row.Scan(&e.ID, &e.RuleID, &e.SensorID, &e.From, &e.To, &e.Value, &e.MeasurementID, &e.Timestamp, &e.CreatedAt)
+		return e, err
+	}
+	for e, err := range queryRows(d.readConn, scan, queryDB, params...) {
+		if err != nil {
+			return nil, fmt.Errorf("error querying alert events: %w", err)
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// SaveAlertChanges stores the new states and appends the events to the history in one transaction,
+// the ids of the events are set
+func (d *Database) SaveAlertChanges(states []AlertState, events []AlertEvent) error {
+	return d.WithTransaction(func(tx *sql.Tx) error {
+		for _, s := range states {
+			_, err := tx.Exec(`INSERT INTO alert_states
+			(rule_id, sensor_id, state, since, value, measurement_id, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (rule_id, sensor_id) DO UPDATE SET
+				state = excluded.state,
+				since = excluded.since,
+				value = excluded.value,
+				measurement_id = excluded.measurement_id,
+				updated_at = excluded.updated_at;`, s.RuleID, s.SensorID, s.State, s.Since, s.Value, s.MeasurementID, s.UpdatedAt)
+			if err != nil {
+				return fmt.Errorf("error saving alert state of rule %v, sensor %v: %w", s.RuleID, s.SensorID, err)
+			}
+		}
+		for i := range events {
+			e := &events[i]
+			res, err := tx.Exec(`INSERT INTO alert_events
+			(rule_id, sensor_id, from_state, to_state, value, measurement_id, timestamp, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?);`, e.RuleID, e.SensorID, e.From, e.To, e.Value, e.MeasurementID, e.Timestamp, e.CreatedAt)
+			if err != nil {
+				return fmt.Errorf("error inserting alert event: %w", err)
+			}
+			if e.ID, err = res.LastInsertId(); err != nil {
+				return fmt.Errorf("error retrieving last insert ID: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// GetSensorTypes maps every sensor to its type
+func (d *Database) GetSensorTypes() (map[int64]string, error) {
+	types := make(map[int64]string)
+	scan := func(row rowScanner) (Sensor, error) {
+		var s Sensor
+		var sensorType sql.NullString
+		err := row.Scan(&s.ID, &sensorType)
+		s.SensorType = sensorType.String
+		return s, err
+	}
+	for s, err := range queryRows(d.readConn, scan, `SELECT id, sensor_type FROM sensors;`) {
+		if err != nil {
+			return nil, fmt.Errorf("error querying sensor types: %w", err)
+		}
+		types[int64(s.ID)] = s.SensorType
+	}
+	return types, nil
+}
+
+// PreviousMeasurement is the last reading of the sensor before the timestamp, nil if there is none
+func (d *Database) PreviousMeasurement(sensorID int64, before Timestamp) (*Measurement, error) {
+	return previousMeasurement(d.readConn, sensorID, before, 0)
+}
+
+// previousMeasurement leaves out the measurement with id except, so a correction is not compared to itself,
+// and bad measurements
+func previousMeasurement(q rowQuerier, sensorID int64, before Timestamp, except int64) (*Measurement, error) {
+	queryDB := `SELECT ` + measurementColumns + ` FROM measurements
+	WHERE sensors_id = ? AND timestamp < ? AND deleted_at IS NULL AND id != ? AND quality != ?
+	ORDER BY timestamp DESC LIMIT 1;`
+	m, err := scanMeasurement(q.QueryRow(queryDB, sensorID, before, except, QualityBad))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting measurement of sensor %v before %s: %w", sensorID, before, err)
+	}
+	return &m, nil
+}
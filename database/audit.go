@@ -0,0 +1,152 @@
+// append-only audit log of all mutating operations
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	AuditInsert  = "insert"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+)
+
+// Actor is the one responsible for a mutation, it is written to the audit log
+type Actor struct {
+	Name      string
+	RequestID string
+}
+
+// SystemActor is used for changes the server does on its own (seeding, jobs)
+var SystemActor = Actor{Name: "system"}
+
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	Entity    string          `json:"entity"`
+	EntityID  int64           `json:"entity_id"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	RequestID string          `json:"request_id"`
+	Timestamp string          `json:"timestamp"`
+}
+
+// AuditFilter fields are ignored when empty
+type AuditFilter struct {
+	Actor     string
+	Action    string
+	Entity    string
+	EntityID  int64
+	RequestID string
+	Since     string
+	Until     string
+	Limit     int
+	Offset    int
+}
+
+func toAuditJSON(v any) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling audit value: %w", err)
+	}
+	return string(data), nil
+}
+
+// writeAudit has to be called inside the transaction of the mutation, so the log and data never diverge
+func writeAudit(tx *sql.Tx, actor Actor, action, entity string, entityID int64, before, after any) error {
+	beforeJSON, err := toAuditJSON(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := toAuditJSON(after)
+	if err != nil {
+		return err
+	}
+	insertSQL := `INSERT INTO audit_log (actor, action, entity, entity_id, before, after, request_id, timestamp)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?);`
+	_, err = tx.Exec(insertSQL, actor.Name, action, entity, entityID, beforeJSON, afterJSON, actor.RequestID, nowUTC())
+	if err != nil {
+		return fmt.Errorf("error writing audit entry (%s %s %v): %w", action, entity, entityID, err)
+	}
+	return nil
+}
+
+func (f *AuditFilter) whereSQL() (string, []any) {
+	where := " WHERE 1 = 1"
+	params := make([]any, 0, 7)
+	if f.Actor != "" {
+		where += " AND actor = ?"
+		params = append(params, f.Actor)
+	}
+	if f.Action != "" {
+		where += " AND action = ?"
+		params = append(params, f.Action)
+	}
+	if f.Entity != "" {
+		where += " AND entity = ?"
+		params = append(params, f.Entity)
+	}
+	if f.EntityID > 0 {
+		where += " AND entity_id = ?"
+		params = append(params, f.EntityID)
+	}
+	if f.RequestID != "" {
+		where += " AND request_id = ?"
+		params = append(params, f.RequestID)
+	}
+	if f.Since != "" {
+		where += " AND timestamp >= ?"
+		params = append(params, f.Since)
+	}
+	if f.Until != "" {
+		where += " AND timestamp <= ?"
+		params = append(params, f.Until)
+	}
+	return where, params
+}
+
+// GetAuditLog returns one page of matching entries (newest first) and the total number of matches
+func (d *Database) GetAuditLog(filter AuditFilter) ([]AuditEntry, int, error) {
+	where, params := filter.whereSQL()
+
+	var total int
+	if err := d.readConn.QueryRow(`SELECT COUNT(*) FROM audit_log`+where+`;`, params...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("error counting audit entries: %w", err)
+	}
+
+	queryDB := `SELECT id, actor, action, entity, entity_id, before, after, request_id, timestamp
+	FROM audit_log` + where + ` ORDER BY id DESC LIMIT ? OFFSET ?;`
+	rows, err := d.readConn.Query(queryDB, append(params, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error querying audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make([]AuditEntry, 0, filter.Limit)
+	for rows.Next() {
+		var e AuditEntry
+		var before, after sql.NullString
+		if err := rows.Scan(&e.ID, &e.Actor, &e.Action, &e.Entity, &e.EntityID, &before, &after, &e.RequestID, &e.Timestamp); err != nil {
+			return nil, 0, fmt.Errorf("error scanning audit entry: %w", err)
+		}
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating over audit entries: %w", err)
+	}
+	return entries, total, nil
+}
@@ -0,0 +1,125 @@
+// consistent snapshots of the running database and restoring them
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// Snapshot writes a consistent copy of the database to path while the server keeps running
+func (d *Database) Snapshot(path string) error {
+	//VACUUM INTO reads in one transaction, so concurrent writes are either fully in the copy or not at all
+	if _, err := d.readConn.Exec(`VACUUM INTO ?;`, path); err != nil {
+		return fmt.Errorf("error writing snapshot to %s: %w", path, err)
+	}
+	return nil
+}
+
+// CheckSnapshot makes sure a file is an intact SQLite database before it replaces the live one
+func CheckSnapshot(path string) error {
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("error opening snapshot %s: %w", path, err)
+	}
+	defer conn.Close()
+
+	var result string
+	if err := conn.QueryRow(`PRAGMA integrity_check;`).Scan(&result); err != nil {
+		return fmt.Errorf("error checking snapshot %s: %w", path, err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("snapshot %s is corrupt: %s", path, result)
+	}
+	return nil
+}
+
+// RestoreFrom replaces the database file with the snapshot and reconnects.
+// Nothing else may use the database meanwhile, the caller has to stop all requests and background jobs first
+// (maintenance mode). If the snapshot can not be opened, the old database is opened again.
+func (d *Database) RestoreFrom(snapshot string) error {
+	if err := CheckSnapshot(snapshot); err != nil {
+		return err
+	}
+	//copy next to the database first, so the renames are atomic and a failed copy leaves the database open
+	tmpPath := d.opts.Path + ".restore"
+	defer os.Remove(tmpPath)
+	if err := copyFile(snapshot, tmpPath); err != nil {
+		return err
+	}
+	if err := d.Close(); err != nil {
+		return fmt.Errorf("error closing database: %w", err)
+	}
+
+	//the old database is kept until the snapshot was opened
+	oldPath := d.opts.Path + ".old"
+	removeJournals(d.opts.Path)
+	if err := os.Rename(d.opts.Path, oldPath); err != nil {
+		return d.reopen(fmt.Errorf("error moving database file: %w", err))
+	}
+	if err := os.Rename(tmpPath, d.opts.Path); err != nil {
+		return d.rollbackRestore(oldPath, fmt.Errorf("error replacing database file: %w", err))
+	}
+
+	//the snapshot may be from an older version
+	if err := d.open(); err != nil {
+		if closeErr := d.Close(); closeErr != nil {
+			log.Printf("error closing restored database: %s", closeErr)
+		}
+		return d.rollbackRestore(oldPath, fmt.Errorf("error reopening restored database: %w", err))
+	}
+	if err := os.Remove(oldPath); err != nil {
+		log.Printf("error removing %s: %s", oldPath, err)
+	}
+	return nil
+}
+
+// rollbackRestore moves the old database back in place after a failed restore and opens it
+func (d *Database) rollbackRestore(oldPath string, cause error) error {
+	removeJournals(d.opts.Path)
+	if err := os.Rename(oldPath, d.opts.Path); err != nil {
+		return fmt.Errorf("%w, and the old database could not be moved back from %s: %w", cause, oldPath, err)
+	}
+	return d.reopen(cause)
+}
+
+// reopen opens the old database again after a failed restore
+func (d *Database) reopen(cause error) error {
+	if err := d.open(); err != nil {
+		return fmt.Errorf("%w, and the old database could not be opened again: %w", cause, err)
+	}
+	return cause
+}
+
+// removeJournals deletes the journal files of a closed database, they must not be applied to another file
+func removeJournals(path string) {
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			log.Printf("error removing %s: %s", path+suffix, err)
+		}
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("error copying %s to %s: %w", src, dst, err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return fmt.Errorf("error syncing %s: %w", dst, err)
+	}
+	return out.Close()
+}
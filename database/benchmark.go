@@ -0,0 +1,126 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ThroughputResult struct {
+	Writers         int           `json:"writers"`
+	Readers         int           `json:"readers"`
+	Duration        time.Duration `json:"duration"`
+	Writes          int64         `json:"writes"`
+	Reads           int64         `json:"reads"`
+	WriteErrors     int64         `json:"write_errors"`
+	ReadErrors      int64         `json:"read_errors"`
+	WritesPerSecond float64       `json:"writes_per_second"`
+	ReadsPerSecond  float64       `json:"reads_per_second"`
+}
+
+// MeasureConcurrentThroughput inserts and reads measurements from parallel goroutines for the given duration.
+// It writes to the database it is called on, so only use it on a scratch database.
+func (db *Database) MeasureConcurrentThroughput(writers, readers int, duration time.Duration) (*ThroughputResult, error) {
+	actor := Actor{Name: "throughputTest"}
+	first := &Measurement{SensorsId: 1, Value: 1, Unit: "hPa"}
+	if _, err := db.InsertMeasurement(first, actor); err != nil {
+		return nil, err
+	}
+
+	result := &ThroughputResult{Writers: writers, Readers: readers, Duration: duration}
+	var firstErr atomic.Value
+	deadline := time.Now().Add(duration)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				m := &Measurement{SensorsId: 1, Value: float64(w), Unit: "hPa"}
+				if _, err := db.InsertMeasurement(m, actor); err != nil {
+					atomic.AddInt64(&result.WriteErrors, 1)
+					firstErr.CompareAndSwap(nil, err)
+					continue
+				}
+				atomic.AddInt64(&result.Writes, 1)
+			}
+		}()
+	}
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				if _, err := db.GetMeasurementById(int(first.ID), false); err != nil {
+					atomic.AddInt64(&result.ReadErrors, 1)
+					firstErr.CompareAndSwap(nil, err)
+					continue
+				}
+				atomic.AddInt64(&result.Reads, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	result.WritesPerSecond = float64(result.Writes) / duration.Seconds()
+	result.ReadsPerSecond = float64(result.Reads) / duration.Seconds()
+	log.Printf("journal %s, %v read conns, %v writers, %v readers: %.0f writes/s (%v errors), %.0f reads/s (%v errors)",
+		db.opts.JournalMode, db.opts.ReadConns, writers, readers,
+		result.WritesPerSecond, result.WriteErrors, result.ReadsPerSecond, result.ReadErrors)
+	if err := firstErr.Load(); err != nil {
+		log.Printf("first error: %s", err)
+	}
+	return result, nil
+}
+
+// SeedMeasurements inserts raw measurements spread round robin over the sensors 1..sensors, one every step
+// starting at start. Only for benchmarks: there are no revisions, rollups or audit entries for these rows.
+func (db *Database) SeedMeasurements(rows, sensors int, start time.Time, step time.Duration) error {
+	const chunk = 1_000_000
+	for offset := 0; offset < rows; offset += chunk {
+		n := min(chunk, rows-offset)
+		err := db.WithTransaction(func(tx *sql.Tx) error {
+			_, err := tx.Exec(`WITH RECURSIVE seq(i) AS (SELECT ? UNION ALL SELECT i + 1 FROM seq WHERE i < ?)
+			INSERT INTO measurements (sensors_id, value, unit, timestamp)
+			SELECT 1 + i % ?, abs(random() % 10000) / 100.0, 'seed', ? + i * ?
+			FROM seq;`, offset, offset+n-1, sensors, NewTimestamp(start), int64(step))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error seeding measurements: %w", err)
+		}
+	}
+	return nil
+}
+
+type RangeQueryResult struct {
+	Span     string        `json:"span"`
+	Rows     int           `json:"rows"`
+	Duration time.Duration `json:"duration"`
+}
+
+// MeasureRangeQueries reads the measurements of an experiment in time ranges of the given spans, ending at until
+func (db *Database) MeasureRangeQueries(experiment string, until time.Time, spans []time.Duration) ([]RangeQueryResult, error) {
+	results := make([]RangeQueryResult, 0, len(spans))
+	for _, span := range spans {
+		start := time.Now()
+		rows, err := db.StreamMeasurementsByExperiment(experiment, NewTimestamp(until.Add(-span)).String(), NewTimestamp(until).String(), false, nil)
+		if err != nil {
+			return nil, err
+		}
+		n := 0
+		for _, err := range rows {
+			if err != nil {
+				return nil, err
+			}
+			n++
+		}
+		result := RangeQueryResult{Span: span.String(), Rows: n, Duration: time.Since(start)}
+		log.Printf("range %s of experiment %s: %v rows; time %s", result.Span, experiment, result.Rows, result.Duration)
+		results = append(results, result)
+	}
+	return results, nil
+}
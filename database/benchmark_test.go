@@ -0,0 +1,57 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestDB opens a fresh database in a temporary directory with the settings of the server
+func openTestDB(tb testing.TB) *Database {
+	tb.Helper()
+	db, err := InitDB(Options{Path: filepath.Join(tb.TempDir(), "test.db"), ReadConns: 4, BusyTimeout: 5 * time.Second})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	return db
+}
+
+func BenchmarkInsertMeasurement(b *testing.B) {
+	db := openTestDB(b)
+	actor := Actor{Name: "benchmark"}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			m := &Measurement{SensorsId: 1, Value: 1013, Unit: "hPa"}
+			if _, err := db.InsertMeasurement(m, actor); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkRangeQuery(b *testing.B) {
+	db := openTestDB(b)
+	const rows = 100_000
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := db.SeedMeasurements(rows, 4, from, time.Second); err != nil {
+		b.Fatal(err)
+	}
+	until := from.Add(rows / 2 * time.Second)
+	for _, span := range []time.Duration{time.Minute, time.Hour, 24 * time.Hour} {
+		b.Run(span.String(), func(b *testing.B) {
+			for range b.N {
+				measurements, err := db.StreamMeasurementsByExperiment("Exp1", NewTimestamp(until.Add(-span)).String(), NewTimestamp(until).String(), false, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, err := range measurements {
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
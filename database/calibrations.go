@@ -0,0 +1,284 @@
+// calibrations of sensors: stored values stay raw, reads add the calibrated value
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"math"
+)
+
+// Calibration corrects the raw values of a sensor from ValidFrom until ValidTo (open ended without) with the
+// polynomial Coefficients[0] + Coefficients[1]*x + Coefficients[2]*x² + ..., in the canonical unit of the sensor.
+// If calibrations overlap the one with the latest ValidFrom is in force.
+type Calibration struct {
+	ID           int64      `json:"id"`
+	SensorID     int64      `json:"sensor_id"`
+	Coefficients []float64  `json:"coefficients"`
+	ValidFrom    Timestamp  `json:"valid_from"`
+	ValidTo      *Timestamp `json:"valid_to,omitempty"`
+	Certificate  string     `json:"certificate,omitempty"` // reference to the calibration certificate
+	CreatedAt    string     `json:"created_at"`
+}
+
+func (c *Calibration) validate() error {
+	if len(c.Coefficients) == 0 {
+		return fmt.Errorf("%w: a calibration needs coefficients, [offset, gain] for a linear one", ErrInvalidField)
+	}
+	for _, coefficient := range c.Coefficients {
+		if math.IsNaN(coefficient) || math.IsInf(coefficient, 0) {
+			return fmt.Errorf("%w: coefficients must be finite numbers", ErrInvalidField)
+		}
+	}
+	if c.ValidFrom.IsZero() {
+		return fmt.Errorf("%w: valid_from is required", ErrInvalidField)
+	}
+	if c.ValidTo != nil && *c.ValidTo <= c.ValidFrom {
+		return fmt.Errorf("%w: valid_to must be after valid_from", ErrInvalidField)
+	}
+	return nil
+}
+
+// covers is true if the calibration is valid at t
+func (c *Calibration) covers(t Timestamp) bool {
+	return c.ValidFrom <= t && (c.ValidTo == nil || t < *c.ValidTo)
+}
+
+// Apply evaluates the polynomial at the raw value
+func (c *Calibration) Apply(raw float64) float64 {
+	calibrated := 0.0
+	for i := len(c.Coefficients) - 1; i >= 0; i-- {
+		calibrated = calibrated*raw + c.Coefficients[i]
+	}
+	return calibrated
+}
+
+// calibrations of the sensors, each ordered by valid_from, latest first
+type calibrations map[int64][]Calibration
+
+func loadCalibrations(q querier, where string, args ...any) (calibrations, error) {
+	list, err := getCalibrations(q, where, args...)
+	if err != nil {
+		return nil, err
+	}
+	cs := make(calibrations)
+	for _, c := range list {
+		cs[c.SensorID] = append(cs[c.SensorID], c)
+	}
+	return cs, nil
+}
+
+// inForce returns the calibration of the sensor at t, nil if there is none
+func (cs calibrations) inForce(sensorID int64, t Timestamp) *Calibration {
+	for i, c := range cs[sensorID] {
+		if c.covers(t) {
+			return &cs[sensorID][i]
+		}
+	}
+	return nil
+}
+
+// calibrate returns the calibrated value and the calibration used, the raw value without a calibration
+func (cs calibrations) calibrate(sensorID int64, t Timestamp, raw float64) (*float64, *int64) {
+	c := cs.inForce(sensorID, t)
+	if c == nil {
+		return &raw, nil
+	}
+	calibrated := c.Apply(raw)
+	return &calibrated, &c.ID
+}
+
+func (cs calibrations) measurement(m *Measurement) {
+	m.CalibratedValue, m.CalibrationID = cs.calibrate(m.SensorsId, m.Timestamp, m.Value)
+}
+
+func (cs calibrations) response(m *MeasurementResponse) {
+	m.CalibratedValue, m.CalibrationID = cs.calibrate(m.sensorID, m.Timestamp, m.Value)
+}
+
+// calibrationCache loads the calibrations of a sensor when the first row of the sensor is calibrated,
+// a read only loads those of the sensors in its result and each of them once
+type calibrationCache struct {
+	q      querier
+	cs     calibrations
+	loaded map[int64]bool
+}
+
+func newCalibrationCache(q querier) *calibrationCache {
+	return &calibrationCache{q: q, cs: make(calibrations), loaded: make(map[int64]bool)}
+}
+
+func (c *calibrationCache) load(sensorID int64) (calibrations, error) {
+	if !c.loaded[sensorID] {
+		cs, err := loadCalibrations(c.q, ` WHERE sensors_id = ?`, sensorID)
+		if err != nil {
+			return nil, err
+		}
+		c.cs[sensorID] = cs[sensorID]
+		c.loaded[sensorID] = true
+	}
+	return c.cs, nil
+}
+
+func measurementSensor(m *Measurement) int64 { return m.SensorsId }
+
+func responseSensor(m *MeasurementResponse) int64 { return m.sensorID }
+
+// connQuerier runs queries on one connection of a pool
+type connQuerier struct {
+	conn *sql.Conn
+}
+
+func (c connQuerier) Query(query string, args ...any) (*sql.Rows, error) {
+	return c.conn.QueryContext(context.Background(), query, args...)
+}
+
+// calibrated yields the rows of the query with the calibrated values, sensor returns the sensor of a row.
+// The calibrations of a sensor are loaded with its first row on the connection of the query, so a stream
+// never waits for a second connection of the pool.
+func calibrated[T any](db *sql.DB, scan func(rowScanner) (T, error), sensor func(*T) int64, apply func(calibrations, *T),
+	query string, args ...any) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			var zero T
+			yield(zero, fmt.Errorf("error getting a connection: %w", err))
+			return
+		}
+		defer conn.Close()
+		q := connQuerier{conn}
+		cache := newCalibrationCache(q)
+		for row, err := range queryRows(q, scan, query, args...) {
+			if err == nil {
+				var cs calibrations
+				if cs, err = cache.load(sensor(&row)); err == nil {
+					apply(cs, &row)
+				}
+			}
+			if !yield(row, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// calibrateOne adds the calibrated value to m
+func calibrateOne(q querier, m *Measurement) error {
+	cs, err := loadCalibrations(q, ` WHERE sensors_id = ?`, m.SensorsId)
+	if err != nil {
+		return err
+	}
+	cs.measurement(m)
+	return nil
+}
+
+// Calibrate adds the calibrated values to measurements that were not read by a query, like those of live streams
+func (d *Database) Calibrate(measurements []Measurement) error {
+	return calibrateAll(d.readConn, measurements)
+}
+
+// calibrateAll adds the calibrated values to the measurements
+func calibrateAll(q querier, measurements []Measurement) error {
+	if len(measurements) == 0 {
+		return nil
+	}
+	cache := newCalibrationCache(q)
+	for i := range measurements {
+		cs, err := cache.load(measurements[i].SensorsId)
+		if err != nil {
+			return err
+		}
+		cs.measurement(&measurements[i])
+	}
+	return nil
+}
+
+func (d *Database) CreateCalibration(c *Calibration, actor Actor) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	coefficients, err := json.Marshal(c.Coefficients)
+	if err != nil {
+		return fmt.Errorf("error marshalling coefficients: %w", err)
+	}
+	return d.WithTransaction(func(tx *sql.Tx) error {
+		if _, err := sensorQuantity(tx, c.SensorID); errors.Is(err, ErrInvalidField) {
+			return fmt.Errorf("%w: sensor %v", ErrRecordNotFound, c.SensorID)
+		} else if err != nil {
+			return err
+		}
+		if err := checkWritable(tx, c.SensorID); err != nil {
+			return err
+		}
+		c.CreatedAt = nowUTC()
+		res, err := tx.Exec(`INSERT INTO sensor_calibrations
+		(sensors_id, coefficients, valid_from, valid_to, certificate, created_at)
+		VALUES (?, ?, ?, ?, ?, ?);`, c.SensorID, string(coefficients), c.ValidFrom, c.ValidTo, c.Certificate, c.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("error inserting calibration: %w", err)
+		}
+		if c.ID, err = res.LastInsertId(); err != nil {
+			return fmt.Errorf("error retrieving last insert ID: %w", err)
+		}
+		return writeAudit(tx, actor, AuditInsert, "calibration", c.ID, nil, c)
+	})
+}
+
+// DeleteCalibration removes a calibration of the sensor, reads use the calibration in force without it
+func (d *Database) DeleteCalibration(sensorID, id int64, actor Actor) error {
+	return d.WithTransaction(func(tx *sql.Tx) error {
+		list, err := getCalibrations(tx, ` WHERE id = ? AND sensors_id = ?`, id, sensorID)
+		if err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			return fmt.Errorf("%w: calibration %v of sensor %v", ErrRecordNotFound, id, sensorID)
+		}
+		if err := checkWritable(tx, sensorID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM sensor_calibrations WHERE id = ?;`, id); err != nil {
+			return fmt.Errorf("error deleting calibration %v: %w", id, err)
+		}
+		return writeAudit(tx, actor, AuditDelete, "calibration", id, list[0], nil)
+	})
+}
+
+// GetCalibrations returns the calibrations of the sensor, latest valid_from first
+func (d *Database) GetCalibrations(sensorID int64) ([]Calibration, error) {
+	if _, err := sensorQuantity(d.readConn, sensorID); errors.Is(err, ErrInvalidField) {
+		return nil, fmt.Errorf("%w: sensor %v", ErrRecordNotFound, sensorID)
+	} else if err != nil {
+		return nil, err
+	}
+	return getCalibrations(d.readConn, ` WHERE sensors_id = ?`, sensorID)
+}
+
+func getCalibrations(q querier, where string, args ...any) ([]Calibration, error) {
+	rows, err := q.Query(`SELECT id, sensors_id, coefficients, valid_from, valid_to, certificate, created_at
+	FROM sensor_calibrations`+where+` ORDER BY sensors_id, valid_from DESC, id DESC;`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying calibrations: %w", err)
+	}
+	defer rows.Close()
+
+	list := []Calibration{}
+	for rows.Next() {
+		var c Calibration
+		var coefficients string
+		if err := rows.Scan(&c.ID, &c.SensorID, &coefficients, &c.ValidFrom, &c.ValidTo, &c.Certificate, &c.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning calibration: %w", err)
+		}
+		if err := json.Unmarshal([]byte(coefficients), &c.Coefficients); err != nil {
+			return nil, fmt.Errorf("error reading coefficients of calibration %v: %w", c.ID, err)
+		}
+		list = append(list, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over calibrations: %w", err)
+	}
+	return list, nil
+}
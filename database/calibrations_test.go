@@ -0,0 +1,53 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a stream loads the calibrations on its own connection, one connection in the read pool is enough
+func TestStreamCalibratedOneConnection(t *testing.T) {
+	db, err := InitDB(Options{Path: filepath.Join(t.TempDir(), "test.db"), ReadConns: 1, BusyTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	actor := Actor{Name: "test"}
+	base := time.Now().Add(-time.Hour)
+	c := &Calibration{SensorID: 1, Coefficients: []float64{1, 2}, ValidFrom: NewTimestamp(base)}
+	if err := db.CreateCalibration(c, actor); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		m := &Measurement{SensorsId: 1, Value: float64(i), Unit: "hPa", Timestamp: NewTimestamp(base.Add(time.Duration(i) * time.Minute))}
+		if _, err := db.InsertMeasurement(m, actor); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n := 0
+		for m, err := range db.StreamMeasurements(false, nil) {
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if m.CalibratedValue == nil || *m.CalibratedValue != 1+2*m.Value || m.CalibrationID == nil || *m.CalibrationID != c.ID {
+				t.Errorf("measurement %v: calibrated value %v with calibration %v, want %v with %v", m.ID,
+					m.CalibratedValue, m.CalibrationID, 1+2*m.Value, c.ID)
+			}
+			n++
+		}
+		if n != 3 {
+			t.Errorf("streamed %v measurements, want 3", n)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream is waiting for a second connection")
+	}
+}
@@ -0,0 +1,249 @@
+// comparison of runs: repeated experiments overlaid on the time elapsed since their start
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"measurements-api-stdlib-docker/units"
+	"time"
+)
+
+// readQuerier is implemented by *sql.DB and *sql.Tx
+type readQuerier interface {
+	querier
+	rowQuerier
+}
+
+// maxComparisonCells limits the grid, a small step over a long run would return huge arrays
+const maxComparisonCells = 10000
+
+// RunComparison holds one series per experiment on a common grid, cell i covers
+// [Elapsed[i], Elapsed[i] + Step) after the start of each run. Mean, Min and Max are taken point-wise
+// over the runs with a value in the cell, RunsWithData counts them.
+type RunComparison struct {
+	SensorType   string        `json:"sensor_type"`
+	Unit         string        `json:"unit"`
+	Step         string        `json:"step"`
+	Elapsed      []float64     `json:"elapsed_seconds"`
+	Runs         []ComparedRun `json:"runs"`
+	Mean         []*float64    `json:"mean"`
+	Min          []*float64    `json:"min"`
+	Max          []*float64    `json:"max"`
+	RunsWithData []int         `json:"runs_with_data"`
+}
+
+// ComparedRun is the series of one experiment, Values[i] is the mean of its readings in cell i, nil without any
+type ComparedRun struct {
+	Experiment Experiment `json:"experiment"`
+	Start      *Timestamp `json:"start,omitempty"` // started_at, the first reading if the experiment was never started, nil without any
+	Values     []*float64 `json:"values"`
+}
+
+// ComparisonQuery selects the sensors of SensorType in the Experiments (names or ids).
+// Without a Duration the grid spans the longest run.
+type ComparisonQuery struct {
+	Experiments []string
+	SensorType  string
+	Step        time.Duration
+	Duration    time.Duration
+	Qualities   []string
+}
+
+// CompareRuns resamples the readings of the sensor type in each experiment onto a grid of elapsed time.
+// The values are raw, like those of aggregates, in the canonical unit of the sensors.
+func (d *Database) CompareRuns(q ComparisonQuery) (*RunComparison, error) {
+	if len(q.Experiments) < 2 {
+		return nil, fmt.Errorf("%w: a comparison needs at least two experiments", ErrInvalidField)
+	}
+	if q.SensorType == "" {
+		return nil, fmt.Errorf("%w: sensor_type is required", ErrInvalidField)
+	}
+	if q.Step < time.Millisecond {
+		return nil, fmt.Errorf("%w: step must be at least 1ms", ErrInvalidField)
+	}
+	if q.Duration < 0 {
+		return nil, fmt.Errorf("%w: duration must not be negative", ErrInvalidField)
+	}
+	if q.Duration > 0 && int64(q.Duration/q.Step) > maxComparisonCells {
+		return nil, fmt.Errorf("%w: more than %v steps, use a larger step or a shorter duration", ErrInvalidField, maxComparisonCells)
+	}
+
+	result := &RunComparison{SensorType: q.SensorType, Step: q.Step.String(), Runs: []ComparedRun{}}
+	quantity, quantityOf := "", ""
+	cells := make([]map[int64]float64, len(q.Experiments))
+	var length int64
+	if q.Duration > 0 {
+		length = int64((q.Duration + q.Step - 1) / q.Step)
+	}
+	for i, ref := range q.Experiments {
+		e, err := getExperiment(d.readConn, ref, false)
+		if err != nil {
+			return nil, err
+		}
+		runQuantity, err := comparedQuantity(d.readConn, e, q.SensorType)
+		if err != nil {
+			return nil, err
+		}
+		if quantity != "" && runQuantity != "" && runQuantity != quantity {
+			return nil, fmt.Errorf("%w: the %s sensors measure %s in %s and %s in %s", ErrInvalidField,
+				q.SensorType, quantity, quantityOf, runQuantity, e.Name)
+		} else if runQuantity != "" {
+			quantity, quantityOf = runQuantity, e.Name
+		}
+		run := ComparedRun{Experiment: *e}
+		start, err := runStart(d.readConn, e, q.SensorType)
+		if err != nil {
+			return nil, err
+		}
+		if !start.IsZero() {
+			run.Start = &start
+			if cells[i], err = runCells(d.readConn, q, e, start); err != nil {
+				return nil, err
+			}
+		}
+		if q.Duration == 0 {
+			for cell := range cells[i] {
+				length = max(length, cell+1)
+			}
+		}
+		result.Runs = append(result.Runs, run)
+	}
+	if length > maxComparisonCells {
+		return nil, fmt.Errorf("%w: the longest run has more than %v steps, use a larger step or a duration", ErrInvalidField, maxComparisonCells)
+	}
+	if canonical, ok := units.Canonical(quantity); ok {
+		result.Unit = canonical.Symbol
+	}
+
+	result.Elapsed = make([]float64, length)
+	result.Mean = make([]*float64, length)
+	result.Min = make([]*float64, length)
+	result.Max = make([]*float64, length)
+	result.RunsWithData = make([]int, length)
+	for i := range result.Runs {
+		result.Runs[i].Values = make([]*float64, length)
+	}
+	for cell := range length {
+		result.Elapsed[cell] = (time.Duration(cell) * q.Step).Seconds()
+		var sum float64
+		for i := range result.Runs {
+			value, ok := cells[i][cell]
+			if !ok {
+				continue
+			}
+			result.Runs[i].Values[cell] = &value
+			if result.RunsWithData[cell] == 0 || value < *result.Min[cell] {
+				result.Min[cell] = &value
+			}
+			if result.RunsWithData[cell] == 0 || value > *result.Max[cell] {
+				result.Max[cell] = &value
+			}
+			sum += value
+			result.RunsWithData[cell]++
+		}
+		if result.RunsWithData[cell] > 0 {
+			mean := sum / float64(result.RunsWithData[cell])
+			result.Mean[cell] = &mean
+		}
+	}
+	return result, nil
+}
+
+// comparedQuantity returns the quantity of the sensors of the type in the experiment, "" if it is not known yet
+func comparedQuantity(q querier, e *Experiment, sensorType string) (string, error) {
+	rows, err := q.Query(`SELECT quantity FROM sensors WHERE experiment_id = ? AND sensor_type = ?;`, e.ID, sensorType)
+	if err != nil {
+		return "", fmt.Errorf("error querying sensors of experiment %s: %w", e.Name, err)
+	}
+	defer rows.Close()
+	sensors := 0
+	quantity := ""
+	for rows.Next() {
+		var sensorQuantity string
+		if err := rows.Scan(&sensorQuantity); err != nil {
+			return "", fmt.Errorf("error scanning quantity: %w", err)
+		}
+		sensors++
+		if sensorQuantity == "" || sensorQuantity == quantity {
+			continue
+		}
+		if quantity != "" {
+			return "", fmt.Errorf("%w: the %s sensors of experiment %s measure %s and %s", ErrInvalidField,
+				sensorType, e.Name, quantity, sensorQuantity)
+		}
+		quantity = sensorQuantity
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("error iterating over sensors: %w", err)
+	}
+	if sensors == 0 {
+		return "", fmt.Errorf("%w: experiment %s has no %s sensor", ErrInvalidField, e.Name, sensorType)
+	}
+	return quantity, nil
+}
+
+// runStart is the time the experiment was first started, the first reading of the sensor type
+// for experiments without started_at and 0 if there is none
+func runStart(q rowQuerier, e *Experiment, sensorType string) (Timestamp, error) {
+	if e.StartedAt != nil {
+		started, err := time.Parse(time.DateTime, *e.StartedAt)
+		if err != nil {
+			return 0, fmt.Errorf("error reading started_at of experiment %s: %w", e.Name, err)
+		}
+		return NewTimestamp(started), nil
+	}
+	var first sql.NullInt64
+	err := q.QueryRow(`SELECT MIN(m.timestamp) FROM measurements m JOIN sensors s ON s.id = m.sensors_id
+	WHERE s.experiment_id = ? AND s.sensor_type = ? AND m.deleted_at IS NULL;`, e.ID, sensorType).Scan(&first)
+	if err != nil {
+		return 0, fmt.Errorf("error getting the first reading of experiment %s: %w", e.Name, err)
+	}
+	return Timestamp(first.Int64), nil
+}
+
+// runCells returns the mean of the readings per cell of the grid, readings before the start are left out.
+// Without a duration the run is checked against maxComparisonCells before its readings are grouped.
+func runCells(q readQuerier, query ComparisonQuery, e *Experiment, start Timestamp) (map[int64]float64, error) {
+	step := int64(query.Step)
+	from := `
+	FROM measurements m JOIN sensors s ON s.id = m.sensors_id
+	WHERE s.experiment_id = ? AND s.sensor_type = ? AND m.deleted_at IS NULL AND m.timestamp >= ?`
+	args := []any{e.ID, query.SensorType, start}
+	if query.Duration > 0 {
+		from += ` AND m.timestamp < ?`
+		args = append(args, start+Timestamp(query.Duration))
+	}
+	where, params := qualitySQL("m", query.Qualities)
+	from += where
+	args = append(args, params...)
+	if query.Duration == 0 {
+		var last sql.NullInt64
+		if err := q.QueryRow(`SELECT MAX(m.timestamp)`+from+`;`, args...).Scan(&last); err != nil {
+			return nil, fmt.Errorf("error getting the last reading of experiment %s: %w", e.Name, err)
+		}
+		if last.Valid && (last.Int64-int64(start))/step >= maxComparisonCells {
+			return nil, fmt.Errorf("%w: the run of experiment %s has more than %v steps, use a larger step or a duration",
+				ErrInvalidField, e.Name, maxComparisonCells)
+		}
+	}
+	rows, err := q.Query(`SELECT (m.timestamp - ?) / ? AS cell, AVG(m.value)`+from+` GROUP BY cell ORDER BY cell;`,
+		append([]any{start, step}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("error resampling experiment %s: %w", e.Name, err)
+	}
+	defer rows.Close()
+
+	cells := make(map[int64]float64)
+	for rows.Next() {
+		var cell int64
+		var mean float64
+		if err := rows.Scan(&cell, &mean); err != nil {
+			return nil, fmt.Errorf("error scanning cell: %w", err)
+		}
+		cells[cell] = mean
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over cells: %w", err)
+	}
+	return cells, nil
+}
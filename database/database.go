@@ -3,8 +3,13 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
+	"measurements-api-stdlib-docker/units"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -32,29 +37,114 @@ func (db *Database) WithTransaction(fn func(transaction *sql.Tx) error) error {
 	return nil
 }
 
-func InitDB() (*Database, error) {
+func InitDB(opts Options) (*Database, error) {
+	if opts.Path == "" {
+		opts.Path = "./experiments.db"
+	}
+	switch opts.ConflictPolicy {
+	case ConflictAllow, ConflictReject, ConflictIgnore, ConflictOverwrite:
+	default:
+		return nil, fmt.Errorf("unknown conflict policy %q", opts.ConflictPolicy)
+	}
+	if opts.JournalMode == "" {
+		opts.JournalMode = "WAL"
+	}
+	opts.JournalMode = strings.ToUpper(opts.JournalMode)
+	switch opts.JournalMode {
+	case "WAL", "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "OFF":
+	default:
+		return nil, fmt.Errorf("unknown journal mode %q", opts.JournalMode)
+	}
+	if opts.Synchronous == "" {
+		opts.Synchronous = "FULL"
+	}
+	opts.Synchronous = strings.ToUpper(opts.Synchronous)
+	switch opts.Synchronous {
+	case "OFF", "NORMAL", "FULL", "EXTRA":
+	default:
+		return nil, fmt.Errorf("unknown synchronous level %q", opts.Synchronous)
+	}
+
+	db := &Database{opts: opts}
+	if err := db.open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// dsn adds the connection settings to opts.Path, the driver applies them to every new connection
+func (db *Database) dsn(readOnly bool) string {
+	params := url.Values{}
+	params.Set("_synchronous", db.opts.Synchronous)
+	params.Set("_busy_timeout", strconv.FormatInt(db.opts.BusyTimeout.Milliseconds(), 10))
+	if db.opts.CacheSizeKB > 0 {
+		//negative sizes are KiB instead of pages
+		params.Set("_cache_size", strconv.Itoa(-db.opts.CacheSizeKB))
+	}
+	if readOnly {
+		params.Set("mode", "ro")
+	} else {
+		//the journal mode is stored in the file, only the writer sets it
+		params.Set("_journal_mode", db.opts.JournalMode)
+		//take the write lock at BEGIN, a read lock upgraded later can fail without waiting for busy_timeout
+		params.Set("_txlock", "immediate")
+	}
+	return "file:" + db.opts.Path + "?" + params.Encode()
+}
+
+// open connects to opts.Path and brings the schema up to date
+func (db *Database) open() error {
 	//Open Connection and Create BasicTable
-	connection, err := sql.Open("sqlite3", "./experiments.db")
+	connection, err := sql.Open("sqlite3", db.dsn(false))
 	if err != nil {
 		log.Println("Error opening the database: ", err)
-		return nil, err
+		return err
+	}
+	db.dbConn = connection
+	db.readConn = connection
+	//a restored snapshot has other webhooks
+	db.resetSubscriptions()
+	if db.opts.ReadConns > 0 {
+		//SQLite allows one writer at a time, one connection queues the writes in Go instead of failing with "database is locked"
+		connection.SetMaxOpenConns(1)
 	}
-
-	db := &Database{dbConn: connection}
 
 	//Create tables with transaction
 	err = db.WithTransaction(db.createTables)
 	if err != nil {
-		return nil, fmt.Errorf("error creating tables: %w", err)
+		return fmt.Errorf("error creating tables: %w", err)
+	}
+
+	//Add columns that older databases are missing
+	err = db.WithTransaction(db.migrateTables)
+	if err != nil {
+		return fmt.Errorf("error migrating tables: %w", err)
+	}
+
+	//Unique (sensor, timestamp) only if duplicates are not allowed
+	err = db.WithTransaction(db.applyConflictPolicy)
+	if err != nil {
+		return fmt.Errorf("error applying conflict policy: %w", err)
 	}
 
 	//Initialise tables with transaction
 	err = db.WithTransaction(db.initTables)
 	if err != nil {
-		return nil, fmt.Errorf("error initialising tables: %w", err)
+		return fmt.Errorf("error initialising tables: %w", err)
 	}
 
-	return db, nil
+	//readers are opened after the schema exists, a read-only connection cannot create it
+	if db.opts.ReadConns > 0 {
+		readers, err := sql.Open("sqlite3", db.dsn(true))
+		if err != nil {
+			return fmt.Errorf("error opening read connections: %w", err)
+		}
+		readers.SetMaxOpenConns(db.opts.ReadConns)
+		readers.SetMaxIdleConns(db.opts.ReadConns)
+		db.readConn = readers
+	}
+
+	return nil
 }
 
 func (db *Database) createTables(tx *sql.Tx) error {
@@ -65,22 +155,183 @@ func (db *Database) createTables(tx *sql.Tx) error {
             id INTEGER PRIMARY KEY AUTOINCREMENT,
             name TEXT,
             description TEXT,
-            date DATE DEFAULT CURRENT_DATE
+            date DATE DEFAULT CURRENT_DATE,
+            deleted_at TEXT,
+            state TEXT NOT NULL DEFAULT 'draft',
+            started_at TEXT,
+            ended_at TEXT
         );`,
 		`CREATE TABLE IF NOT EXISTS sensors (
             id INTEGER PRIMARY KEY AUTOINCREMENT,
             experiment_id INTEGER,
             sensor_type TEXT,
+            quantity TEXT NOT NULL DEFAULT '',
+            expected_interval_seconds INTEGER NOT NULL DEFAULT 0,
             FOREIGN KEY (experiment_id) REFERENCES experiments(id)
         );`,
-		`CREATE TABLE IF NOT EXISTS measurements (
+		createMeasurementsSQL("measurements"),
+		createRevisionsSQL("measurement_revisions"),
+		`CREATE TABLE IF NOT EXISTS idempotency_keys (
+            client TEXT NOT NULL,
+            key TEXT NOT NULL,
+            request_hash TEXT NOT NULL,
+            status INTEGER NOT NULL DEFAULT 0,
+            body BLOB,
+            location TEXT,
+            created_at TEXT NOT NULL,
+            PRIMARY KEY (client, key)
+        );`,
+		`CREATE TABLE IF NOT EXISTS retention_rules (
             id INTEGER PRIMARY KEY AUTOINCREMENT,
-            sensors_id INTEGER,
-			value REAL,
-			unit TEXT,
-            timestamp TEXT DEFAULT CURRENT_TIMESTAMP,
+            experiment_id INTEGER,
+            sensor_id INTEGER,
+            raw_retention_seconds INTEGER NOT NULL,
+            downsample_interval_seconds INTEGER NOT NULL DEFAULT 0,
+            downsample_retention_seconds INTEGER NOT NULL DEFAULT 0,
+            created_at TEXT,
+            FOREIGN KEY (experiment_id) REFERENCES experiments(id),
+            FOREIGN KEY (sensor_id) REFERENCES sensors(id)
+        );`,
+		//migration 11 adds the quality to the downsamples and the rollups
+		`CREATE TABLE IF NOT EXISTS measurement_downsamples (
+            sensors_id INTEGER NOT NULL,
+            interval_seconds INTEGER NOT NULL,
+            bucket_start TEXT NOT NULL,
+            unit TEXT,
+            count INTEGER NOT NULL,
+            avg REAL,
+            min REAL,
+            max REAL,
+            PRIMARY KEY (sensors_id, interval_seconds, bucket_start, unit)
+        );`,
+		`CREATE TABLE IF NOT EXISTS measurement_rollups (
+            sensors_id INTEGER NOT NULL,
+            resolution_seconds INTEGER NOT NULL,
+            bucket_start INTEGER NOT NULL,
+            unit TEXT NOT NULL DEFAULT '',
+            count INTEGER NOT NULL,
+            sum REAL NOT NULL,
+            min REAL,
+            max REAL,
+            sum_sq REAL NOT NULL,
+            PRIMARY KEY (sensors_id, resolution_seconds, bucket_start, unit)
+        );`,
+		`CREATE TABLE IF NOT EXISTS retention_runs (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            started_at TEXT,
+            duration_ms INTEGER,
+            raw_purged INTEGER,
+            buckets_written INTEGER,
+            downsamples_purged INTEGER
+        );`,
+		`CREATE TABLE IF NOT EXISTS alert_rules (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT NOT NULL,
+            sensor_id INTEGER,
+            sensor_type TEXT,
+            condition TEXT NOT NULL,
+            threshold REAL,
+            low REAL,
+            high REAL,
+            hysteresis REAL NOT NULL DEFAULT 0,
+            for_seconds INTEGER NOT NULL DEFAULT 0,
+            created_at TEXT,
+            FOREIGN KEY (sensor_id) REFERENCES sensors(id)
+        );`,
+		`CREATE TABLE IF NOT EXISTS alert_states (
+            rule_id INTEGER NOT NULL,
+            sensor_id INTEGER NOT NULL,
+            state TEXT NOT NULL,
+            since INTEGER,
+            value REAL,
+            measurement_id INTEGER,
+            updated_at TEXT,
+            PRIMARY KEY (rule_id, sensor_id)
+        );`,
+		// the history outlives deleted rules, so there is no foreign key
+		`CREATE TABLE IF NOT EXISTS alert_events (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            rule_id INTEGER NOT NULL,
+            sensor_id INTEGER NOT NULL,
+            from_state TEXT NOT NULL,
+            to_state TEXT NOT NULL,
+            value REAL,
+            measurement_id INTEGER,
+            timestamp INTEGER,
+            created_at TEXT
+        );`,
+		`CREATE INDEX IF NOT EXISTS alert_events_rule ON alert_events (rule_id, sensor_id);`,
+		`CREATE TABLE IF NOT EXISTS validation_rules (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            sensor_type TEXT NOT NULL,
+            allowed_units TEXT NOT NULL DEFAULT '',
+            min REAL,
+            max REAL,
+            max_step REAL,
+            require_unit INTEGER NOT NULL DEFAULT 0,
+            require_timestamp INTEGER NOT NULL DEFAULT 0,
+            action TEXT NOT NULL,
+            created_at TEXT
+        );`,
+		`CREATE INDEX IF NOT EXISTS validation_rules_type ON validation_rules (sensor_type);`,
+		`CREATE TABLE IF NOT EXISTS sensor_calibrations (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            sensors_id INTEGER NOT NULL,
+            coefficients TEXT NOT NULL,
+            valid_from INTEGER NOT NULL,
+            valid_to INTEGER,
+            certificate TEXT NOT NULL DEFAULT '',
+            created_at TEXT,
             FOREIGN KEY (sensors_id) REFERENCES sensors(id)
         );`,
+		`CREATE INDEX IF NOT EXISTS sensor_calibrations_sensor ON sensor_calibrations (sensors_id, valid_from);`,
+		`CREATE TABLE IF NOT EXISTS experiment_templates (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT NOT NULL UNIQUE,
+            description TEXT NOT NULL DEFAULT '',
+            sensors TEXT NOT NULL,
+            validation_rules TEXT NOT NULL DEFAULT '[]',
+            created_at TEXT
+        );`,
+		`CREATE TABLE IF NOT EXISTS webhooks (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            url TEXT NOT NULL,
+            events TEXT NOT NULL,
+            secret TEXT NOT NULL,
+            created_at TEXT
+        );`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            webhook_id INTEGER NOT NULL,
+            event TEXT NOT NULL,
+            payload TEXT NOT NULL,
+            status TEXT NOT NULL,
+            attempts INTEGER NOT NULL DEFAULT 0,
+            next_attempt_at INTEGER,
+            response_code INTEGER,
+            last_error TEXT,
+            created_at TEXT,
+            delivered_at TEXT,
+            FOREIGN KEY (webhook_id) REFERENCES webhooks(id)
+        );`,
+		`CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at);`,
+		`CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook ON webhook_deliveries (webhook_id, id);`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            actor TEXT,
+            action TEXT,
+            entity TEXT,
+            entity_id INTEGER,
+            before TEXT,
+            after TEXT,
+            request_id TEXT,
+            timestamp TEXT
+        );`,
+		// the audit log is append-only
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+        BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;`,
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+        BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;`,
 		`PRAGMA foreign_keys = ON;`, // Ensure foreign keys are enforced
 	}
 
@@ -93,73 +344,156 @@ func (db *Database) createTables(tx *sql.Tx) error {
 	return nil
 }
 
-// Inserts 2 experiments and 2 sensors each, no measurements inserted
+// measurement timestamps are integer nanoseconds since the epoch (UTC), see Timestamp.
+// The table name is a parameter because migration 5 rebuilds both tables (and 14 the revisions).
+func createMeasurementsSQL(table string) string {
+	return `CREATE TABLE IF NOT EXISTS ` + table + ` (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            sensors_id INTEGER,
+			value REAL,
+			unit TEXT,
+            timestamp INTEGER,
+            deleted_at TEXT,
+            revision INTEGER NOT NULL DEFAULT 1,
+            version INTEGER NOT NULL DEFAULT 1,
+            quality TEXT NOT NULL DEFAULT 'good',
+            quality_reason TEXT NOT NULL DEFAULT '',
+            FOREIGN KEY (sensors_id) REFERENCES sensors(id)
+        );`
+}
+
+func createRevisionsSQL(table string) string {
+	return `CREATE TABLE IF NOT EXISTS ` + table + ` (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            measurement_id INTEGER NOT NULL,
+            revision INTEGER NOT NULL,
+            sensors_id INTEGER,
+            value REAL,
+            unit TEXT,
+            timestamp INTEGER,
+            reason TEXT,
+            author TEXT,
+            created_at INTEGER,
+            deleted INTEGER NOT NULL DEFAULT 0,
+            UNIQUE (measurement_id, revision),
+            FOREIGN KEY (measurement_id) REFERENCES measurements(id)
+        );`
+}
+
+// Inserts 2 experiments and 2 sensors each, no measurements inserted. The template of them is seeded by a migration.
 func (db *Database) initTables(tx *sql.Tx) error {
 	//Creates two experiments, one yesterday, one today.
-	createExpSQL := `INSERT OR IGNORE INTO experiments (id, name, description, date)
-				     VAlUES (1, ?, ?, ?);`
+	createExpSQL := `INSERT OR IGNORE INTO experiments (id, name, description, date, state)
+				     VAlUES (1, ?, ?, ?, ?);`
 	yesterday := time.Now().AddDate(0, 0, -1)
-	_, err := tx.Exec(createExpSQL, "Exp1", "the first experiment", yesterday.Format("2006-01-02"))
+	exp1 := Experiment{ID: 1, Name: "Exp1", Description: "the first experiment", Date: yesterday.Format("2006-01-02"), State: ExperimentRunning}
+	res, err := tx.Exec(createExpSQL, exp1.Name, exp1.Description, exp1.Date, exp1.State)
 	if err != nil {
 		log.Println("Couldnt create first Experiment: ", err)
 		return err
 	}
+	if err := auditSeed(tx, res, "experiment", int64(exp1.ID), exp1); err != nil {
+		return err
+	}
 
-	createExpSQL = `INSERT OR IGNORE INTO experiments (id, name, description, date)
-				     VAlUES (2, ?, ?, ?);`
-	_, err = tx.Exec(createExpSQL, "Exp2", "the second experiment", time.Now().Format("2006-01-02"))
+	createExpSQL = `INSERT OR IGNORE INTO experiments (id, name, description, date, state)
+				     VAlUES (2, ?, ?, ?, ?);`
+	exp2 := Experiment{ID: 2, Name: "Exp2", Description: "the second experiment", Date: time.Now().Format("2006-01-02"), State: ExperimentRunning}
+	res, err = tx.Exec(createExpSQL, exp2.Name, exp2.Description, exp2.Date, exp2.State)
 	if err != nil {
 		log.Println("Couldnt create second Experiment: ", err)
 		return err
 	}
+	if err := auditSeed(tx, res, "experiment", int64(exp2.ID), exp2); err != nil {
+		return err
+	}
 
 	//create two sensors for each experiment
-	sensorStmt, err := tx.Prepare("INSERT OR IGNORE INTO sensors (id, experiment_id, sensor_type) VALUES (?, ?, ?)")
+	sensorStmt, err := tx.Prepare("INSERT OR IGNORE INTO sensors (id, experiment_id, sensor_type, quantity) VALUES (?, ?, ?, ?)")
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer sensorStmt.Close()
 
 	sensors := []Sensor{
-		{1, 1, "Barometer"},
-		{2, 1, "Thermometer"},
-		{3, 2, "Barometer"},
-		{4, 2, "Thermometer"},
+		{1, 1, "Barometer", units.Pressure, 0},
+		{2, 1, "Thermometer", units.Temperature, 0},
+		{3, 2, "Barometer", units.Pressure, 0},
+		{4, 2, "Thermometer", units.Temperature, 0},
 	}
 
 	for _, sensor := range sensors {
-		_, err := sensorStmt.Exec(sensor.ID, sensor.ExperimentID, sensor.SensorType)
+		res, err := sensorStmt.Exec(sensor.ID, sensor.ExperimentID, sensor.SensorType, sensor.Quantity)
 		if err != nil {
 			log.Printf("Couldnt create sensor %v: %s", sensor.ID, err)
 			return err
 		}
+		if err := auditSeed(tx, res, "sensor", int64(sensor.ID), sensor); err != nil {
+			return err
+		}
 	}
+
 	return nil
 }
 
+// seedTemplate is the migration that adds a template like the seeded experiments. It runs once, so a template
+// that was deleted does not come back.
+func seedTemplate(tx *sql.Tx) error {
+	template := ExperimentTemplate{ID: 1, Name: "Barometer and thermometer", Description: "an experiment like the seeded ones",
+		Sensors:   []TemplateSensor{{SensorType: "Barometer", Unit: "hPa"}, {SensorType: "Thermometer", Unit: "°C"}},
+		CreatedAt: nowUTC()}
+	templateSensors, err := json.Marshal(template.Sensors)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(`INSERT OR IGNORE INTO experiment_templates (id, name, description, sensors, validation_rules, created_at)
+	VALUES (?, ?, ?, ?, '[]', ?);`, template.ID, template.Name, template.Description, string(templateSensors), template.CreatedAt)
+	if err != nil {
+		log.Println("Couldnt create template: ", err)
+		return err
+	}
+	return auditSeed(tx, res, "experiment_template", template.ID, template)
+}
+
+// auditSeed only logs seeded rows that were actually inserted (not ignored)
+func auditSeed(tx *sql.Tx, res sql.Result, entity string, id int64, after any) error {
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error retrieving rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return nil
+	}
+	return writeAudit(tx, SystemActor, AuditInsert, entity, id, nil, after)
+}
+
 func (db *Database) TestInsertionSpeed(amount int) error {
 	start := time.Now()
-	if err := db.BulkInsertRandMeasurementSlow(amount, 1, "insertionSpeedTest"); err != nil {
+	if err := db.BulkInsertRandMeasurementSlow(amount, 1, "hPa", SystemActor); err != nil {
 		return fmt.Errorf("error slow bulk insert: %w", err)
 	}
 	log.Printf("no tx, no prepared stmt, nr. inserts: %v; time: %s", amount, time.Since(start))
 
 	start = time.Now()
-	err := db.WithTransaction(func(transaction *sql.Tx) error {
-		if err := db.BulkInsertRandMeasurementFast(transaction, amount, 3, "insertionSpeedTest"); err != nil {
-			return fmt.Errorf("error inside fast bulk insert: %w", err)
-		}
-		return nil
-	})
-	if err != nil {
-		return fmt.Errorf("error transaction for fast bulk insert: %w", err)
+	if err := db.BulkInsertRandMeasurementFast(amount, 3, "hPa", SystemActor); err != nil {
+		return fmt.Errorf("error fast bulk insert: %w", err)
 	}
 
 	log.Printf("tx, prepared stmt, nr. inserts: %v; time: %s", amount, time.Since(start))
 	return nil
 }
 
+// nowUTC has the same format as CURRENT_TIMESTAMP
+func nowUTC() string {
+	return time.Now().UTC().Format(time.DateTime)
+}
+
 func (d *Database) Close() error {
+	if d.readConn != nil && d.readConn != d.dbConn {
+		if err := d.readConn.Close(); err != nil {
+			return err
+		}
+	}
 	if d.dbConn != nil {
 		return d.dbConn.Close()
 	}
@@ -0,0 +1,12 @@
+package database
+
+import "errors"
+
+// sentinel errors, handlers map them to status codes with errors.Is
+var (
+	ErrRecordNotFound  = errors.New("record not found")
+	ErrInvalidField    = errors.New("invalid field")
+	ErrVersionConflict = errors.New("version conflict")
+	ErrDuplicate       = errors.New("duplicate")
+	ErrExperimentState = errors.New("experiment state")
+)
@@ -1,95 +1,128 @@
 package database
 
 import (
+	"database/sql"
 	"fmt"
+	"iter"
 	"time"
 )
 
-func (d *Database) experimentExists(name string) (bool, error) {
-	queryDB := `SELECT EXISTS (
-		SELECT 1
-		FROM experiments
-		WHERE name = ?
-	) AS order_exists;`
-
-	exists := false
-	if err := d.dbConn.QueryRow(queryDB, name).Scan(&exists); err != nil {
-		return false, fmt.Errorf("error checking if %s exists: %w", name, err)
-	}
-	return exists, nil
-}
-
-func (d *Database) constructTimeRangeSQL(name, startTime, endTime string) (string, []any, error) {
+func (d *Database) constructTimeRangeSQL(experimentID int, startTime, endTime string, includeDeleted bool, qualities []string) (string, []any, error) {
 	//Basic query
-	queryDB := `SELECT value, unit, timestamp 
+	queryDB := `SELECT value, unit, timestamp, quality, sensors_id 
 	FROM measurements 
 	INNER JOIN sensors 		ON measurements.sensors_id 	= sensors.id
 	INNER JOIN experiments 	ON sensors.experiment_id 	= experiments.id
-	WHERE experiments.name = ?`
+	WHERE experiments.id = ?`
+	queryDB += notDeletedSQL("measurements", includeDeleted) + notDeletedSQL("experiments", includeDeleted)
 
 	queryParams := make([]any, 0, 2)
-	queryParams = append(queryParams, name)
+	queryParams = append(queryParams, experimentID)
 
 	if startTime != "" {
-		parsedStartTime, err := time.Parse(time.DateTime, startTime)
+		parsedStartTime, err := ParseTimestamp(startTime)
 		if err != nil {
 			return "", nil, fmt.Errorf("invalid format of startingtime(%w)", err)
 		}
 
-		startTime = parsedStartTime.Format(time.DateTime)
-		queryParams = append(queryParams, startTime)
+		queryParams = append(queryParams, parsedStartTime)
 		queryDB += " AND measurements.timestamp >= ?"
 	}
 
 	if endTime != "" {
-		parsedEndTime, err := time.Parse(time.DateTime, endTime)
+		parsedEndTime, err := ParseTimestamp(endTime)
 		if err != nil {
 			return "", nil, fmt.Errorf("invalid format of endingtime(%w)", err)
 		}
 
-		endTime = parsedEndTime.Format(time.DateTime)
-		queryParams = append(queryParams, endTime)
+		queryParams = append(queryParams, parsedEndTime)
 		queryDB += " AND measurements.timestamp <= ?"
 	}
-	queryDB += ";"
+	where, params := qualitySQL("measurements", qualities)
+	queryDB += where + ";"
+	queryParams = append(queryParams, params...)
 	//fmt.Println(queryDB)
 	return queryDB, queryParams, nil
 }
 
-func (d *Database) GetMeasurementsByExperiment(expName, startTime, endTime string) (*[]MeasurementResponse, error) {
-	//check for an experiment with the submitted name
-	exists, err := d.experimentExists(expName)
+// StreamMeasurementsByExperiment checks the experiment (id or name) and the time range first, so those errors
+// come before the first row, then yields the measurements (of the qualities, if there are any) one by one
+func (d *Database) StreamMeasurementsByExperiment(ref, startTime, endTime string, includeDeleted bool, qualities []string) (iter.Seq2[MeasurementResponse, error], error) {
+	e, err := getExperiment(d.readConn, ref, includeDeleted)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check experiment %s exists: %w", expName, err)
-	} else if !exists {
-		return nil, fmt.Errorf("experiment %s does not exist", expName)
+		return nil, err
 	}
 
 	//build the query accordingt to submitted params
-	queryDB, params, err := d.constructTimeRangeSQL(expName, startTime, endTime)
+	queryDB, params, err := d.constructTimeRangeSQL(e.ID, startTime, endTime, includeDeleted, qualities)
 	if err != nil {
-		return nil, fmt.Errorf("error constructing sql query: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrInvalidField, err)
+	}
+
+	scan := func(row rowScanner) (MeasurementResponse, error) {
+		var m MeasurementResponse
+		err := row.Scan(&m.Value, &m.Unit, &m.Timestamp, &m.Quality, &m.sensorID)
+		return m, err
+	}
+	return calibrated(d.readConn, scan, responseSensor, calibrations.response, queryDB, params...), nil
+}
+
+func (d *Database) GetSensorExperimentID(sensorID int64) (int, error) {
+	var experimentID int
+	queryDB := `SELECT experiment_id
+	FROM sensors
+	INNER JOIN experiments ON sensors.experiment_id = experiments.id
+	WHERE sensors.id = ? AND experiments.deleted_at IS NULL;`
+	err := d.readConn.QueryRow(queryDB, sensorID).Scan(&experimentID)
+	if err == sql.ErrNoRows {
+		return -1, fmt.Errorf("%w: sensor %v does not exist", ErrRecordNotFound, sensorID)
+	} else if err != nil {
+		return -1, fmt.Errorf("error getting experiment of sensor %v: %w", sensorID, err)
 	}
+	return experimentID, nil
+}
 
-	rows, err := d.dbConn.Query(queryDB, params...)
+// GetExperimentSensorIDs returns the sensors of the experiment (id or name)
+func (d *Database) GetExperimentSensorIDs(ref string) ([]int64, error) {
+	e, err := getExperiment(d.readConn, ref, false)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := d.readConn.Query(`SELECT id FROM sensors WHERE experiment_id = ? ORDER BY id;`, e.ID)
 	if err != nil {
-		return nil, fmt.Errorf("error querying measurements: %w", err)
+		return nil, fmt.Errorf("error querying sensors of experiment %s: %w", ref, err)
 	}
-	defer rows.Close() // Ensure rows are closed after processing
+	defer rows.Close()
 
-	var measurements []MeasurementResponse
+	ids := []int64{}
 	for rows.Next() {
-		var m MeasurementResponse
-		if err := rows.Scan(&m.Value, &m.Unit, &m.Timestamp); err != nil {
-			return nil, fmt.Errorf("error scanning row: %w", err)
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("error scanning sensor id: %w", err)
 		}
-		measurements = append(measurements, m)
+		ids = append(ids, id)
 	}
-
-	// Check for errors from iterating over rows
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating over rows: %w", err)
+		return nil, fmt.Errorf("error iterating over sensors: %w", err)
 	}
+	return ids, nil
+}
+
+// a range instead of date(timestamp), so the index on (sensors_id, timestamp) is used
+const countInRangeSQL = `SELECT COUNT(*)
+	FROM measurements
+	INNER JOIN sensors ON measurements.sensors_id = sensors.id
+	WHERE sensors.experiment_id = ? AND measurements.timestamp >= ? AND measurements.timestamp < ?;`
 
-	return &measurements, nil
+// day is formatted as YYYY-MM-DD (UTC)
+func (d *Database) CountExperimentMeasurementsOnDay(experimentID int, day string) (int, error) {
+	start, err := time.Parse(time.DateOnly, day)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid day %q: %w", ErrInvalidField, day, err)
+	}
+	var count int
+	if err := d.readConn.QueryRow(countInRangeSQL, experimentID, NewTimestamp(start), NewTimestamp(start.AddDate(0, 0, 1))).Scan(&count); err != nil {
+		return 0, fmt.Errorf("error counting measurements of experiment %v: %w", experimentID, err)
+	}
+	return count, nil
 }
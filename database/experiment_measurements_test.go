@@ -0,0 +1,26 @@
+package database
+
+import "testing"
+
+func TestStreamMeasurementsByExperimentIDOrName(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.InsertMeasurement(&Measurement{SensorsId: 1, Value: 1013, Unit: "hPa"}, Actor{Name: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"1", "Exp1"} {
+		measurements, err := db.StreamMeasurementsByExperiment(ref, "", "", false, nil)
+		if err != nil {
+			t.Fatalf("experiment %s: %s", ref, err)
+		}
+		count := 0
+		for _, err := range measurements {
+			if err != nil {
+				t.Fatal(err)
+			}
+			count++
+		}
+		if count != 1 {
+			t.Errorf("experiment %s: %v measurements, want 1", ref, count)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// methods for the experiments table
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// lifecycle states of an experiment, only running experiments accept new measurements
+const (
+	ExperimentDraft     = "draft"
+	ExperimentRunning   = "running"
+	ExperimentPaused    = "paused"
+	ExperimentCompleted = "completed"
+	ExperimentArchived  = "archived" // read-only
+	ExperimentDeleted   = "deleted"  // in the trash, only in ExperimentChange
+)
+
+var ExperimentStates = []string{ExperimentDraft, ExperimentRunning, ExperimentPaused, ExperimentCompleted, ExperimentArchived}
+
+// experimentTransitions are the actions of the transition endpoints and the states they are allowed in
+var experimentTransitions = map[string]struct {
+	from []string
+	to   string
+}{
+	"start":    {[]string{ExperimentDraft}, ExperimentRunning},
+	"pause":    {[]string{ExperimentRunning}, ExperimentPaused},
+	"resume":   {[]string{ExperimentPaused}, ExperimentRunning},
+	"complete": {[]string{ExperimentRunning, ExperimentPaused}, ExperimentCompleted},
+	"archive":  {[]string{ExperimentCompleted}, ExperimentArchived},
+}
+
+const experimentColumns = `experiments.id, experiments.name, experiments.description,
+	experiments.date, experiments.deleted_at, experiments.state, experiments.started_at, experiments.ended_at`
+
+func scanExperiment(row rowScanner) (Experiment, error) {
+	var e Experiment
+	var description, date sql.NullString
+	err := row.Scan(&e.ID, &e.Name, &description, &date, &e.DeletedAt, &e.State, &e.StartedAt, &e.EndedAt)
+	e.Description, e.Date = description.String, date.String
+	return e, err
+}
+
+// getExperiment looks the experiment up by id if ref is a number, otherwise by name
+func getExperiment(q rowQuerier, ref string, includeDeleted bool) (*Experiment, error) {
+	column := "name"
+	if _, err := strconv.Atoi(ref); err == nil {
+		column = "id"
+	}
+	queryDB := `SELECT ` + experimentColumns + ` FROM experiments
+	WHERE ` + column + ` = ?` + notDeletedSQL("experiments", includeDeleted) + ` ORDER BY id LIMIT 1;`
+	e, err := scanExperiment(q.QueryRow(queryDB, ref))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: experiment %s does not exist", ErrRecordNotFound, ref)
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting experiment %s: %w", ref, err)
+	}
+	return &e, nil
+}
+
+func (d *Database) GetExperiment(ref string, includeDeleted bool) (*Experiment, error) {
+	return getExperiment(d.readConn, ref, includeDeleted)
+}
+
+// GetExperiments returns the experiments that are not in the trash, only those in the state if it is not empty
+func (d *Database) GetExperiments(state string) ([]Experiment, error) {
+	queryDB := `SELECT ` + experimentColumns + ` FROM experiments WHERE deleted_at IS NULL`
+	var params []any
+	if state != "" {
+		if !slices.Contains(ExperimentStates, state) {
+			return nil, fmt.Errorf("%w: state must be one of %v", ErrInvalidField, ExperimentStates)
+		}
+		queryDB += ` AND state = ?`
+		params = append(params, state)
+	}
+	experiments := []Experiment{}
+	for e, err := range queryRows(d.readConn, scanExperiment, queryDB+` ORDER BY id;`, params...) {
+		if err != nil {
+			return nil, fmt.Errorf("error querying experiments: %w", err)
+		}
+		experiments = append(experiments, e)
+	}
+	return experiments, nil
+}
+
+// TransitionExperiment applies a lifecycle action (start, pause, resume, complete or archive), it fails
+// with ErrExperimentState if the action is not allowed in the current state. The first time the
+// experiment runs sets started_at, complete sets ended_at.
+func (d *Database) TransitionExperiment(ref, action string, actor Actor) (*Experiment, error) {
+	transition, ok := experimentTransitions[action]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown action %q", ErrInvalidField, action)
+	}
+	var before, after *Experiment
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		var err error
+		if before, err = getExperiment(tx, ref, false); err != nil {
+			return err
+		}
+		if !slices.Contains(transition.from, before.State) {
+			return fmt.Errorf("%w: experiment %s is %s, %s needs it to be %s", ErrExperimentState, before.Name,
+				before.State, action, strings.Join(transition.from, " or "))
+		}
+		now := nowUTC()
+		startedAt, endedAt := before.StartedAt, before.EndedAt
+		if transition.to == ExperimentRunning && startedAt == nil {
+			startedAt = &now
+		}
+		if transition.to == ExperimentCompleted {
+			endedAt = &now
+		}
+		_, err = tx.Exec(`UPDATE experiments SET state = ?, started_at = ?, ended_at = ? WHERE id = ?;`,
+			transition.to, startedAt, endedAt, before.ID)
+		if err != nil {
+			return fmt.Errorf("error changing state of experiment %s: %w", ref, err)
+		}
+		if after, err = getExperiment(tx, strconv.Itoa(before.ID), false); err != nil {
+			return err
+		}
+		return writeAudit(tx, actor, AuditUpdate, "experiment", int64(before.ID), before, after)
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.notifyExperiment(ExperimentChange{Experiment: *after, From: before.State, To: after.State})
+	return after, nil
+}
+
+// sensorExperiment returns the name and state of the experiment of the sensor, empty for a sensor
+// without experiment or one that does not exist
+func sensorExperiment(q rowQuerier, sensorID int64) (string, string, error) {
+	var name, state string
+	err := q.QueryRow(`SELECT experiments.name, experiments.state FROM sensors
+	INNER JOIN experiments ON sensors.experiment_id = experiments.id
+	WHERE sensors.id = ?;`, sensorID).Scan(&name, &state)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", fmt.Errorf("error getting experiment of sensor %v: %w", sensorID, err)
+	}
+	return name, state, nil
+}
+
+// checkRunning fails with ErrExperimentState unless the experiment of the sensor is running
+func checkRunning(q rowQuerier, sensorID int64) error {
+	name, state, err := sensorExperiment(q, sensorID)
+	if err != nil {
+		return err
+	}
+	if state != "" && state != ExperimentRunning {
+		return fmt.Errorf("%w: experiment %s is %s, only running experiments accept measurements", ErrExperimentState, name, state)
+	}
+	return nil
+}
+
+// checkWritable fails with ErrExperimentState if the experiment of the sensor is archived
+func checkWritable(q rowQuerier, sensorID int64) error {
+	name, state, err := sensorExperiment(q, sensorID)
+	if err != nil {
+		return err
+	}
+	if state == ExperimentArchived {
+		return fmt.Errorf("%w: experiment %s is archived and read-only", ErrExperimentState, name)
+	}
+	return nil
+}
+
+// DeleteExperiment moves the experiment to the trash, its measurements are hidden with it
+func (d *Database) DeleteExperiment(ref string, actor Actor) error {
+	var deleted *Experiment
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		before, err := getExperiment(tx, ref, false)
+		if err != nil {
+			return err
+		}
+		if before.State == ExperimentArchived {
+			return fmt.Errorf("%w: experiment %s is archived and read-only", ErrExperimentState, before.Name)
+		}
+		if _, err := tx.Exec(`UPDATE experiments SET deleted_at = ? WHERE id = ?;`, nowUTC(), before.ID); err != nil {
+			return fmt.Errorf("error deleting experiment %s: %w", ref, err)
+		}
+		deleted, err = getExperiment(tx, strconv.Itoa(before.ID), true)
+		if err != nil {
+			return err
+		}
+		return writeAudit(tx, actor, AuditDelete, "experiment", int64(before.ID), before, deleted)
+	})
+	if err != nil {
+		return err
+	}
+	d.notifyExperiment(ExperimentChange{Experiment: *deleted, From: deleted.State, To: ExperimentDeleted})
+	return nil
+}
+
+func (d *Database) RestoreExperiment(ref string, actor Actor) (*Experiment, error) {
+	var restored *Experiment
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		before, err := getExperiment(tx, ref, true)
+		if err != nil {
+			return err
+		}
+		if before.DeletedAt == nil {
+			return fmt.Errorf("experiment %s not found in trash", ref)
+		}
+		if _, err := tx.Exec(`UPDATE experiments SET deleted_at = NULL WHERE id = ?;`, before.ID); err != nil {
+			return fmt.Errorf("error restoring experiment %s: %w", ref, err)
+		}
+		restored, err = getExperiment(tx, strconv.Itoa(before.ID), false)
+		if err != nil {
+			return err
+		}
+		return writeAudit(tx, actor, AuditRestore, "experiment", int64(before.ID), before, restored)
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.notifyExperiment(ExperimentChange{Experiment: *restored, From: ExperimentDeleted, To: restored.State})
+	return restored, nil
+}
+
+func (d *Database) GetDeletedExperiments() ([]Experiment, error) {
+	queryDB := `SELECT ` + experimentColumns + ` FROM experiments WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC;`
+	rows, err := d.readConn.Query(queryDB)
+	if err != nil {
+		return nil, fmt.Errorf("error querying deleted experiments: %w", err)
+	}
+	defer rows.Close()
+
+	experiments := []Experiment{}
+	for rows.Next() {
+		e, err := scanExperiment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		experiments = append(experiments, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return experiments, nil
+}
@@ -0,0 +1,40 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// InsertBatch is the measurements of one request in a group commit
+type InsertBatch struct {
+	Measurements []Measurement
+	Actor        Actor
+	Results      []InsertResult
+	Err          error // only this batch failed, the others of the group are stored
+}
+
+// InsertGroup stores the batches of several requests in one transaction. Each batch is all or nothing
+// on its own (a savepoint), so a bad request does not fail the others. The returned error means the
+// whole transaction failed and nothing was stored.
+func (d *Database) InsertGroup(batches []*InsertBatch) error {
+	return d.withInsertTransaction(func(tx *sql.Tx) ([]Measurement, error) {
+		var created []Measurement
+		for _, batch := range batches {
+			if _, err := tx.Exec(`SAVEPOINT insert_batch;`); err != nil {
+				return nil, fmt.Errorf("error creating savepoint: %w", err)
+			}
+			batch.Results, batch.Err = d.insertMeasurements(tx, batch.Measurements, batch.Actor)
+			if batch.Err != nil {
+				if _, err := tx.Exec(`ROLLBACK TO insert_batch;`); err != nil {
+					return nil, fmt.Errorf("error rolling back to savepoint: %w", err)
+				}
+			} else {
+				created = append(created, createdOnly(batch.Measurements, batch.Results)...)
+			}
+			if _, err := tx.Exec(`RELEASE insert_batch;`); err != nil {
+				return nil, fmt.Errorf("error releasing savepoint: %w", err)
+			}
+		}
+		return created, nil
+	})
+}
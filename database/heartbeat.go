@@ -0,0 +1,392 @@
+// heartbeat monitoring: sensors with an expected interval get gap detection and an online status
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// states of a sensor, only sensors of running experiments with an expected interval are online or offline
+const (
+	SensorOnline   = "online"
+	SensorOffline  = "offline"
+	SensorInactive = "inactive" // the experiment is not running
+	SensorUnknown  = "unknown"  // no expected interval
+)
+
+// DefaultSilentIntervals is how many expected intervals without a reading make a gap or an offline sensor
+const DefaultSilentIntervals = 2.0
+
+// maxGaps limits the gaps of one request, a sensor reporting every second could have millions
+const maxGaps = 10000
+
+type SensorStatus struct {
+	Sensor
+	Status    string     `json:"status"`
+	LastSeen  *Timestamp `json:"last_seen,omitempty"`  // timestamp of the latest reading
+	SilentFor *Duration  `json:"silent_for,omitempty"` // since monitoring began if the sensor never reported
+}
+
+// Gap is a span of more than the silent intervals without a reading while the experiment was running.
+// It starts at the reading before it (or the time monitoring began) and ends at the next reading or when
+// the experiment stopped running, Open gaps last until now.
+type Gap struct {
+	SensorID int64     `json:"sensor_id"`
+	Start    Timestamp `json:"start"`
+	End      Timestamp `json:"end"`
+	Duration Duration  `json:"duration"`
+	Missed   int64     `json:"missed"` // readings expected in the gap
+	Open     bool      `json:"open,omitempty"`
+}
+
+func checkExpectedInterval(interval Duration) error {
+	if interval < 0 || time.Duration(interval)%time.Second != 0 {
+		return fmt.Errorf("%w: expected_interval must be whole seconds, 0s disables monitoring", ErrInvalidField)
+	}
+	return nil
+}
+
+func checkSilentIntervals(intervals float64) error {
+	if intervals < 1 {
+		return fmt.Errorf("%w: intervals must be at least 1", ErrInvalidField)
+	}
+	return nil
+}
+
+// SetSensorInterval sets how often readings of the sensor are expected, 0 disables monitoring.
+// Monitoring begins when the interval is set on a sensor without one.
+func (d *Database) SetSensorInterval(id int64, interval Duration, actor Actor) (*Sensor, error) {
+	if err := checkExpectedInterval(interval); err != nil {
+		return nil, err
+	}
+	var after *Sensor
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		before, err := scanSensor(tx.QueryRow(`SELECT `+sensorColumns+` FROM sensors WHERE id = ?;`, id))
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: sensor %v", ErrRecordNotFound, id)
+		} else if err != nil {
+			return fmt.Errorf("error getting sensor %v: %w", id, err)
+		}
+		if err := checkWritable(tx, id); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE sensors SET expected_interval_since = CASE WHEN expected_interval_seconds = 0
+			THEN ? ELSE expected_interval_since END, expected_interval_seconds = ? WHERE id = ?;`,
+			NewTimestamp(time.Now()), interval.seconds(), id)
+		if err != nil {
+			return fmt.Errorf("error setting expected interval of sensor %v: %w", id, err)
+		}
+		updated := before
+		updated.ExpectedInterval = interval
+		after = &updated
+		return writeAudit(tx, actor, AuditUpdate, "sensor", id, before, after)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return after, nil
+}
+
+// SensorStatusFilter fields are ignored when 0
+type SensorStatusFilter struct {
+	SensorID     int64
+	ExperimentID int
+	Intervals    float64 // silent intervals that make a sensor offline, DefaultSilentIntervals if 0
+}
+
+// GetSensorStatuses derives the status of the sensors from their latest reading at now, sensors that never
+// reported are silent since the experiment started or the interval was set, whichever is later.
+// Sensors of experiments in the trash are left out.
+func (d *Database) GetSensorStatuses(filter SensorStatusFilter, now time.Time) ([]SensorStatus, error) {
+	if filter.Intervals == 0 {
+		filter.Intervals = DefaultSilentIntervals
+	}
+	if err := checkSilentIntervals(filter.Intervals); err != nil {
+		return nil, err
+	}
+	queryDB := `SELECT s.id, COALESCE(s.experiment_id, 0), COALESCE(s.sensor_type, ''), s.quantity,
+		s.expected_interval_seconds, COALESCE(e.state, ''), e.started_at, s.expected_interval_since,
+		(SELECT MAX(timestamp) FROM measurements WHERE sensors_id = s.id AND deleted_at IS NULL)
+	FROM sensors s
+	LEFT JOIN experiments e ON e.id = s.experiment_id
+	WHERE e.deleted_at IS NULL`
+	params := []any{}
+	if filter.SensorID != 0 {
+		queryDB += ` AND s.id = ?`
+		params = append(params, filter.SensorID)
+	}
+	if filter.ExperimentID != 0 {
+		queryDB += ` AND s.experiment_id = ?`
+		params = append(params, filter.ExperimentID)
+	}
+	queryDB += ` ORDER BY s.id;`
+
+	type statusRow struct {
+		SensorStatus
+		experimentState string
+		silentSince     *Timestamp // the latest reading or when monitoring began, nil if unknown
+	}
+	scan := func(row rowScanner) (statusRow, error) {
+		var st statusRow
+		var intervalSeconds int64
+		var startedAt sql.NullString
+		var intervalSince Timestamp
+		var lastSeen sql.NullInt64
+		err := row.Scan(&st.ID, &st.ExperimentID, &st.SensorType, &st.Quantity, &intervalSeconds, &st.experimentState,
+			&startedAt, &intervalSince, &lastSeen)
+		if err != nil {
+			return st, err
+		}
+		st.ExpectedInterval = Duration(time.Duration(intervalSeconds) * time.Second)
+		if lastSeen.Valid {
+			seen := Timestamp(lastSeen.Int64)
+			st.LastSeen, st.silentSince = &seen, &seen
+			return st, nil
+		}
+		since := intervalSince
+		if startedAt.Valid {
+			started, err := time.Parse(time.DateTime, startedAt.String)
+			if err != nil {
+				return st, fmt.Errorf("error reading started_at of experiment %v: %w", st.ExperimentID, err)
+			}
+			since = max(since, NewTimestamp(started))
+		}
+		if since != 0 {
+			st.silentSince = &since
+		}
+		return st, nil
+	}
+	statuses := []SensorStatus{}
+	for st, err := range queryRows(d.readConn, scan, queryDB, params...) {
+		if err != nil {
+			return nil, fmt.Errorf("error querying sensor status: %w", err)
+		}
+		st.Status = sensorStatus(st.Sensor, st.experimentState, st.silentSince, filter.Intervals, now)
+		if st.silentSince != nil {
+			silent := Duration(max(0, now.Sub(st.silentSince.Time())))
+			st.SilentFor = &silent
+		}
+		statuses = append(statuses, st.SensorStatus)
+	}
+	return statuses, nil
+}
+
+// sensorStatus is offline once the sensor has been silent since silentSince for more than intervals
+// expected intervals, a sensor that never reported and has no known start of monitoring is offline as well
+func sensorStatus(s Sensor, experimentState string, silentSince *Timestamp, intervals float64, now time.Time) string {
+	switch {
+	case s.ExpectedInterval == 0:
+		return SensorUnknown
+	case experimentState != ExperimentRunning:
+		return SensorInactive
+	case silentSince == nil || now.Sub(silentSince.Time()) > silentThreshold(s.ExpectedInterval, intervals):
+		return SensorOffline
+	}
+	return SensorOnline
+}
+
+func silentThreshold(interval Duration, intervals float64) time.Duration {
+	return time.Duration(float64(interval) * intervals)
+}
+
+// SensorGaps lists the gaps of the sensor in [since, until), until is capped at now
+func (d *Database) SensorGaps(sensorID int64, since, until time.Time, intervals float64) ([]Gap, error) {
+	if err := checkSilentIntervals(intervals); err != nil {
+		return nil, err
+	}
+	s, err := d.GetSensor(sensorID)
+	if err != nil {
+		return nil, err
+	}
+	if s.ExpectedInterval == 0 {
+		return nil, fmt.Errorf("%w: sensor %v has no expected_interval", ErrInvalidField, sensorID)
+	}
+	var periods []period
+	if s.ExperimentID != 0 {
+		e, err := getExperiment(d.readConn, strconv.Itoa(s.ExperimentID), false)
+		if err != nil {
+			return nil, err
+		}
+		if periods, err = runningPeriods(d.readConn, e); err != nil {
+			return nil, err
+		}
+	}
+	return sensorGaps(d.readConn, *s, periods, since, until, intervals, time.Now())
+}
+
+// ExperimentGaps lists the gaps of the sensors of the experiment that have an expected interval, by sensor and start
+func (d *Database) ExperimentGaps(ref string, since, until time.Time, intervals float64) ([]Gap, error) {
+	if err := checkSilentIntervals(intervals); err != nil {
+		return nil, err
+	}
+	e, err := getExperiment(d.readConn, ref, false)
+	if err != nil {
+		return nil, err
+	}
+	var sensors []Sensor
+	for s, err := range queryRows(d.readConn, scanSensor, `SELECT `+sensorColumns+` FROM sensors
+	WHERE experiment_id = ? AND expected_interval_seconds > 0 ORDER BY id;`, e.ID) {
+		if err != nil {
+			return nil, fmt.Errorf("error reading sensors of experiment %s: %w", e.Name, err)
+		}
+		sensors = append(sensors, s)
+	}
+	periods, err := runningPeriods(d.readConn, e)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	gaps := []Gap{}
+	for _, s := range sensors {
+		sensorGaps, err := sensorGaps(d.readConn, s, periods, since, until, intervals, now)
+		if err != nil {
+			return nil, err
+		}
+		if len(gaps)+len(sensorGaps) > maxGaps {
+			return nil, fmt.Errorf("%w: more than %v gaps, use a shorter range", ErrInvalidField, maxGaps)
+		}
+		gaps = append(gaps, sensorGaps...)
+	}
+	return gaps, nil
+}
+
+// period is a span [start, end) in which the experiment was running, end is math.MaxInt64 while it runs
+type period struct {
+	start, end Timestamp
+}
+
+// runningPeriods reads the periods in which the experiment was running from the state changes in the
+// audit log. An experiment without entries has been in its current state from the start.
+func runningPeriods(q querier, e *Experiment) ([]period, error) {
+	type change struct {
+		before, after sql.NullString
+		at            string
+	}
+	scan := func(row rowScanner) (change, error) {
+		var c change
+		err := row.Scan(&c.before, &c.after, &c.at)
+		return c, err
+	}
+	periods := []period{}
+	state, running := "", Timestamp(0)
+	first := true
+	for c, err := range queryRows(q, scan, `SELECT json_extract(before, '$.state'), json_extract(after, '$.state'), timestamp
+	FROM audit_log WHERE entity = 'experiment' AND entity_id = ? ORDER BY id;`, e.ID) {
+		if err != nil {
+			return nil, fmt.Errorf("error reading the state changes of experiment %s: %w", e.Name, err)
+		}
+		if first && c.before.String == ExperimentRunning {
+			state = ExperimentRunning
+		}
+		first = false
+		if !c.after.Valid || c.after.String == state {
+			continue
+		}
+		at, err := time.Parse(time.DateTime, c.at)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the state changes of experiment %s: %w", e.Name, err)
+		}
+		if c.after.String == ExperimentRunning {
+			running = NewTimestamp(at)
+		} else if state == ExperimentRunning {
+			periods = append(periods, period{running, NewTimestamp(at)})
+		}
+		state = c.after.String
+	}
+	if first {
+		state = e.State
+	}
+	if state == ExperimentRunning {
+		periods = append(periods, period{running, math.MaxInt64})
+	}
+	return periods, nil
+}
+
+// monitoringSince is when the expected interval of the sensor was set, 0 if that is unknown
+func monitoringSince(q rowQuerier, sensorID int) (Timestamp, error) {
+	var since Timestamp
+	err := q.QueryRow(`SELECT expected_interval_since FROM sensors WHERE id = ?;`, sensorID).Scan(&since)
+	if err != nil {
+		return 0, fmt.Errorf("error reading the expected interval of sensor %v: %w", sensorID, err)
+	}
+	return since, nil
+}
+
+// sensorGaps looks for gaps in each running period within [since, until). Monitoring of a period begins
+// when it starts or the interval was set, and the first gap starts at the last reading before since.
+func sensorGaps(q readQuerier, s Sensor, periods []period, since, until time.Time, intervals float64, now time.Time) ([]Gap, error) {
+	open := false
+	if until.After(now) {
+		until, open = now, true
+	}
+	gaps := []Gap{}
+	if !since.Before(until) {
+		return gaps, nil
+	}
+	intervalSince, err := monitoringSince(q, s.ID)
+	if err != nil {
+		return nil, err
+	}
+	threshold := silentThreshold(s.ExpectedInterval, intervals)
+	add := func(start, end Timestamp) error {
+		length := end.Time().Sub(start.Time())
+		if length <= threshold {
+			return nil
+		}
+		if len(gaps) == maxGaps {
+			return fmt.Errorf("%w: more than %v gaps, use a shorter range", ErrInvalidField, maxGaps)
+		}
+		gaps = append(gaps, Gap{SensorID: int64(s.ID), Start: start, End: end, Duration: Duration(length),
+			Missed: max(0, int64(length/time.Duration(s.ExpectedInterval))-1)})
+		return nil
+	}
+
+	scan := func(row rowScanner) (Timestamp, error) {
+		var t Timestamp
+		err := row.Scan(&t)
+		return t, err
+	}
+	for _, p := range periods {
+		began := max(p.start, intervalSince)
+		lo, hi := max(NewTimestamp(since), began), min(NewTimestamp(until), p.end)
+		if lo >= hi {
+			continue
+		}
+		//without a known start of monitoring the range starts at since
+		previous := lo
+		if began != 0 {
+			var last sql.NullInt64
+			err := q.QueryRow(`SELECT MAX(timestamp) FROM measurements
+			WHERE sensors_id = ? AND deleted_at IS NULL AND timestamp >= ? AND timestamp < ?;`, s.ID, began, lo).Scan(&last)
+			if err != nil {
+				return nil, fmt.Errorf("error reading timestamps of sensor %v: %w", s.ID, err)
+			}
+			previous = began
+			if last.Valid {
+				previous = Timestamp(last.Int64)
+			}
+		}
+		for t, err := range queryRows(q, scan, `SELECT timestamp FROM measurements
+		WHERE sensors_id = ? AND deleted_at IS NULL AND timestamp >= ? AND timestamp < ?
+		ORDER BY timestamp;`, s.ID, lo, hi) {
+			if err != nil {
+				return nil, fmt.Errorf("error reading timestamps of sensor %v: %w", s.ID, err)
+			}
+			if err := add(previous, t); err != nil {
+				return nil, err
+			}
+			previous = t
+		}
+		before := len(gaps)
+		if err := add(previous, hi); err != nil {
+			return nil, err
+		}
+		if len(gaps) > before {
+			gaps[len(gaps)-1].Open = open && p.end == math.MaxInt64
+		}
+	}
+	return gaps, nil
+}
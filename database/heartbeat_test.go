@@ -0,0 +1,82 @@
+package database
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSetSensorIntervalAudit(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.SetSensorInterval(2, Duration(time.Minute), Actor{Name: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	entries, _, err := db.GetAuditLog(AuditFilter{Entity: "sensor", EntityID: 2, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before, after Sensor
+	if err := json.Unmarshal(entries[0].Before, &before); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(entries[0].After, &after); err != nil {
+		t.Fatal(err)
+	}
+	if before.ExpectedInterval != 0 || after.ExpectedInterval != Duration(time.Minute) {
+		t.Errorf("audit of the interval: before %v after %v, want 0s and 1m", before.ExpectedInterval, after.ExpectedInterval)
+	}
+
+	//sensor 2 never reported, it is silent since the interval was set
+	now := time.Now().Add(10 * time.Minute)
+	statuses, err := db.GetSensorStatuses(SensorStatusFilter{SensorID: 2}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := statuses[0]
+	if st.Status != SensorOffline || st.SilentFor == nil || *st.SilentFor < Duration(10*time.Minute) {
+		t.Errorf("never seen sensor: status %s silent for %v, want offline for 10m", st.Status, st.SilentFor)
+	}
+}
+
+func TestSensorGapsInRunningPeriods(t *testing.T) {
+	db := openTestDB(t)
+	actor := Actor{Name: "test"}
+	base := time.Now().UTC().Truncate(time.Hour).Add(-48 * time.Hour)
+	at := func(minutes int) Timestamp { return NewTimestamp(base.Add(time.Duration(minutes) * time.Minute)) }
+	s, err := db.SetSensorInterval(1, Duration(time.Minute), actor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.dbConn.Exec(`UPDATE sensors SET expected_interval_since = ? WHERE id = 1;`, at(0)); err != nil {
+		t.Fatal(err)
+	}
+	for _, minutes := range []int{1, 2, 20, 40, 41} {
+		m := &Measurement{SensorsId: 1, Value: 1013, Unit: "hPa", Timestamp: at(minutes)}
+		if _, err := db.InsertMeasurement(m, actor); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//paused from 10m to 30m, the reading at 20m does not count
+	periods := []period{{at(0), at(10)}, {at(30), math.MaxInt64}}
+	now := base.Add(time.Hour)
+	gaps, err := sensorGaps(db.readConn, *s, periods, base.Add(5*time.Minute), now.Add(time.Hour), DefaultSilentIntervals, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Gap{
+		{Start: at(2), End: at(10)},
+		{Start: at(30), End: at(40)},
+		{Start: at(41), End: at(60), Open: true},
+	}
+	if len(gaps) != len(want) {
+		t.Fatalf("gaps %+v, want %+v", gaps, want)
+	}
+	for i, g := range gaps {
+		if g.Start != want[i].Start || g.End != want[i].End || g.Open != want[i].Open {
+			t.Errorf("gap %v: %v to %v open %v, want %v to %v open %v", i, g.Start.Time(), g.End.Time(), g.Open,
+				want[i].Start.Time(), want[i].End.Time(), want[i].Open)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// stored responses for requests with an Idempotency-Key, so retries are answered without a second insert
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// StoredResponse is the response of the first request with a key, Status 0 means it is still in progress
+type StoredResponse struct {
+	RequestHash string
+	Status      int
+	Body        []byte
+	Location    string
+}
+
+// ReserveIdempotencyKey claims the key for a new request. If the key is already known
+// (and younger than ttl) the stored response is returned instead and the request must not be executed.
+func (d *Database) ReserveIdempotencyKey(client, key, requestHash string, ttl time.Duration) (*StoredResponse, error) {
+	var stored *StoredResponse
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		//an expired key can be used again
+		expiredBefore := time.Now().Add(-ttl).UTC().Format(time.DateTime)
+		_, err := tx.Exec(`DELETE FROM idempotency_keys WHERE client = ? AND key = ? AND created_at < ?;`, client, key, expiredBefore)
+		if err != nil {
+			return fmt.Errorf("error removing expired idempotency key: %w", err)
+		}
+
+		res, err := tx.Exec(`INSERT OR IGNORE INTO idempotency_keys (client, key, request_hash, created_at)
+		VALUES (?, ?, ?, ?);`, client, key, requestHash, nowUTC())
+		if err != nil {
+			return fmt.Errorf("error reserving idempotency key: %w", err)
+		}
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("error retrieving rows affected: %w", err)
+		}
+		if rowsAffected == 1 {
+			return nil
+		}
+
+		stored = &StoredResponse{}
+		var location sql.NullString
+		err = tx.QueryRow(`SELECT request_hash, status, body, location FROM idempotency_keys WHERE client = ? AND key = ?;`,
+			client, key).Scan(&stored.RequestHash, &stored.Status, &stored.Body, &location)
+		if err != nil {
+			return fmt.Errorf("error reading stored response: %w", err)
+		}
+		stored.Location = location.String
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (d *Database) CompleteIdempotencyKey(client, key string, status int, body []byte, location string) error {
+	_, err := d.dbConn.Exec(`UPDATE idempotency_keys SET status = ?, body = ?, location = ? WHERE client = ? AND key = ?;`,
+		status, body, location, client, key)
+	if err != nil {
+		return fmt.Errorf("error storing idempotent response: %w", err)
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey forgets a reserved key, so a request that failed on the server can be retried
+func (d *Database) ReleaseIdempotencyKey(client, key string) error {
+	if _, err := d.dbConn.Exec(`DELETE FROM idempotency_keys WHERE client = ? AND key = ?;`, client, key); err != nil {
+		return fmt.Errorf("error releasing idempotency key: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) PurgeIdempotencyKeys(cutoff time.Time) (int64, error) {
+	res, err := d.dbConn.Exec(`DELETE FROM idempotency_keys WHERE created_at < ?;`, cutoff.UTC().Format(time.DateTime))
+	if err != nil {
+		return 0, fmt.Errorf("error purging idempotency keys: %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -3,157 +3,604 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"iter"
 	"log"
 	"math/rand/v2"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// InsertResult tells what an insert did under the conflict policy
+type InsertResult string
+
+const (
+	InsertCreated     InsertResult = "created"
+	InsertIgnored     InsertResult = "ignored"
+	InsertOverwritten InsertResult = "overwritten"
 )
 
-func (d *Database) InsertMeasurement(m *Measurement) error {
+func (d *Database) InsertMeasurement(m *Measurement, actor Actor) (InsertResult, error) {
+	var result InsertResult
+	err := d.withInsertTransaction(func(tx *sql.Tx) ([]Measurement, error) {
+		var err error
+		result, err = d.insertMeasurement(tx, m, actor)
+		if err != nil {
+			return nil, err
+		}
+		return createdOnly([]Measurement{*m}, []InsertResult{result}), nil
+	})
+	return result, err
+}
+
+// InsertMeasurements inserts a batch in one transaction, either all or none are stored
+func (d *Database) InsertMeasurements(measurements []Measurement, actor Actor) ([]InsertResult, error) {
+	var results []InsertResult
+	err := d.withInsertTransaction(func(tx *sql.Tx) ([]Measurement, error) {
+		var err error
+		results, err = d.insertMeasurements(tx, measurements, actor)
+		if err != nil {
+			return nil, err
+		}
+		return createdOnly(measurements, results), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (d *Database) insertMeasurements(tx *sql.Tx, measurements []Measurement, actor Actor) ([]InsertResult, error) {
+	results := make([]InsertResult, len(measurements))
+	for i := range measurements {
+		result, err := d.insertMeasurement(tx, &measurements[i], actor)
+		if err != nil && len(measurements) > 1 {
+			return nil, fmt.Errorf("measurement %v of batch: %w", i, err)
+		} else if err != nil {
+			return nil, err
+		}
+		results[i] = result
+	}
+	return results, nil
+}
+
+// insertMeasurement stores m and overwrites it with the stored row (id, timestamp, ...)
+func (d *Database) insertMeasurement(tx *sql.Tx, m *Measurement, actor Actor) (InsertResult, error) {
+	//the client may send the time of the reading, otherwise it is the time of the insert
+	clientTimestamp := !m.Timestamp.IsZero()
+	if !clientTimestamp {
+		m.Timestamp = d.insertTimestamp()
+	}
+	//before the conflict check, so an overwrite stores the converted and validated value as well
+	if err := checkNewMeasurement(tx, m, clientTimestamp); err != nil {
+		return "", err
+	}
+
+	if d.opts.ConflictPolicy != ConflictAllow && clientTimestamp {
+		existing, err := findByNaturalKey(tx, m.SensorsId, m.Timestamp)
+		if err != nil {
+			return "", err
+		}
+		if existing != nil {
+			return d.resolveConflict(tx, existing, m, actor)
+		}
+	}
+
 	insertSQL := `INSERT INTO measurements (
 		sensors_id,
 		value,
-		unit) VALUES (?, ?, ?);`
-	result, err := d.dbConn.Exec(insertSQL, m.SensorsId, m.Value, m.Unit)
-	if err != nil {
+		unit,
+		timestamp,
+		quality,
+		quality_reason) VALUES (?, ?, ?, ?, ?, ?);`
+	result, err := tx.Exec(insertSQL, m.SensorsId, m.Value, m.Unit, m.Timestamp, m.Quality, m.QualityReason)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		//an insert without timestamp that hit a reading the client sent for exactly this nanosecond
+		return "", fmt.Errorf("%w: measurement of sensor %v at %v", ErrDuplicate, m.SensorsId, m.Timestamp)
+	} else if err != nil {
 		log.Println("Error inserting point: ", err)
-		return err
+		return "", err
 	}
 	// Retrieve the last inserted ID
 	lastInsertId, err := result.LastInsertId()
 	if err != nil {
 		log.Println("Error retrieving last insert ID: ", err)
+		return "", err
+	}
+	//read back the row, so the response and the audit log contain the defaults
+	inserted, err := getMeasurement(tx, lastInsertId, false)
+	if err != nil {
+		return "", err
+	}
+	*m = *inserted //change the ID to the asserted one
+	if err := writeRevision(tx, m, "original", actor.Name); err != nil {
+		return "", err
+	}
+	if err := rollupAdd(tx, m); err != nil {
+		return "", err
+	}
+	return InsertCreated, writeAudit(tx, actor, AuditInsert, "measurement", m.ID, nil, m)
+}
+
+// checkNewMeasurement runs the checks of every insert path: the experiment of the sensor must be running,
+// the value is converted into the canonical unit and validated
+func checkNewMeasurement(tx *sql.Tx, m *Measurement, clientTimestamp bool) error {
+	if err := checkRunning(tx, m.SensorsId); err != nil {
 		return err
 	}
-	m.ID = lastInsertId //change the ID to the asserted one
-	return nil
+	sentUnit := m.Unit
+	if err := toCanonicalUnit(tx, m); err != nil {
+		return err
+	}
+	return validateMeasurement(tx, m, sentFields{&sentUnit, clientTimestamp})
 }
 
-func (d *Database) GetAllMeasurements() ([]Measurement, error) {
-	rows, err := d.dbConn.Query(`SELECT * FROM measurements;`)
-	if err != nil {
-		log.Println("Error getting all points: ", err)
-		return nil, err
+// insertTimestamp is the time of an insert without a timestamp. It is strictly increasing, so two such
+// inserts of a sensor never share the natural key, even if the clock does not advance between them.
+func (d *Database) insertTimestamp() Timestamp {
+	d.lastInsertMu.Lock()
+	defer d.lastInsertMu.Unlock()
+	d.lastInsert = max(NewTimestamp(time.Now()), d.lastInsert+1)
+	return d.lastInsert
+}
+
+const naturalKeySQL = `SELECT ` + measurementColumns + ` FROM measurements
+	WHERE sensors_id = ? AND timestamp = ? AND deleted_at IS NULL LIMIT 1;`
+
+func findByNaturalKey(tx *sql.Tx, sensorID int64, timestamp Timestamp) (*Measurement, error) {
+	m, err := scanMeasurement(tx.QueryRow(naturalKeySQL, sensorID, timestamp))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error looking up sensor %v at %s: %w", sensorID, timestamp, err)
 	}
-	defer rows.Close()
+	return &m, nil
+}
 
-	var points []Measurement
-	for rows.Next() {
-		var p Measurement
-		if err := rows.Scan(&p.ID, &p.SensorsId, &p.Value, &p.Unit, &p.Timestamp); err != nil {
-			log.Println("Error scanning row: ", err)
-			return nil, err
+func (d *Database) resolveConflict(tx *sql.Tx, existing, m *Measurement, actor Actor) (InsertResult, error) {
+	switch d.opts.ConflictPolicy {
+	case ConflictIgnore:
+		*m = *existing
+		return InsertIgnored, nil
+	case ConflictOverwrite:
+		_, err := tx.Exec(`UPDATE measurements SET value = ?, unit = ?, quality = ?, quality_reason = ?,
+		revision = revision + 1, version = version + 1
+		WHERE id = ?;`, m.Value, m.Unit, m.Quality, m.QualityReason, existing.ID)
+		if err != nil {
+			return "", fmt.Errorf("error overwriting measurement(id=%v): %w", existing.ID, err)
+		}
+		after, err := getMeasurement(tx, existing.ID, false)
+		if err != nil {
+			return "", fmt.Errorf("error getting overwritten measurement(id=%v): %w", existing.ID, err)
+		}
+		*m = *after
+		if err := writeRevision(tx, m, "overwritten by duplicate insert", actor.Name); err != nil {
+			return "", err
+		}
+		if err := rollupRemove(tx, existing); err != nil {
+			return "", err
 		}
-		points = append(points, p) //Append points to the Measurement slice
+		if err := rollupAdd(tx, m); err != nil {
+			return "", err
+		}
+		return InsertOverwritten, writeAudit(tx, actor, AuditUpdate, "measurement", m.ID, existing, m)
+	default:
+		return "", fmt.Errorf("%w: measurement of sensor %v at %s is measurement %v", ErrDuplicate, existing.SensorsId, existing.Timestamp, existing.ID)
 	}
+}
 
-	// Check for errors from the row iteration
-	if err := rows.Err(); err != nil {
-		log.Println("Error during row iteration: ", err)
-		return nil, err
+// applyConflictPolicy creates the unique index on (sensor, timestamp) or drops it if duplicates are allowed
+func (d *Database) applyConflictPolicy(tx *sql.Tx) error {
+	if d.opts.ConflictPolicy == ConflictAllow {
+		_, err := tx.Exec(`DROP INDEX IF EXISTS measurements_natural_key;`)
+		return err
+	}
+	_, err := tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS measurements_natural_key
+	ON measurements (sensors_id, timestamp) WHERE deleted_at IS NULL;`)
+	if err != nil {
+		return fmt.Errorf("error creating unique index on (sensors_id, timestamp), remove existing duplicates first: %w", err)
+	}
+	return nil
+}
+
+// measurementColumns matches the order scanned by scanMeasurement
+const measurementColumns = `measurements.id, measurements.sensors_id, measurements.value,
+	measurements.unit, measurements.timestamp, measurements.deleted_at, measurements.revision, measurements.version,
+	measurements.quality, measurements.quality_reason`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMeasurement(row rowScanner) (Measurement, error) {
+	var m Measurement
+	err := row.Scan(&m.ID, &m.SensorsId, &m.Value, &m.Unit, &m.Timestamp, &m.DeletedAt, &m.Revision, &m.Version,
+		&m.Quality, &m.QualityReason)
+	return m, err
+}
+
+// notDeletedSQL is added to WHERE clauses unless deleted rows are explicitly requested
+func notDeletedSQL(table string, includeDeleted bool) string {
+	if includeDeleted {
+		return ""
 	}
+	return " AND " + table + ".deleted_at IS NULL"
+}
 
-	return points, nil
+// experimentNotDeletedSQL leaves out the measurements of experiments in the trash, unless deleted rows are
+// explicitly requested. Sensors without an experiment are kept.
+func experimentNotDeletedSQL(table string, includeDeleted bool) string {
+	if includeDeleted {
+		return ""
+	}
+	return " AND " + table + `.sensors_id NOT IN (SELECT sensors.id FROM sensors
+	INNER JOIN experiments ON sensors.experiment_id = experiments.id WHERE experiments.deleted_at IS NOT NULL)`
 }
 
-func (d *Database) GetMeasurementById(queryId int) (*Measurement, error) {
-	row := d.dbConn.QueryRow(`SELECT * FROM measurements WHERE id = ? LIMIT 1;`, queryId)
-	p := &Measurement{}
+// StreamMeasurements yields all measurements ordered by id, limited to the qualities if there are any
+func (d *Database) StreamMeasurements(includeDeleted bool, qualities []string) iter.Seq2[Measurement, error] {
+	where, params := qualitySQL("measurements", qualities)
+	queryDB := `SELECT ` + measurementColumns + ` FROM measurements WHERE 1 = 1` + notDeletedSQL("measurements", includeDeleted) +
+		experimentNotDeletedSQL("measurements", includeDeleted) + where + ` ORDER BY id;`
+	return calibrated(d.readConn, scanMeasurement, measurementSensor, calibrations.measurement, queryDB, params...)
+}
 
-	if err := row.Scan(&p.ID, &p.SensorsId, &p.Value, &p.Unit, &p.Timestamp); err != nil {
+// rowQuerier is implemented by *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func getMeasurement(q rowQuerier, id int64, includeDeleted bool) (*Measurement, error) {
+	queryDB := `SELECT ` + measurementColumns + ` FROM measurements WHERE id = ?` + notDeletedSQL("measurements", includeDeleted) + ` LIMIT 1;`
+	p, err := scanMeasurement(q.QueryRow(queryDB, id))
+	if err != nil {
 		log.Println("Error getting single row: ", err)
 		return nil, err
 	}
-	return p, nil
+	return &p, nil
 }
 
-func (d *Database) DeleteMeasurement(id int) error {
-	res, err := d.dbConn.Exec(`DELETE FROM measurements WHERE id = ?;`, id)
+// GetMeasurementById hides the measurements of experiments in the trash like the deleted ones
+func (d *Database) GetMeasurementById(queryId int, includeDeleted bool) (*Measurement, error) {
+	queryDB := `SELECT ` + measurementColumns + ` FROM measurements WHERE id = ?` + notDeletedSQL("measurements", includeDeleted) +
+		experimentNotDeletedSQL("measurements", includeDeleted) + ` LIMIT 1;`
+	m, err := scanMeasurement(d.readConn.QueryRow(queryDB, queryId))
 	if err != nil {
-		return fmt.Errorf("error deleting measurement(id=%v): %w", id, err)
+		log.Println("Error getting single row: ", err)
+		return nil, err
+	}
+	return &m, calibrateOne(d.readConn, &m)
+}
+
+// checkVersion compares the version the client has seen with the current one, 0 skips the check
+func checkVersion(m *Measurement, expectedVersion int) error {
+	if expectedVersion != 0 && m.Version != expectedVersion {
+		return fmt.Errorf("%w: measurement(id=%v) is at version %v, not %v", ErrVersionConflict, m.ID, m.Version, expectedVersion)
 	}
-	//Check if there was actually a delete
-	rowsAffected, err := res.RowsAffected()
+	return nil
+}
+
+// DeleteMeasurement only marks the measurement as deleted, it stays in the trash until it is purged.
+// With an expectedVersion != 0 the delete fails with ErrVersionConflict if the measurement was changed meanwhile.
+func (d *Database) DeleteMeasurement(id, expectedVersion int, actor Actor) error {
+	return d.WithTransaction(func(tx *sql.Tx) error {
+		before, err := getMeasurement(tx, int64(id), false)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: measurement(id=%v)", ErrRecordNotFound, id)
+		} else if err != nil {
+			return fmt.Errorf("error getting measurement(id=%v): %w", id, err)
+		}
+		if err := checkVersion(before, expectedVersion); err != nil {
+			return err
+		}
+		if err := checkWritable(tx, before.SensorsId); err != nil {
+			return err
+		}
+
+		res, err := tx.Exec(`UPDATE measurements SET deleted_at = ?, version = version + 1, revision = revision + 1
+		WHERE id = ? AND version = ? AND deleted_at IS NULL;`, nowUTC(), id, before.Version)
+		if err != nil {
+			return fmt.Errorf("error deleting measurement(id=%v): %w", id, err)
+		}
+		//Check if there was actually a delete
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("error retrieving rows affected: %w", err)
+		}
+		//the row was read in this transaction, so only a concurrent change can make the guarded update miss
+		if rowsAffected == 0 {
+			return fmt.Errorf("%w: measurement(id=%v) changed while it was deleted", ErrVersionConflict, id)
+		}
+		after, err := getMeasurement(tx, int64(id), true)
+		if err != nil {
+			return fmt.Errorf("error getting deleted measurement(id=%v): %w", id, err)
+		}
+		if err := writeRevision(tx, after, "deleted", actor.Name); err != nil {
+			return err
+		}
+		if err := rollupRemove(tx, before); err != nil {
+			return err
+		}
+		return writeAudit(tx, actor, AuditDelete, "measurement", int64(id), before, after)
+	})
+}
+
+func (d *Database) RestoreMeasurement(id int, actor Actor) (*Measurement, error) {
+	var restored *Measurement
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		before, err := getMeasurement(tx, int64(id), true)
+		if err == sql.ErrNoRows || (err == nil && before.DeletedAt == nil) {
+			return fmt.Errorf("measurement(id=%v) not found in trash", id)
+		} else if err != nil {
+			return fmt.Errorf("error getting measurement(id=%v): %w", id, err)
+		}
+		if err := checkWritable(tx, before.SensorsId); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE measurements SET deleted_at = NULL, version = version + 1, revision = revision + 1 WHERE id = ?;`, id)
+		if err != nil {
+			return fmt.Errorf("error restoring measurement(id=%v): %w", id, err)
+		}
+		restored, err = getMeasurement(tx, int64(id), false)
+		if err != nil {
+			return fmt.Errorf("error getting restored measurement(id=%v): %w", id, err)
+		}
+		if err := writeRevision(tx, restored, "restored", actor.Name); err != nil {
+			return err
+		}
+		if err := rollupAdd(tx, restored); err != nil {
+			return err
+		}
+		return writeAudit(tx, actor, AuditRestore, "measurement", int64(id), before, restored)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
+
+func (d *Database) GetDeletedMeasurements() ([]Measurement, error) {
+	queryDB := `SELECT ` + measurementColumns + ` FROM measurements WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC;`
+	rows, err := d.readConn.Query(queryDB)
 	if err != nil {
-		return fmt.Errorf("error retrieving rows affected: %w", err)
+		return nil, fmt.Errorf("error querying deleted measurements: %w", err)
 	}
-	if rowsAffected == 0 {
-		return fmt.Errorf("measurement(id=%v) not found", id)
+	defer rows.Close()
+
+	measurements := []Measurement{}
+	for rows.Next() {
+		m, err := scanMeasurement(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		measurements = append(measurements, m)
 	}
-	return nil
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return measurements, nil
+}
+
+// updatableColumns are the columns a correction may change
+var updatableColumns = map[string]bool{
+	"sensors_id": true,
+	"value":      true,
+	"unit":       true,
+	"timestamp":  true,
 }
 
-func (d *Database) UpdateMeasurement(id int, updateData map[string]any) error {
+// UpdateMeasurement corrects a measurement, the previous state stays available as an older revision.
+// With an expectedVersion != 0 the update fails with ErrVersionConflict if the measurement was changed meanwhile.
+func (d *Database) UpdateMeasurement(id int, updateData map[string]any, reason string, expectedVersion int, actor Actor) (*Measurement, error) {
 	//should check here if correct types are passed in json request
+	if len(updateData) == 0 {
+		return nil, fmt.Errorf("%w: nothing to update", ErrInvalidField)
+	}
 
 	// Build SQL query dynamically
-	query := "UPDATE measurements SET "
-	args := make([]any, 0, len(updateData)+1) //max cap is one more than updateData (+id)
-	i := 0
+	query := "UPDATE measurements SET revision = revision + 1, version = version + 1"
+	args := make([]any, 0, len(updateData)+4) //max cap is four more than updateData (+sensor, value and unit, +id, +version)
+	reading := make(map[string]any)           //sensors_id, value and unit are converted inside the transaction
 	for key, value := range updateData {
-		if i > 0 {
-			//no comma in first iteration
-			query += ", "
+		if !updatableColumns[key] {
+			return nil, fmt.Errorf("%w: %s can not be updated", ErrInvalidField, key)
+		}
+		if key == "sensors_id" || key == "value" || key == "unit" {
+			reading[key] = value
+			continue
+		}
+		if key == "timestamp" {
+			text, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: timestamp must be a string", ErrInvalidField)
+			}
+			parsed, err := ParseTimestamp(text)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrInvalidField, err)
+			}
+			value = parsed
 		}
-		query += key + " = ?"
+		query += ", " + key + " = ?"
 		args = append(args, value)
-		i++
 	}
-	query += " WHERE id = ?"
-	fmt.Printf("final update query: %s", query)
 
-	args = append(args, id)
-	// Execute the query
-	res, err := d.dbConn.Exec(query, args...)
-	if err != nil {
-		return fmt.Errorf("failed to update: %w", err)
-	}
+	var after *Measurement
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		before, err := getMeasurement(tx, int64(id), false)
+		if err == sql.ErrNoRows {
+			return ErrRecordNotFound
+		} else if err != nil {
+			return fmt.Errorf("error getting measurement(id=%v): %w", id, err)
+		}
+		if err := checkVersion(before, expectedVersion); err != nil {
+			return err
+		}
+		if err := checkWritable(tx, before.SensorsId); err != nil {
+			return err
+		}
+		if len(reading) > 0 {
+			corrected, err := correctedReading(tx, *before, reading)
+			if err != nil {
+				return err
+			}
+			if err := checkWritable(tx, corrected.SensorsId); err != nil {
+				return err
+			}
+			query += ", sensors_id = ?, value = ?, unit = ?"
+			args = append(args, corrected.SensorsId, corrected.Value, corrected.Unit)
+		}
+		//the version condition makes the check and the update atomic
+		query += " WHERE id = ? AND version = ? AND deleted_at IS NULL"
+		args = append(args, id, before.Version)
+
+		// Execute the query
+		res, err := tx.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("failed to update: %w", err)
+		}
 
-	// Check if the row exists
-	rowsAffected, err := res.RowsAffected()
+		// Check if the row exists
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("error retrieving rows affected: %w", err)
+		}
+		if rowsAffected == 0 {
+			return fmt.Errorf("%w: measurement(id=%v) changed while it was updated", ErrVersionConflict, id)
+		}
+
+		after, err = getMeasurement(tx, int64(id), false)
+		if err != nil {
+			return fmt.Errorf("error getting updated measurement(id=%v): %w", id, err)
+		}
+		//the corrected reading is validated like an insert, a broken reject rule rolls the correction back
+		after.Quality, after.QualityReason = QualityCorrected, reason
+		sent := sentFields{timestamp: true}
+		if unit, ok := reading["unit"].(string); ok {
+			sent.unit = &unit
+		}
+		if err := validateMeasurement(tx, after, sent); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE measurements SET quality = ?, quality_reason = ? WHERE id = ?;`, after.Quality, after.QualityReason, id)
+		if err != nil {
+			return fmt.Errorf("error setting quality of measurement(id=%v): %w", id, err)
+		}
+		if err := writeRevision(tx, after, reason, actor.Name); err != nil {
+			return err
+		}
+		if err := rollupRemove(tx, before); err != nil {
+			return err
+		}
+		if err := rollupAdd(tx, after); err != nil {
+			return err
+		}
+		return writeAudit(tx, actor, AuditUpdate, "measurement", int64(id), before, after)
+	})
 	if err != nil {
-		return fmt.Errorf("error retrieving rows affected: %w", err)
-	}
-	if rowsAffected == 0 {
-		return fmt.Errorf("record not found")
+		return nil, err
 	}
+	return after, nil
+}
 
-	return nil
+// bulkAudit is one summary entry for a bulk insert in one transaction instead of one entry per random measurement
+type bulkAudit struct {
+	SensorID int    `json:"sensor_id"`
+	Unit     string `json:"unit"`
+	Amount   int    `json:"amount"`
 }
 
-func (d *Database) BulkInsertRandMeasurementSlow(amount, sensorId int, unit string) error {
+// BulkInsertRandMeasurementSlow inserts every row in its own transaction, the rows go through the same
+// checks as other inserts
+func (d *Database) BulkInsertRandMeasurementSlow(amount, sensorId int, unit string, actor Actor) error {
 	sqlInsert := `INSERT INTO measurements
 		(sensors_id,
 		value,
-		unit)
-		VALUES (?, ?, ?);`
+		unit,
+		timestamp,
+		quality,
+		quality_reason)
+		VALUES (?, ?, ?, ?, ?, ?);`
+	//every row commits on its own together with its audit entry, the listeners get each row after its commit
 	for i := 0; i < amount; i++ {
-		_, err := d.dbConn.Exec(sqlInsert, sensorId, rand.Float64()*100, unit)
+		err := d.withInsertTransaction(func(tx *sql.Tx) ([]Measurement, error) {
+			m := &Measurement{SensorsId: int64(sensorId), Value: rand.Float64() * 100, Unit: unit, Timestamp: d.insertTimestamp()}
+			if err := checkNewMeasurement(tx, m, false); err != nil {
+				return nil, err
+			}
+			res, err := tx.Exec(sqlInsert, m.SensorsId, m.Value, m.Unit, m.Timestamp, m.Quality, m.QualityReason)
+			if err != nil {
+				return nil, fmt.Errorf("error inserting measurement: %w", err)
+			}
+			if m.ID, err = res.LastInsertId(); err != nil {
+				return nil, fmt.Errorf("error retrieving last insert ID: %w", err)
+			}
+			if _, err := tx.Exec(revisionFromRowSQL, "original", actor.Name, NewTimestamp(time.Now()), m.ID); err != nil {
+				return nil, fmt.Errorf("error inserting revision: %w", err)
+			}
+			if err := rollupAdd(tx, m); err != nil {
+				return nil, err
+			}
+			return []Measurement{*m}, writeAudit(tx, actor, AuditInsert, "measurement", m.ID, nil, m)
+		})
 		if err != nil {
-			return fmt.Errorf("error inserting measurement: %w", err)
+			return err
 		}
 	}
 	return nil
 }
 
-func (d *Database) BulkInsertRandMeasurementFast(tx *sql.Tx, amount, sensorId int, unit string) error {
+// BulkInsertRandMeasurementFast inserts all rows in one transaction with prepared statements,
+// the listeners get them after the commit. Every row is checked like other inserts and gets its own timestamp.
+func (d *Database) BulkInsertRandMeasurementFast(amount, sensorId int, unit string, actor Actor) error {
 	sqlInsert := `INSERT INTO measurements
 	(sensors_id,
 	value,
-	unit)
-	VALUES (?, ?, ?);`
-	sqlStmt, err := tx.Prepare(sqlInsert)
-	if err != nil {
-		return fmt.Errorf("error preparing sql stmt: %w", err)
-	}
-	defer sqlStmt.Close()
-
-	for i := 0; i < amount; i++ {
-		_, err := sqlStmt.Exec(sensorId, rand.Float64()*100, unit)
+	unit,
+	timestamp,
+	quality,
+	quality_reason)
+	VALUES (?, ?, ?, ?, ?, ?);`
+	return d.withInsertTransaction(func(tx *sql.Tx) ([]Measurement, error) {
+		sqlStmt, err := tx.Prepare(sqlInsert)
 		if err != nil {
-			return fmt.Errorf("error inserting measurement: %w", err)
+			return nil, fmt.Errorf("error preparing sql stmt: %w", err)
 		}
-	}
-	return nil
+		defer sqlStmt.Close()
+		revisionStmt, err := tx.Prepare(revisionFromRowSQL)
+		if err != nil {
+			return nil, fmt.Errorf("error preparing sql stmt: %w", err)
+		}
+		defer revisionStmt.Close()
+
+		createdAt := NewTimestamp(time.Now())
+		created := make([]Measurement, 0, amount)
+		for i := 0; i < amount; i++ {
+			m := &Measurement{SensorsId: int64(sensorId), Value: rand.Float64() * 100, Unit: unit, Timestamp: d.insertTimestamp()}
+			if err := checkNewMeasurement(tx, m, false); err != nil {
+				return nil, fmt.Errorf("measurement %v of bulk insert: %w", i, err)
+			}
+			res, err := sqlStmt.Exec(m.SensorsId, m.Value, m.Unit, m.Timestamp, m.Quality, m.QualityReason)
+			if err != nil {
+				return nil, fmt.Errorf("error inserting measurement: %w", err)
+			}
+			if m.ID, err = res.LastInsertId(); err != nil {
+				return nil, fmt.Errorf("error retrieving last insert ID: %w", err)
+			}
+			if _, err := revisionStmt.Exec("original", actor.Name, createdAt, m.ID); err != nil {
+				return nil, fmt.Errorf("error inserting revision: %w", err)
+			}
+			if err := rollupAdd(tx, m); err != nil {
+				return nil, err
+			}
+			created = append(created, *m)
+		}
+		return created, writeAudit(tx, actor, AuditInsert, "measurement", 0, nil, bulkAudit{sensorId, unit, amount})
+	})
 }
 
 func (db *Database) MeasurementRows() (int64, error) {
@@ -161,7 +608,7 @@ func (db *Database) MeasurementRows() (int64, error) {
 	FROM measurements;`
 
 	var totalRows sql.NullInt64
-	err := db.dbConn.QueryRow(sqlQuery).Scan(&totalRows)
+	err := db.readConn.QueryRow(sqlQuery).Scan(&totalRows)
 	if err != nil {
 		return -1, fmt.Errorf("error executing row count query: %w", err)
 	}
@@ -171,34 +618,25 @@ func (db *Database) MeasurementRows() (int64, error) {
 	return int64(totalRows.Int64), nil
 }
 
-func (db *Database) GetMeasurementMinMax() ([]Measurement, error) {
-	//Query could be improved but for now it's good
-	sqlQuery := `SELECT * 
-	FROM measurements
-	WHERE value = (SELECT MAX(value) FROM measurements)
-	OR value = (SELECT MIN(value) FROM measurements);`
-
-	rows, err := db.dbConn.Query(sqlQuery)
-	if err != nil {
-		return nil, fmt.Errorf("error querying min/max: %w", err)
-	}
-	defer rows.Close()
-
-	var MinMaxMeasurements []Measurement
-	for rows.Next() {
-		var m Measurement
-		if err := rows.Scan(&m.ID, &m.SensorsId, &m.Value, &m.Unit, &m.Timestamp); err != nil {
-			return nil, fmt.Errorf("error minmax scanning row: %w", err)
-		}
-		MinMaxMeasurements = append(MinMaxMeasurements, m)
+// StreamMeasurementMinMax yields every measurement with the smallest or the largest value of its unit,
+// values in different units are not compared. A unit that is not empty limits it to that unit,
+// qualities to measurements of those qualities.
+func (db *Database) StreamMeasurementMinMax(unit string, qualities []string) iter.Seq2[Measurement, error] {
+	where, qualityParams := qualitySQL("measurements", qualities)
+	extremes := `SELECT unit AS extreme_unit, MIN(value) AS min_value, MAX(value) AS max_value
+		FROM measurements WHERE deleted_at IS NULL` + experimentNotDeletedSQL("measurements", false) + where
+	params := qualityParams
+	if unit != "" {
+		extremes += ` AND unit = ?`
+		params = append(params, unit)
 	}
-
-	// Check for errors from the row iteration
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error during row iteration: %w", err)
-	}
-
-	return MinMaxMeasurements, nil
+	sqlQuery := `SELECT ` + measurementColumns + `
+	FROM measurements
+	INNER JOIN (` + extremes + ` GROUP BY unit) ON measurements.unit IS extreme_unit
+	WHERE measurements.deleted_at IS NULL` + experimentNotDeletedSQL("measurements", false) + where + `
+	AND (measurements.value = min_value OR measurements.value = max_value)
+	ORDER BY measurements.unit, measurements.value;`
+	return calibrated(db.readConn, scanMeasurement, measurementSensor, calibrations.measurement, sqlQuery, append(params, qualityParams...)...)
 }
 
 // this should fix the problem with updating not supported types, but not finished
@@ -0,0 +1,43 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBulkInsertChecksEveryRow(t *testing.T) {
+	db, err := InitDB(Options{Path: filepath.Join(t.TempDir(), "test.db"), ReadConns: 2, BusyTimeout: 5 * time.Second,
+		ConflictPolicy: ConflictReject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	actor := Actor{Name: "test"}
+
+	//every row gets its own timestamp, so the natural key does not reject the second one
+	if err := db.BulkInsertRandMeasurementFast(3, 1, "kPa", actor); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.MeasurementRows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 3 {
+		t.Errorf("%v rows, want 3", rows)
+	}
+	if err := db.BulkInsertRandMeasurementFast(1, 1, "V", actor); !errors.Is(err, ErrInvalidField) {
+		t.Errorf("bulk insert in volt into a pressure sensor: %v, want ErrInvalidField", err)
+	}
+
+	if _, err := db.TransitionExperiment("1", "pause", actor); err != nil {
+		t.Fatal(err)
+	}
+	for name, insert := range map[string]func(int, int, string, Actor) error{
+		"fast": db.BulkInsertRandMeasurementFast, "slow": db.BulkInsertRandMeasurementSlow} {
+		if err := insert(1, 1, "hPa", actor); !errors.Is(err, ErrExperimentState) {
+			t.Errorf("%s bulk insert into a paused experiment: %v, want ErrExperimentState", name, err)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// schema migrations for databases created by an older version, CREATE TABLE IF NOT EXISTS does not touch them
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// migrations run in order, the number of applied migrations is stored in PRAGMA user_version.
+// Never reorder or remove entries, only append.
+var migrations = []func(tx *sql.Tx) error{
+	// 1: soft delete
+	func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "measurements", "deleted_at", "TEXT"); err != nil {
+			return err
+		}
+		return addColumnIfMissing(tx, "experiments", "deleted_at", "TEXT")
+	},
+	// 2: revision history, existing measurements become their own first revision
+	func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "measurements", "revision", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO measurement_revisions
+		(measurement_id, revision, sensors_id, value, unit, timestamp, reason, author, created_at)
+		SELECT id, revision, sensors_id, value, unit, timestamp, 'original', 'system', timestamp
+		FROM measurements m
+		WHERE NOT EXISTS (SELECT 1 FROM measurement_revisions r WHERE r.measurement_id = m.id);`)
+		if err != nil {
+			return fmt.Errorf("error seeding measurement revisions: %w", err)
+		}
+		return nil
+	},
+	// 3: optimistic concurrency
+	func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "measurements", "version", "INTEGER NOT NULL DEFAULT 1")
+	},
+	// 4: continuous aggregates of the data that exists already
+	backfillRollups,
+	// 5: integer timestamps and indexes for range queries
+	func(tx *sql.Tx) error {
+		if err := integerTimestamps(tx, "measurements", "timestamp", createMeasurementsSQL,
+			"id, sensors_id, value, unit, timestamp, deleted_at, revision, version"); err != nil {
+			return err
+		}
+		if err := integerTimestamps(tx, "measurement_revisions", "timestamp", createRevisionsSQL,
+			"id, measurement_id, revision, sensors_id, value, unit, timestamp, reason, author, created_at"); err != nil {
+			return err
+		}
+		return createIndexes(tx)
+	},
+	// 6: quantities of sensors and canonical units
+	canonicalUnits,
+	// 7: quality of measurements, set by the validation rules
+	func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "measurements", "quality", "TEXT NOT NULL DEFAULT 'good'"); err != nil {
+			return err
+		}
+		return addColumnIfMissing(tx, "measurements", "quality_reason", "TEXT NOT NULL DEFAULT ''")
+	},
+	// 8: lifecycle of experiments, existing experiments keep accepting measurements
+	func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "experiments", "state", "TEXT NOT NULL DEFAULT 'draft'"); err != nil {
+			return err
+		}
+		if err := addColumnIfMissing(tx, "experiments", "started_at", "TEXT"); err != nil {
+			return err
+		}
+		if err := addColumnIfMissing(tx, "experiments", "ended_at", "TEXT"); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE experiments SET state = ? WHERE state = ?;`, ExperimentRunning, ExperimentDraft); err != nil {
+			return fmt.Errorf("error setting state of existing experiments: %w", err)
+		}
+		return nil
+	},
+	// 9: expected sampling interval of sensors, 0 for sensors without heartbeat monitoring
+	func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "sensors", "expected_interval_seconds", "INTEGER NOT NULL DEFAULT 0")
+	},
+	// 10: the range queries read the quality too, the index covers it again
+	func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DROP INDEX IF EXISTS measurements_sensor_time;`); err != nil {
+			return fmt.Errorf("error dropping index measurements_sensor_time: %w", err)
+		}
+		_, err := tx.Exec(`CREATE INDEX measurements_sensor_time ON measurements (sensors_id, timestamp, deleted_at, value, unit, quality);`)
+		if err != nil {
+			return fmt.Errorf("error creating index measurements_sensor_time: %w", err)
+		}
+		return nil
+	},
+	// 11: rollups and downsamples by quality, so filtered aggregates of purged raw data are answered
+	qualityAggregates,
+	// 12: the template of the seeded experiments, only once so it can be deleted
+	seedTemplate,
+	// 13: when monitoring of a sensor began, 0 for intervals set before the upgrade. The running periods of
+	// experiments are read from the audit log by entity.
+	func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "sensors", "expected_interval_since", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS audit_log_entity ON audit_log (entity, entity_id);`); err != nil {
+			return fmt.Errorf("error creating index audit_log_entity: %w", err)
+		}
+		return nil
+	},
+	// 14: nanosecond created_at of revisions and deletions in the revision history, for as_of reads
+	deletionRevisions,
+}
+
+func (db *Database) migrateTables(tx *sql.Tx) error {
+	var version int
+	if err := tx.QueryRow(`PRAGMA user_version;`).Scan(&version); err != nil {
+		return fmt.Errorf("error reading schema version: %w", err)
+	}
+	for i := version; i < len(migrations); i++ {
+		log.Printf("migrating schema to version %v", i+1)
+		if err := migrations[i](tx); err != nil {
+			return fmt.Errorf("migration %v failed: %w", i+1, err)
+		}
+	}
+	if version < len(migrations) {
+		//PRAGMA does not take parameters
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d;`, len(migrations))); err != nil {
+			return fmt.Errorf("error writing schema version: %w", err)
+		}
+	}
+	return nil
+}
+
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info(?);`, table)
+	if err != nil {
+		return nil, fmt.Errorf("error reading columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("error scanning columns of %s: %w", table, err)
+		}
+		columns[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over columns of %s: %w", table, err)
+	}
+	return columns, nil
+}
+
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	columns, err := tableColumns(tx, table)
+	if err != nil {
+		return err
+	}
+	if columns[column] {
+		return nil
+	}
+
+	log.Printf("migrating: adding column %s.%s", table, column)
+	if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s;`, table, column, definition)); err != nil {
+		return fmt.Errorf("error adding column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// integerTimestamps rebuilds a table whose timestamp column is still TEXT, a column type can not be altered
+// and a TEXT column would keep storing the integers as text
+func integerTimestamps(tx *sql.Tx, table, column string, createSQL func(string) string, columns string) error {
+	var columnType string
+	err := tx.QueryRow(`SELECT type FROM pragma_table_info(?) WHERE name = ?;`, table, column).Scan(&columnType)
+	if err != nil {
+		return fmt.Errorf("error reading type of %s.%s: %w", table, column, err)
+	}
+	if columnType == "INTEGER" {
+		//a table created with the new schema can still hold TEXT copied by an earlier migration
+		_, err := tx.Exec(`UPDATE ` + table + ` SET ` + column + ` = CAST(strftime('%s', ` + column + `) AS INTEGER) * 1000000000
+		WHERE typeof(` + column + `) = 'text';`)
+		if err != nil {
+			return fmt.Errorf("error converting text timestamps of %s.%s: %w", table, column, err)
+		}
+		return nil
+	}
+
+	log.Printf("migrating: converting %s.%s to integer nanoseconds", table, column)
+	newTable := table + "_new"
+	if _, err := tx.Exec(createSQL(newTable)); err != nil {
+		return fmt.Errorf("error creating %s: %w", newTable, err)
+	}
+	//the old timestamps have whole seconds ("YYYY-MM-DD HH:MM:SS" like CURRENT_TIMESTAMP)
+	selectColumns := strings.Replace(columns, column, "CAST(strftime('%s', "+column+") AS INTEGER) * 1000000000", 1)
+	if _, err := tx.Exec(`INSERT INTO ` + newTable + ` (` + columns + `) SELECT ` + selectColumns + ` FROM ` + table + `;`); err != nil {
+		return fmt.Errorf("error copying %s: %w", table, err)
+	}
+
+	//keep the AUTOINCREMENT counter, so ids of purged rows are not handed out again
+	var seq sql.NullInt64
+	err = tx.QueryRow(`SELECT seq FROM sqlite_sequence WHERE name = ?;`, table).Scan(&seq)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error reading id sequence of %s: %w", table, err)
+	}
+	statements := []string{
+		`DROP TABLE ` + table + `;`,
+		`ALTER TABLE ` + newTable + ` RENAME TO ` + table + `;`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("error executing statement: %s, error: %w", stmt, err)
+		}
+	}
+	if seq.Valid {
+		if _, err := tx.Exec(`UPDATE sqlite_sequence SET seq = MAX(seq, ?) WHERE name = ?;`, seq.Int64, table); err != nil {
+			return fmt.Errorf("error restoring id sequence of %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// createIndexes adds the indexes of the range queries. measurements_sensor_time covers the columns
+// the experiment and aggregate queries read, so they never touch the table itself (migration 10 adds the quality).
+func createIndexes(tx *sql.Tx) error {
+	statements := []string{
+		`CREATE INDEX IF NOT EXISTS measurements_sensor_time ON measurements (sensors_id, timestamp, deleted_at, value, unit);`,
+		`CREATE INDEX IF NOT EXISTS sensors_experiment ON sensors (experiment_id);`,
+		`CREATE INDEX IF NOT EXISTS experiments_name ON experiments (name);`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("error executing statement: %s, error: %w", stmt, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// legacySchema is the schema before the first migration, the unit of a measurement could be NULL
+const legacySchema = `
+CREATE TABLE experiments (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT,
+	description TEXT,
+	date DATE DEFAULT CURRENT_DATE
+);
+CREATE TABLE sensors (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	experiment_id INTEGER,
+	sensor_type TEXT,
+	FOREIGN KEY (experiment_id) REFERENCES experiments(id)
+);
+CREATE TABLE measurements (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	sensors_id INTEGER,
+	value REAL,
+	unit TEXT,
+	timestamp TEXT DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (sensors_id) REFERENCES sensors(id)
+);
+INSERT INTO experiments (id, name, description) VALUES (1, 'Legacy', 'created before the migrations');
+INSERT INTO sensors (id, experiment_id, sensor_type) VALUES (1, 1, 'elektrisch');
+INSERT INTO measurements (sensors_id, value, unit, timestamp) VALUES
+	(1, 1.5, NULL, '2025-02-17 11:59:12'),
+	(1, 2.5, NULL, '2025-02-17 11:59:40'),
+	(1, 3, 'V', '2025-02-17 11:59:50');`
+
+// migrateLegacy creates a database with the legacy schema and the extra statements and opens it
+func migrateLegacy(t *testing.T, extra string) *Database {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	legacy, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := legacy.Exec(legacySchema + extra); err != nil {
+		t.Fatal(err)
+	}
+	if err := legacy.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := InitDB(Options{Path: path})
+	if err != nil {
+		t.Fatalf("migrating a legacy database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrateNullUnit(t *testing.T) {
+	db := migrateLegacy(t, "")
+
+	var version int
+	if err := db.dbConn.QueryRow(`PRAGMA user_version;`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Errorf("schema version is %v, want %v", version, len(migrations))
+	}
+
+	var count int64
+	var sum float64
+	err := db.dbConn.QueryRow(`SELECT count, sum FROM measurement_rollups
+	WHERE sensors_id = 1 AND resolution_seconds = 60 AND unit = '';`).Scan(&count, &sum)
+	if err != nil {
+		t.Fatalf("reading the rollup of the measurements without unit: %v", err)
+	}
+	if count != 2 || sum != 4 {
+		t.Errorf("rollup without unit has count %v and sum %v, want 2 and 4", count, sum)
+	}
+}
+
+func TestMigrateSensorQuantity(t *testing.T) {
+	db := migrateLegacy(t, `
+INSERT INTO sensors (id, experiment_id, sensor_type) VALUES (2, 1, 'Barometer'), (3, 1, 'Thermometer'), (4, 1, 'other');
+INSERT INTO measurements (sensors_id, value, unit, timestamp) VALUES
+	(2, 1013, 'hPa', '2025-02-17 12:00:00'),
+	(2, 1012, 'mbar', '2025-02-17 12:00:01'),
+	(2, 20, 'C', '2025-02-17 12:00:02'),
+	(3, 1013, 'hPa', '2025-02-17 12:00:00'),
+	(3, 20, 'C', '2025-02-17 12:00:01'),
+	(4, 1013, 'hPa', '2025-02-17 12:00:00'),
+	(4, 20, 'C', '2025-02-17 12:00:01');`)
+
+	//the majority wins, a tie goes to the quantity of the type and is left open without one
+	want := map[int64]string{1: "voltage", 2: "pressure", 3: "temperature", 4: ""}
+	for id, quantity := range want {
+		s, err := db.GetSensor(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Quantity != quantity {
+			t.Errorf("sensor %v measures %q, want %q", id, s.Quantity, quantity)
+		}
+	}
+}
+
+func TestDeletedTemplateStaysDeleted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := InitDB(Options{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteTemplate(1, Actor{Name: "test"}); err != nil {
+		t.Fatalf("deleting the seeded template: %v", err)
+	}
+	db.Close()
+
+	if db, err = InitDB(Options{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.GetTemplate(1); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("the deleted template is back after reopening, error %v", err)
+	}
+}
@@ -1,34 +1,106 @@
 package database
 
-import "database/sql"
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
 
 type Database struct {
-	dbConn *sql.DB
+	dbConn   *sql.DB // the single writer, every mutation goes through it
+	readConn *sql.DB // read-only pool, the writer itself if ReadConns is 0
+	opts     Options
+
+	// listeners get the measurements of every insert after its commit, see OnInsert and OnExperimentChange,
+	// txListeners get them in its transaction, see OnInsertTx
+	notifyMu            sync.Mutex
+	listeners           []func([]Measurement)
+	txListeners         []func(*sql.Tx, []Measurement) error
+	experimentListeners []func(ExperimentChange)
+
+	// the event types webhooks subscribe to, nil until they are read again, see Subscribed
+	subscriptionsMu sync.Mutex
+	subscriptions   map[string]bool
+
+	// the last timestamp given to a measurement without one, see insertTimestamp
+	lastInsertMu sync.Mutex
+	lastInsert   Timestamp
+}
+
+// what happens when a measurement with the same sensor and timestamp is inserted again
+const (
+	ConflictAllow     = ""          // no unique constraint, duplicates are stored
+	ConflictReject    = "reject"    // the insert fails with ErrDuplicate
+	ConflictIgnore    = "ignore"    // the existing measurement is kept and returned
+	ConflictOverwrite = "overwrite" // the existing measurement gets a new revision with the new values
+)
+
+type Options struct {
+	Path           string // defaults to ./experiments.db
+	ConflictPolicy string
+	JournalMode    string        // defaults to WAL, so readers do not block the writer
+	Synchronous    string        // defaults to FULL, NORMAL with WAL may lose the latest commits on power loss
+	BusyTimeout    time.Duration // how long a connection waits for a lock before "database is locked", 0 fails at once
+	CacheSizeKB    int           // page cache per connection, 0 keeps the SQLite default
+	// size of the read-only pool next to the single writer connection,
+	// 0 shares one unlimited pool for reads and writes (concurrent writes can fail with "database is locked")
+	ReadConns int
 }
 
 type Experiment struct {
-	ID          int    `json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Date        string `json:"date"`
+	ID          int     `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Date        string  `json:"date"`
+	State       string  `json:"state"`                // see the Experiment constants
+	StartedAt   *string `json:"started_at,omitempty"` // set by the first start
+	EndedAt     *string `json:"ended_at,omitempty"`   // set by complete
+	DeletedAt   *string `json:"deleted_at,omitempty"`
 }
 
 type Sensor struct {
 	ID           int    `json:"id"`
 	ExperimentID int    `json:"experiment_id"`
 	SensorType   string `json:"sensor_type"`
+	Quantity     string `json:"quantity"` // see package units, "" until the first measurement with a unit
+	// readings are expected this often, 0 disables gap detection and the online status
+	ExpectedInterval Duration `json:"expected_interval,omitempty"`
 }
 
 type Measurement struct {
-	ID        int64   `json:"id"`
-	SensorsId int64   `json:"sensor_id"`
-	Value     float64 `json:"value"`
-	Unit      string  `json:"unit"`
-	Timestamp string  `json:"timestamp"`
+	ID        int64     `json:"id"`
+	SensorsId int64     `json:"sensor_id"`
+	Value     float64   `json:"value"`
+	Unit      string    `json:"unit"`
+	Timestamp Timestamp `json:"timestamp"`
+	// see the Quality constants, suspect readings have the broken validation rules as reason
+	Quality       string `json:"quality"`
+	QualityReason string `json:"quality_reason,omitempty"`
+	// added on read: the value corrected by the calibration in force at the timestamp (the value without one)
+	CalibratedValue *float64 `json:"calibrated_value,omitempty"`
+	CalibrationID   *int64   `json:"calibration_id,omitempty"`
+	DeletedAt       *string  `json:"deleted_at,omitempty"`
+	Revision        int      `json:"revision"`
+	Version         int      `json:"version"`
 }
 
+// quality of a measurement, flagged readings are kept and can be filtered out with ?quality=
+const (
+	QualityGood         = "good"
+	QualitySuspect      = "suspect"
+	QualityBad          = "bad"
+	QualityInterpolated = "interpolated" // filled in, not read from the sensor
+	QualityCorrected    = "corrected"    // changed by hand, see the revisions
+)
+
+var Qualities = []string{QualityGood, QualitySuspect, QualityBad, QualityInterpolated, QualityCorrected}
+
 type MeasurementResponse struct {
-	Value     float64 `json:"value"`
-	Unit      string  `json:"unit"`
-	Timestamp string  `json:"timestamp"`
+	Value           float64   `json:"value"`
+	CalibratedValue *float64  `json:"calibrated_value,omitempty"`
+	CalibrationID   *int64    `json:"calibration_id,omitempty"`
+	Unit            string    `json:"unit"`
+	Timestamp       Timestamp `json:"timestamp"`
+	Quality         string    `json:"quality"`
+	sensorID        int64     // selects the calibration
 }
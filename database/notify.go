@@ -0,0 +1,135 @@
+// notification of committed inserts, e.g. for live streams
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// OnInsert registers fn to be called with the newly created measurements after every committed insert,
+// in commit order. fn runs while the next insert waits, so it must not block.
+func (d *Database) OnInsert(fn func([]Measurement)) {
+	d.notifyMu.Lock()
+	defer d.notifyMu.Unlock()
+	d.listeners = append(d.listeners, fn)
+}
+
+// OnInsertTx registers fn to be called with the newly created measurements of every insert in its
+// transaction, an error rolls the insert back. fn runs while the insert holds the writer, it must only write to tx.
+func (d *Database) OnInsertTx(fn func(tx *sql.Tx, created []Measurement) error) {
+	d.notifyMu.Lock()
+	defer d.notifyMu.Unlock()
+	d.txListeners = append(d.txListeners, fn)
+}
+
+// withInsertTransaction runs fn in a transaction and hands the measurements it created to the listeners
+// once the commit succeeded. The lock keeps commits and notifications in the same order, so listeners
+// see increasing ids.
+func (d *Database) withInsertTransaction(fn func(tx *sql.Tx) ([]Measurement, error)) error {
+	d.notifyMu.Lock()
+	defer d.notifyMu.Unlock()
+
+	var created []Measurement
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		var err error
+		if created, err = fn(tx); err != nil || len(created) == 0 {
+			return err
+		}
+		for _, listener := range d.txListeners {
+			if err := listener(tx, created); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.notify(created)
+	return nil
+}
+
+// notify must be called with notifyMu held
+func (d *Database) notify(created []Measurement) {
+	if len(created) == 0 {
+		return
+	}
+	for _, fn := range d.listeners {
+		fn(created)
+	}
+}
+
+// ExperimentChange is a lifecycle transition (see the Experiment constants), a move from a state
+// to ExperimentDeleted (the trash) and back, or the creation of an experiment with an empty From.
+type ExperimentChange struct {
+	Experiment Experiment `json:"experiment"`
+	From       string     `json:"from"`
+	To         string     `json:"to"`
+}
+
+// OnExperimentChange registers fn to be called after an experiment changed its state, it must not block
+func (d *Database) OnExperimentChange(fn func(ExperimentChange)) {
+	d.notifyMu.Lock()
+	defer d.notifyMu.Unlock()
+	d.experimentListeners = append(d.experimentListeners, fn)
+}
+
+// notifyExperiment is called after the commit of the change
+func (d *Database) notifyExperiment(change ExperimentChange) {
+	d.notifyMu.Lock()
+	defer d.notifyMu.Unlock()
+	for _, fn := range d.experimentListeners {
+		fn(change)
+	}
+}
+
+// createdOnly keeps the measurements that were inserted, not ignored or overwritten duplicates
+func createdOnly(measurements []Measurement, results []InsertResult) []Measurement {
+	var created []Measurement
+	for i, result := range results {
+		if result == InsertCreated {
+			created = append(created, measurements[i])
+		}
+	}
+	return created
+}
+
+// MeasurementsAfter returns up to limit measurements of the sensors with an id greater than afterID,
+// ordered by id. Live streams use it to resume after a reconnect or after falling behind.
+func (d *Database) MeasurementsAfter(afterID int64, sensorIDs []int64, limit int) ([]Measurement, error) {
+	measurements := []Measurement{}
+	if len(sensorIDs) == 0 {
+		return measurements, nil
+	}
+	params := make([]any, 0, len(sensorIDs)+2)
+	params = append(params, afterID)
+	placeholders := ""
+	for i, id := range sensorIDs {
+		if i > 0 {
+			placeholders += ", "
+		}
+		placeholders += "?"
+		params = append(params, id)
+	}
+	params = append(params, limit)
+
+	queryDB := `SELECT ` + measurementColumns + ` FROM measurements
+	WHERE id > ? AND sensors_id IN (` + placeholders + `) AND deleted_at IS NULL
+	ORDER BY id LIMIT ?;`
+	for m, err := range queryRows(d.readConn, scanMeasurement, queryDB, params...) {
+		if err != nil {
+			return nil, fmt.Errorf("error querying measurements after id %v: %w", afterID, err)
+		}
+		measurements = append(measurements, m)
+	}
+	return measurements, nil
+}
+
+// LastMeasurementID is the highest id in the measurements table, 0 if it is empty
+func (d *Database) LastMeasurementID() (int64, error) {
+	var id int64
+	if err := d.readConn.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM measurements;`).Scan(&id); err != nil {
+		return 0, fmt.Errorf("error getting the last measurement id: %w", err)
+	}
+	return id, nil
+}
@@ -0,0 +1,152 @@
+// quality flags of measurements: flagged readings are kept, reads can exclude them with ?quality=
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ParseQualities reads a comma separated list of qualities, an empty list matches every quality
+func ParseQualities(text string) ([]string, error) {
+	if text == "" {
+		return nil, nil
+	}
+	var qualities []string
+	for _, q := range strings.Split(text, ",") {
+		q = strings.TrimSpace(q)
+		if !slices.Contains(Qualities, q) {
+			return nil, fmt.Errorf("%w: unknown quality %q, valid are %v", ErrInvalidField, q, Qualities)
+		}
+		qualities = append(qualities, q)
+	}
+	return qualities, nil
+}
+
+// qualitySQL is added to WHERE clauses to limit them to the qualities, it is empty for no qualities
+func qualitySQL(table string, qualities []string) (string, []any) {
+	if len(qualities) == 0 {
+		return "", nil
+	}
+	args := make([]any, len(qualities))
+	for i, q := range qualities {
+		args[i] = q
+	}
+	return " AND " + table + ".quality IN (?" + strings.Repeat(", ?", len(qualities)-1) + ")", args
+}
+
+func checkQuality(quality string) error {
+	if !slices.Contains(Qualities, quality) {
+		return fmt.Errorf("%w: quality must be one of %v", ErrInvalidField, Qualities)
+	}
+	return nil
+}
+
+// SetMeasurementQuality flags one measurement, the value stays as it is.
+// With an expectedVersion != 0 it fails with ErrVersionConflict if the measurement was changed meanwhile.
+func (d *Database) SetMeasurementQuality(id int64, quality, reason string, expectedVersion int, actor Actor) (*Measurement, error) {
+	if err := checkQuality(quality); err != nil {
+		return nil, err
+	}
+	var after *Measurement
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		before, err := getMeasurement(tx, id, false)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: measurement(id=%v)", ErrRecordNotFound, id)
+		} else if err != nil {
+			return fmt.Errorf("error getting measurement(id=%v): %w", id, err)
+		}
+		if err := checkVersion(before, expectedVersion); err != nil {
+			return err
+		}
+		if err := checkWritable(tx, before.SensorsId); err != nil {
+			return err
+		}
+		res, err := tx.Exec(`UPDATE measurements SET quality = ?, quality_reason = ?, version = version + 1
+		WHERE id = ? AND version = ? AND deleted_at IS NULL;`, quality, reason, id, before.Version)
+		if err != nil {
+			return fmt.Errorf("error setting quality of measurement(id=%v): %w", id, err)
+		}
+		if rowsAffected, err := res.RowsAffected(); err != nil {
+			return fmt.Errorf("error retrieving rows affected: %w", err)
+		} else if rowsAffected == 0 {
+			return fmt.Errorf("%w: measurement(id=%v) changed while it was flagged", ErrVersionConflict, id)
+		}
+		if after, err = getMeasurement(tx, id, false); err != nil {
+			return fmt.Errorf("error getting flagged measurement(id=%v): %w", id, err)
+		}
+		//the rollups are kept by quality
+		if err := rollupRemove(tx, before); err != nil {
+			return err
+		}
+		if err := rollupAdd(tx, after); err != nil {
+			return err
+		}
+		return writeAudit(tx, actor, AuditUpdate, "measurement", id, before, after)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return after, nil
+}
+
+// QualityFlag flags all measurements of a sensor in [Since, Until)
+type QualityFlag struct {
+	SensorID int64     `json:"sensor_id"`
+	Since    Timestamp `json:"since"`
+	Until    Timestamp `json:"until"`
+	Quality  string    `json:"quality"`
+	Reason   string    `json:"reason,omitempty"`
+	Flagged  int64     `json:"flagged"`
+}
+
+// FlagSensorRange sets the quality of the measurements of the sensor in the range of flag and counts them in
+// flag.Flagged. Every flagged measurement gets an audit entry with its quality and reason before and after.
+func (d *Database) FlagSensorRange(flag *QualityFlag, actor Actor) error {
+	if err := checkQuality(flag.Quality); err != nil {
+		return err
+	}
+	if flag.Since.IsZero() || flag.Until.IsZero() || flag.Since >= flag.Until {
+		return fmt.Errorf("%w: since and until are required, since must be before until", ErrInvalidField)
+	}
+	return d.WithTransaction(func(tx *sql.Tx) error {
+		if _, err := sensorQuantity(tx, flag.SensorID); errors.Is(err, ErrInvalidField) {
+			return fmt.Errorf("%w: sensor %v", ErrRecordNotFound, flag.SensorID)
+		} else if err != nil {
+			return err
+		}
+		if err := checkWritable(tx, flag.SensorID); err != nil {
+			return err
+		}
+		//the rows are audited before the update, which overwrites their quality and reason
+		_, err := tx.Exec(`INSERT INTO audit_log (actor, action, entity, entity_id, before, after, request_id, timestamp)
+		SELECT ?, ?, 'measurement', id,
+			json_object('id', id, 'quality', quality, 'quality_reason', quality_reason, 'version', version),
+			json_object('id', id, 'quality', ?, 'quality_reason', ?, 'version', version + 1), ?, ?
+		FROM measurements
+		WHERE sensors_id = ? AND timestamp >= ? AND timestamp < ? AND deleted_at IS NULL;`,
+			actor.Name, AuditUpdate, flag.Quality, flag.Reason, actor.RequestID, nowUTC(), flag.SensorID, flag.Since, flag.Until)
+		if err != nil {
+			return fmt.Errorf("error writing audit entries of flagged measurements of sensor %v: %w", flag.SensorID, err)
+		}
+		//the rollups are kept by quality, the range moves from the buckets of the old qualities to the new one
+		if err := rollupRange(tx, flag.SensorID, flag.Since, flag.Until, true); err != nil {
+			return err
+		}
+		res, err := tx.Exec(`UPDATE measurements SET quality = ?, quality_reason = ?, version = version + 1
+		WHERE sensors_id = ? AND timestamp >= ? AND timestamp < ? AND deleted_at IS NULL;`,
+			flag.Quality, flag.Reason, flag.SensorID, flag.Since, flag.Until)
+		if err != nil {
+			return fmt.Errorf("error flagging measurements of sensor %v: %w", flag.SensorID, err)
+		}
+		if flag.Flagged, err = res.RowsAffected(); err != nil {
+			return fmt.Errorf("error retrieving rows affected: %w", err)
+		}
+		if err := rollupRange(tx, flag.SensorID, flag.Since, flag.Until, false); err != nil {
+			return err
+		}
+		return rollupMinMax(tx, flag.SensorID, flag.Since, flag.Until)
+	})
+}
@@ -0,0 +1,42 @@
+package database
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestFlagSensorRangeAuditsEveryRow(t *testing.T) {
+	db := openTestDB(t)
+	actor := Actor{Name: "test"}
+	base := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour)
+	m := &Measurement{SensorsId: 1, Value: 1013, Unit: "hPa", Timestamp: NewTimestamp(base.Add(time.Minute))}
+	if _, err := db.InsertMeasurement(m, actor); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SetMeasurementQuality(m.ID, QualitySuspect, "step too large", 0, actor); err != nil {
+		t.Fatal(err)
+	}
+	flag := &QualityFlag{SensorID: 1, Since: NewTimestamp(base), Until: NewTimestamp(base.Add(time.Hour)), Quality: QualityBad,
+		Reason: "sensor broken"}
+	if err := db.FlagSensorRange(flag, actor); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _, err := db.GetAuditLog(AuditFilter{Entity: "measurement", EntityID: m.ID, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before, after Measurement
+	if err := json.Unmarshal(entries[0].Before, &before); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(entries[0].After, &after); err != nil {
+		t.Fatal(err)
+	}
+	if before.Quality != QualitySuspect || before.QualityReason != "step too large" ||
+		after.Quality != QualityBad || after.QualityReason != "sensor broken" {
+		t.Errorf("audit of the range flag: before %s (%s) after %s (%s)", before.Quality, before.QualityReason,
+			after.Quality, after.QualityReason)
+	}
+}
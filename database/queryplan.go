@@ -0,0 +1,78 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type QueryPlan struct {
+	Name      string   `json:"name"`
+	Plan      []string `json:"plan"`
+	UsesIndex bool     `json:"uses_index"`
+}
+
+// CheckQueryPlans runs EXPLAIN QUERY PLAN on the range queries and fails if one of them
+// reads the measurements table without searching an index
+func (d *Database) CheckQueryPlans() ([]QueryPlan, error) {
+	now := time.Now()
+	since, until := NewTimestamp(now.Add(-time.Hour)), NewTimestamp(now)
+	experimentSQL, experimentArgs, err := d.constructTimeRangeSQL(1, since.String(), until.String(), false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	queries := []struct {
+		name  string
+		query string
+		args  []any
+	}{
+		{"experiment time range", experimentSQL, experimentArgs},
+		{"sensor aggregate", rawAggregateSQL + rawAggregateGroupSQL, []any{nanosPerSecond, 60, 60, 1, since, until}},
+		{"experiment measurements per day", countInRangeSQL, []any{1, since, until}},
+		{"natural key", naturalKeySQL, []any{1, since}},
+	}
+
+	plans := make([]QueryPlan, 0, len(queries))
+	var failed []string
+	for _, q := range queries {
+		plan, err := d.explain(q.query, q.args...)
+		if err != nil {
+			return nil, fmt.Errorf("error explaining %s: %w", q.name, err)
+		}
+		usesIndex := false
+		for _, step := range plan {
+			if strings.HasPrefix(step, "SEARCH measurements USING") && strings.Contains(step, "INDEX") {
+				usesIndex = true
+			}
+		}
+		plans = append(plans, QueryPlan{Name: q.name, Plan: plan, UsesIndex: usesIndex})
+		if !usesIndex {
+			failed = append(failed, fmt.Sprintf("%s (%s)", q.name, strings.Join(plan, "; ")))
+		}
+	}
+	if len(failed) > 0 {
+		return plans, fmt.Errorf("queries without index on measurements: %s", strings.Join(failed, ", "))
+	}
+	return plans, nil
+}
+
+// explain returns the detail column of EXPLAIN QUERY PLAN, one entry per step
+func (d *Database) explain(query string, args ...any) ([]string, error) {
+	rows, err := d.readConn.Query(`EXPLAIN QUERY PLAN `+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plan []string
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		if err := rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			return nil, err
+		}
+		plan = append(plan, detail)
+	}
+	return plan, rows.Err()
+}
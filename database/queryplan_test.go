@@ -0,0 +1,40 @@
+package database
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRangeQueriesUseIndex(t *testing.T) {
+	db := openTestDB(t)
+	//enough rows that a full scan would be the wrong plan, ANALYZE gives the planner the statistics of a real database
+	from := time.Now().Add(-24 * time.Hour)
+	if err := db.SeedMeasurements(20_000, 4, from, 4*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.dbConn.Exec(`ANALYZE;`); err != nil {
+		t.Fatal(err)
+	}
+
+	plans, err := db.CheckQueryPlans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plan := range plans {
+		t.Logf("%s: %s", plan.Name, strings.Join(plan.Plan, "; "))
+		//the natural key reads whole rows, the range queries must be answered from the index alone
+		covered := plan.Name == "natural key"
+		for _, step := range plan.Plan {
+			if strings.HasPrefix(step, "SCAN measurements") {
+				t.Errorf("%s scans measurements: %s", plan.Name, strings.Join(plan.Plan, "; "))
+			}
+			if strings.HasPrefix(step, "SEARCH measurements USING COVERING INDEX measurements_sensor_time") {
+				covered = true
+			}
+		}
+		if !covered {
+			t.Errorf("%s does not use the covering index measurements_sensor_time: %s", plan.Name, strings.Join(plan.Plan, "; "))
+		}
+	}
+}
@@ -0,0 +1,418 @@
+// retention rules: raw measurements are purged after a while, optionally downsampled to averages first
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Duration is stored as seconds and written as Go duration string ("720h") in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"720h\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) seconds() int64 {
+	return int64(time.Duration(d) / time.Second)
+}
+
+// RetentionRule applies to one sensor or to all sensors of an experiment, a sensor rule wins.
+// DownsampleInterval 0 purges raw data without keeping averages, DownsampleRetention 0 keeps the averages forever.
+type RetentionRule struct {
+	ID                  int64    `json:"id"`
+	ExperimentID        *int64   `json:"experiment_id,omitempty"`
+	SensorID            *int64   `json:"sensor_id,omitempty"`
+	RawRetention        Duration `json:"raw_retention"`
+	DownsampleInterval  Duration `json:"downsample_interval"`
+	DownsampleRetention Duration `json:"downsample_retention"`
+	CreatedAt           string   `json:"created_at"`
+}
+
+// Downsample sums up the downsamples of the selected qualities in a bucket
+type Downsample struct {
+	SensorID    int64   `json:"sensor_id"`
+	Interval    int64   `json:"interval_seconds"`
+	BucketStart string  `json:"bucket_start"`
+	Unit        string  `json:"unit"`
+	Count       int64   `json:"count"`
+	Avg         float64 `json:"avg"`
+	Min         float64 `json:"min"`
+	Max         float64 `json:"max"`
+}
+
+type SensorRetention struct {
+	SensorID          int64 `json:"sensor_id"`
+	RuleID            int64 `json:"rule_id"`
+	RawPurged         int64 `json:"raw_purged"`
+	BucketsWritten    int64 `json:"buckets_written"`
+	DownsamplesPurged int64 `json:"downsamples_purged"`
+}
+
+type RetentionReport struct {
+	DryRun            bool              `json:"dry_run"`
+	StartedAt         string            `json:"started_at"`
+	Duration          string            `json:"duration"`
+	RawPurged         int64             `json:"raw_purged"`
+	BucketsWritten    int64             `json:"buckets_written"`
+	DownsamplesPurged int64             `json:"downsamples_purged"`
+	Sensors           []SensorRetention `json:"sensors"`
+}
+
+type RetentionMetrics struct {
+	Runs              int64   `json:"runs"`
+	RawPurged         int64   `json:"raw_purged"`
+	BucketsWritten    int64   `json:"buckets_written"`
+	DownsamplesPurged int64   `json:"downsamples_purged"`
+	LastRunAt         *string `json:"last_run_at"`
+	LastRunDuration   *string `json:"last_run_duration"`
+}
+
+func (r *RetentionRule) validate() error {
+	if (r.ExperimentID == nil) == (r.SensorID == nil) {
+		return fmt.Errorf("%w: a rule needs either experiment_id or sensor_id", ErrInvalidField)
+	}
+	if r.RawRetention < Duration(time.Minute) {
+		return fmt.Errorf("%w: raw_retention must be at least 1m", ErrInvalidField)
+	}
+	if r.DownsampleInterval < 0 || (r.DownsampleInterval > 0 && r.DownsampleInterval < Duration(time.Second)) {
+		return fmt.Errorf("%w: downsample_interval must be 0 or at least 1s", ErrInvalidField)
+	}
+	if r.DownsampleRetention < 0 {
+		return fmt.Errorf("%w: downsample_retention must not be negative", ErrInvalidField)
+	}
+	return nil
+}
+
+func (d *Database) CreateRetentionRule(rule *RetentionRule, actor Actor) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	return d.WithTransaction(func(tx *sql.Tx) error {
+		rule.CreatedAt = nowUTC()
+		res, err := tx.Exec(`INSERT INTO retention_rules
+		(experiment_id, sensor_id, raw_retention_seconds, downsample_interval_seconds, downsample_retention_seconds, created_at)
+		VALUES (?, ?, ?, ?, ?, ?);`, rule.ExperimentID, rule.SensorID, rule.RawRetention.seconds(),
+			rule.DownsampleInterval.seconds(), rule.DownsampleRetention.seconds(), rule.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("error inserting retention rule: %w", err)
+		}
+		if rule.ID, err = res.LastInsertId(); err != nil {
+			return fmt.Errorf("error retrieving last insert ID: %w", err)
+		}
+		return writeAudit(tx, actor, AuditInsert, "retention_rule", rule.ID, nil, rule)
+	})
+}
+
+func (d *Database) DeleteRetentionRule(id int64, actor Actor) error {
+	return d.WithTransaction(func(tx *sql.Tx) error {
+		rules, err := getRetentionRules(tx, ` WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		if len(rules) == 0 {
+			return fmt.Errorf("%w: retention rule %v", ErrRecordNotFound, id)
+		}
+		if _, err := tx.Exec(`DELETE FROM retention_rules WHERE id = ?;`, id); err != nil {
+			return fmt.Errorf("error deleting retention rule %v: %w", id, err)
+		}
+		return writeAudit(tx, actor, AuditDelete, "retention_rule", id, rules[0], nil)
+	})
+}
+
+func (d *Database) GetRetentionRules() ([]RetentionRule, error) {
+	return getRetentionRules(d.readConn, "")
+}
+
+// querier is implemented by *sql.DB and *sql.Tx
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// retentionConn is the write transaction of a run or the read pool of a preview, which never writes
+type retentionConn interface {
+	querier
+	rowQuerier
+	execer
+}
+
+func getRetentionRules(q querier, where string, args ...any) ([]RetentionRule, error) {
+	rows, err := q.Query(`SELECT id, experiment_id, sensor_id, raw_retention_seconds,
+	downsample_interval_seconds, downsample_retention_seconds, created_at
+	FROM retention_rules`+where+` ORDER BY id;`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying retention rules: %w", err)
+	}
+	defer rows.Close()
+
+	rules := []RetentionRule{}
+	for rows.Next() {
+		var r RetentionRule
+		var raw, interval, downsampleRetention int64
+		if err := rows.Scan(&r.ID, &r.ExperimentID, &r.SensorID, &raw, &interval, &downsampleRetention, &r.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning retention rule: %w", err)
+		}
+		r.RawRetention = Duration(time.Duration(raw) * time.Second)
+		r.DownsampleInterval = Duration(time.Duration(interval) * time.Second)
+		r.DownsampleRetention = Duration(time.Duration(downsampleRetention) * time.Second)
+		rules = append(rules, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over retention rules: %w", err)
+	}
+	return rules, nil
+}
+
+// effectiveRules maps every sensor with a rule to the rule that applies, sensor rules win over experiment rules
+func effectiveRules(tx querier, rules []RetentionRule) (map[int64]RetentionRule, error) {
+	byExperiment := make(map[int64]RetentionRule)
+	bySensor := make(map[int64]RetentionRule)
+	for _, r := range rules {
+		if r.SensorID != nil {
+			bySensor[*r.SensorID] = r
+		} else {
+			byExperiment[*r.ExperimentID] = r
+		}
+	}
+
+	rows, err := tx.Query(`SELECT id, experiment_id FROM sensors;`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying sensors: %w", err)
+	}
+	defer rows.Close()
+
+	effective := make(map[int64]RetentionRule)
+	for rows.Next() {
+		var sensorID int64
+		var experimentID sql.NullInt64
+		if err := rows.Scan(&sensorID, &experimentID); err != nil {
+			return nil, fmt.Errorf("error scanning sensor: %w", err)
+		}
+		if r, ok := bySensor[sensorID]; ok {
+			effective[sensorID] = r
+		} else if r, ok := byExperiment[experimentID.Int64]; ok && experimentID.Valid {
+			effective[sensorID] = r
+		}
+	}
+	return effective, rows.Err()
+}
+
+func countRows(tx rowQuerier, query string, args ...any) (int64, error) {
+	var n int64
+	if err := tx.QueryRow(query, args...).Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// bucketSQL is the start of the downsample bucket of a measurement (timestamps in nanoseconds), takes the interval in seconds twice
+const bucketSQL = `datetime((timestamp / 1000000000 / ?) * ?, 'unixepoch')`
+
+func applySensorRetention(tx retentionConn, sensorID int64, rule RetentionRule, now time.Time, dryRun bool) (SensorRetention, error) {
+	result := SensorRetention{SensorID: sensorID, RuleID: rule.ID}
+	rawCutoff := NewTimestamp(now.Add(-time.Duration(rule.RawRetention)))
+	interval := rule.DownsampleInterval.seconds()
+	var err error
+
+	//the averages are kept by quality like the rollups. Soft deleted measurements are left to the
+	//trash purge, so they can still be restored until the trash retention is over.
+	result.RawPurged, err = countRows(tx, `SELECT COUNT(*) FROM measurements
+	WHERE sensors_id = ? AND timestamp < ? AND deleted_at IS NULL;`, sensorID, rawCutoff)
+	if err != nil {
+		return result, fmt.Errorf("error counting expired measurements of sensor %v: %w", sensorID, err)
+	}
+	if result.RawPurged == 0 {
+		return result, nil
+	}
+
+	if interval > 0 {
+		result.BucketsWritten, err = countRows(tx, `SELECT COUNT(*) FROM (SELECT DISTINCT `+bucketSQL+`, unit, quality
+		FROM measurements WHERE sensors_id = ? AND timestamp < ? AND deleted_at IS NULL);`, interval, interval, sensorID, rawCutoff)
+		if err != nil {
+			return result, fmt.Errorf("error counting buckets of sensor %v: %w", sensorID, err)
+		}
+		if !dryRun {
+			//merge with a bucket that was partly written by an earlier run
+			_, err = tx.Exec(`INSERT INTO measurement_downsamples
+			(sensors_id, interval_seconds, bucket_start, unit, quality, count, avg, min, max)
+			SELECT sensors_id, ?, `+bucketSQL+` AS bucket, COALESCE(unit, '') AS bucket_unit, quality,
+				COUNT(*), AVG(value), MIN(value), MAX(value)
+			FROM measurements
+			WHERE sensors_id = ? AND timestamp < ? AND deleted_at IS NULL
+			GROUP BY bucket, bucket_unit, quality
+			ON CONFLICT (sensors_id, interval_seconds, bucket_start, unit, quality) DO UPDATE SET
+				avg = (avg * count + excluded.avg * excluded.count) / (count + excluded.count),
+				count = count + excluded.count,
+				min = MIN(min, excluded.min),
+				max = MAX(max, excluded.max);`, interval, interval, interval, sensorID, rawCutoff)
+			if err != nil {
+				return result, fmt.Errorf("error downsampling sensor %v: %w", sensorID, err)
+			}
+		}
+	}
+
+	if !dryRun {
+		_, err = tx.Exec(`DELETE FROM measurement_revisions WHERE measurement_id IN
+		(SELECT id FROM measurements WHERE sensors_id = ? AND timestamp < ? AND deleted_at IS NULL);`, sensorID, rawCutoff)
+		if err != nil {
+			return result, fmt.Errorf("error purging revisions of sensor %v: %w", sensorID, err)
+		}
+		_, err = tx.Exec(`DELETE FROM measurements WHERE sensors_id = ? AND timestamp < ? AND deleted_at IS NULL;`, sensorID, rawCutoff)
+		if err != nil {
+			return result, fmt.Errorf("error purging measurements of sensor %v: %w", sensorID, err)
+		}
+	}
+
+	if interval > 0 && rule.DownsampleRetention > 0 {
+		downsampleCutoff := now.Add(-time.Duration(rule.DownsampleRetention)).UTC().Format(time.DateTime)
+		where := ` FROM measurement_downsamples WHERE sensors_id = ? AND interval_seconds = ? AND bucket_start < ?;`
+		result.DownsamplesPurged, err = countRows(tx, `SELECT COUNT(*)`+where, sensorID, interval, downsampleCutoff)
+		if err != nil {
+			return result, fmt.Errorf("error counting expired downsamples of sensor %v: %w", sensorID, err)
+		}
+		if !dryRun && result.DownsamplesPurged > 0 {
+			if _, err = tx.Exec(`DELETE`+where, sensorID, interval, downsampleCutoff); err != nil {
+				return result, fmt.Errorf("error purging downsamples of sensor %v: %w", sensorID, err)
+			}
+		}
+	}
+	return result, nil
+}
+
+// ApplyRetention enforces all retention rules, with dryRun it only reports what would happen.
+// A dry run reads from the read pool and does not block writers.
+func (d *Database) ApplyRetention(dryRun bool) (*RetentionReport, error) {
+	start := time.Now()
+	report := &RetentionReport{DryRun: dryRun, StartedAt: start.UTC().Format(time.DateTime), Sensors: []SensorRetention{}}
+	if dryRun {
+		if err := applyRetention(d.readConn, report, start, true); err != nil {
+			return nil, err
+		}
+		return report, nil
+	}
+
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		if err := applyRetention(tx, report, start, false); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO retention_runs
+		(started_at, duration_ms, raw_purged, buckets_written, downsamples_purged) VALUES (?, ?, ?, ?, ?);`,
+			report.StartedAt, time.Since(start).Milliseconds(), report.RawPurged, report.BucketsWritten, report.DownsamplesPurged)
+		if err != nil {
+			return fmt.Errorf("error recording retention run: %w", err)
+		}
+		if report.RawPurged > 0 {
+			summary := map[string]any{"raw_purged": report.RawPurged, "buckets_written": report.BucketsWritten}
+			return writeAudit(tx, SystemActor, AuditPurge, "measurement", 0, nil, summary)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// applyRetention applies the rule of every sensor and adds the results to the report
+func applyRetention(conn retentionConn, report *RetentionReport, start time.Time, dryRun bool) error {
+	rules, err := getRetentionRules(conn, "")
+	if err != nil {
+		return err
+	}
+	effective, err := effectiveRules(conn, rules)
+	if err != nil {
+		return err
+	}
+	sensorIDs := slices.Sorted(maps.Keys(effective))
+	for _, sensorID := range sensorIDs {
+		result, err := applySensorRetention(conn, sensorID, effective[sensorID], start, dryRun)
+		if err != nil {
+			return err
+		}
+		report.RawPurged += result.RawPurged
+		report.BucketsWritten += result.BucketsWritten
+		report.DownsamplesPurged += result.DownsamplesPurged
+		report.Sensors = append(report.Sensors, result)
+	}
+	report.Duration = time.Since(start).String()
+	return nil
+}
+
+func (d *Database) GetRetentionMetrics() (*RetentionMetrics, error) {
+	m := &RetentionMetrics{}
+	err := d.readConn.QueryRow(`SELECT COUNT(*), COALESCE(SUM(raw_purged), 0), COALESCE(SUM(buckets_written), 0),
+	COALESCE(SUM(downsamples_purged), 0) FROM retention_runs;`).Scan(&m.Runs, &m.RawPurged, &m.BucketsWritten, &m.DownsamplesPurged)
+	if err != nil {
+		return nil, fmt.Errorf("error summing retention runs: %w", err)
+	}
+	if m.Runs == 0 {
+		return m, nil
+	}
+
+	var lastRun string
+	var durationMs int64
+	err = d.readConn.QueryRow(`SELECT started_at, duration_ms FROM retention_runs ORDER BY id DESC LIMIT 1;`).Scan(&lastRun, &durationMs)
+	if err != nil {
+		return nil, fmt.Errorf("error getting last retention run: %w", err)
+	}
+	lastDuration := (time.Duration(durationMs) * time.Millisecond).String()
+	m.LastRunAt, m.LastRunDuration = &lastRun, &lastDuration
+	return m, nil
+}
+
+// GetDownsamples merges the qualities of each bucket, no qualities select all of them. Downsamples written
+// before they were kept by quality have none and are only returned without qualities.
+func (d *Database) GetDownsamples(sensorID int64, interval int64, since, until string, qualities []string) ([]Downsample, error) {
+	queryDB := `SELECT sensors_id, interval_seconds, bucket_start, unit, SUM(count), SUM(avg * count) / SUM(count), MIN(min), MAX(max)
+	FROM measurement_downsamples WHERE sensors_id = ?`
+	params := []any{sensorID}
+	if interval > 0 {
+		queryDB += " AND interval_seconds = ?"
+		params = append(params, interval)
+	}
+	if since != "" {
+		queryDB += " AND bucket_start >= ?"
+		params = append(params, since)
+	}
+	if until != "" {
+		queryDB += " AND bucket_start <= ?"
+		params = append(params, until)
+	}
+	where, qualityParams := qualitySQL("measurement_downsamples", qualities)
+	rows, err := d.readConn.Query(queryDB+where+` GROUP BY interval_seconds, bucket_start, unit
+	ORDER BY bucket_start, interval_seconds, unit;`, append(params, qualityParams...)...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying downsamples of sensor %v: %w", sensorID, err)
+	}
+	defer rows.Close()
+
+	downsamples := []Downsample{}
+	for rows.Next() {
+		var ds Downsample
+		if err := rows.Scan(&ds.SensorID, &ds.Interval, &ds.BucketStart, &ds.Unit, &ds.Count, &ds.Avg, &ds.Min, &ds.Max); err != nil {
+			return nil, fmt.Errorf("error scanning downsample: %w", err)
+		}
+		downsamples = append(downsamples, ds)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over downsamples: %w", err)
+	}
+	return downsamples, nil
+}
@@ -0,0 +1,145 @@
+// revision history of measurements, the measurements table always holds the latest revision
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"iter"
+	"time"
+)
+
+type Revision struct {
+	MeasurementID int64     `json:"measurement_id"`
+	Revision      int       `json:"revision"`
+	SensorsId     int64     `json:"sensor_id"`
+	Value         float64   `json:"value"`
+	Unit          string    `json:"unit"`
+	Timestamp     Timestamp `json:"timestamp"`
+	Reason        string    `json:"reason"`
+	Author        string    `json:"author"`
+	CreatedAt     Timestamp `json:"created_at"`
+	Deleted       bool      `json:"deleted,omitempty"` // the measurement was moved to the trash with this revision
+}
+
+const revisionInsertSQL = `INSERT INTO measurement_revisions
+	(measurement_id, revision, sensors_id, value, unit, timestamp, reason, author, created_at, deleted)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+
+// revisionFromRowSQL copies a freshly inserted row as its first revision, takes reason, author, created_at and id
+const revisionFromRowSQL = `INSERT INTO measurement_revisions
+	(measurement_id, revision, sensors_id, value, unit, timestamp, reason, author, created_at)
+	SELECT id, revision, sensors_id, value, unit, timestamp, ?, ?, ?
+	FROM measurements WHERE id = ?;`
+
+// writeRevision stores the current state of m as a new revision, inside the transaction of the change.
+// Deleting and restoring m are revisions as well, so as_of reads know when it was in the trash.
+func writeRevision(tx *sql.Tx, m *Measurement, reason, author string) error {
+	_, err := tx.Exec(revisionInsertSQL, m.ID, m.Revision, m.SensorsId, m.Value, m.Unit, m.Timestamp, reason, author,
+		NewTimestamp(time.Now()), m.DeletedAt != nil)
+	if err != nil {
+		return fmt.Errorf("error writing revision %v of measurement(id=%v): %w", m.Revision, m.ID, err)
+	}
+	return nil
+}
+
+func (d *Database) GetMeasurementRevisions(id int) ([]Revision, error) {
+	queryDB := `SELECT measurement_id, revision, sensors_id, value, unit, timestamp, reason, author, created_at, deleted
+	FROM measurement_revisions
+	WHERE measurement_id = ?
+	ORDER BY revision;`
+	rows, err := d.readConn.Query(queryDB, id)
+	if err != nil {
+		return nil, fmt.Errorf("error querying revisions of measurement(id=%v): %w", id, err)
+	}
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+		var r Revision
+		if err := rows.Scan(&r.MeasurementID, &r.Revision, &r.SensorsId, &r.Value, &r.Unit, &r.Timestamp, &r.Reason, &r.Author, &r.CreatedAt, &r.Deleted); err != nil {
+			return nil, fmt.Errorf("error scanning revision: %w", err)
+		}
+		revisions = append(revisions, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over revisions: %w", err)
+	}
+	if len(revisions) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return revisions, nil
+}
+
+// asOfSQL selects the revision of every measurement that was current at the given time (a Timestamp),
+// measurements created later or in the trash at that time are left out.
+// Historic rows have no version (0), they can not be the base of an update. The quality is the current one.
+const asOfSQL = `SELECT r.measurement_id, r.sensors_id, r.value, r.unit, r.timestamp, NULL, r.revision, 0,
+	m.quality, m.quality_reason
+	FROM measurement_revisions r
+	INNER JOIN measurements m ON m.id = r.measurement_id
+	WHERE r.revision = (
+		SELECT MAX(r2.revision) FROM measurement_revisions r2
+		WHERE r2.measurement_id = r.measurement_id AND r2.created_at <= ?
+	)
+	AND r.deleted = 0`
+
+// parseAsOf reads YYYY-MM-DD HH:MM:SS (UTC) with an optional fraction
+func parseAsOf(asOf string) (Timestamp, error) {
+	t, err := ParseTimestamp(asOf)
+	if err != nil {
+		return 0, fmt.Errorf("%w: as_of: %w", ErrInvalidField, err)
+	}
+	return t, nil
+}
+
+// GetMeasurementAsOf returns the measurement like it was at asOf (YYYY-MM-DD HH:MM:SS, UTC)
+func (d *Database) GetMeasurementAsOf(id int, asOf string) (*Measurement, error) {
+	at, err := parseAsOf(asOf)
+	if err != nil {
+		return nil, err
+	}
+	m, err := scanMeasurement(d.readConn.QueryRow(asOfSQL+` AND r.measurement_id = ?;`, at, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrRecordNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting measurement(id=%v) as of %s: %w", id, asOf, err)
+	}
+	return &m, calibrateOne(d.readConn, &m)
+}
+
+// StreamMeasurementsAsOf yields every measurement like it was at asOf, limited to the qualities if there are any
+func (d *Database) StreamMeasurementsAsOf(asOf string, qualities []string) iter.Seq2[Measurement, error] {
+	at, err := parseAsOf(asOf)
+	if err != nil {
+		return func(yield func(Measurement, error) bool) { yield(Measurement{}, err) }
+	}
+	where, params := qualitySQL("m", qualities)
+	queryDB := asOfSQL + where + ` ORDER BY r.measurement_id;`
+	return calibrated(d.readConn, scanMeasurement, measurementSensor, calibrations.measurement, queryDB, append([]any{at}, params...)...)
+}
+
+// deletionRevisions is migration 14: created_at of the revisions becomes a Timestamp, and every measurement
+// in the trash gets a revision that deleted it at its deleted_at. Restores before the upgrade are not known.
+func deletionRevisions(tx *sql.Tx) error {
+	if err := integerTimestamps(tx, "measurement_revisions", "created_at", createRevisionsSQL,
+		"id, measurement_id, revision, sensors_id, value, unit, timestamp, reason, author, created_at"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(tx, "measurement_revisions", "deleted", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	statements := []string{
+		`INSERT INTO measurement_revisions
+		(measurement_id, revision, sensors_id, value, unit, timestamp, reason, author, created_at, deleted)
+		SELECT id, revision + 1, sensors_id, value, unit, timestamp, 'deleted', 'system',
+			CAST(strftime('%s', deleted_at) AS INTEGER) * 1000000000, 1
+		FROM measurements WHERE deleted_at IS NOT NULL;`,
+		`UPDATE measurements SET revision = revision + 1 WHERE deleted_at IS NOT NULL;`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("error executing statement: %s, error: %w", stmt, err)
+		}
+	}
+	return nil
+}
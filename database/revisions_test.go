@@ -0,0 +1,40 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAsOfKnowsTheTrash(t *testing.T) {
+	db := openTestDB(t)
+	actor := Actor{Name: "test"}
+	m := &Measurement{SensorsId: 1, Value: 1013, Unit: "hPa"}
+	if _, err := db.InsertMeasurement(m, actor); err != nil {
+		t.Fatal(err)
+	}
+	id := int(m.ID)
+	if err := db.DeleteMeasurement(id, 0, actor); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.RestoreMeasurement(id, actor); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := db.GetMeasurementRevisions(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 3 || !revisions[1].Deleted || revisions[2].Deleted {
+		t.Fatalf("revisions %+v, want the original, a deleted and a restored one", revisions)
+	}
+
+	for i, r := range revisions {
+		_, err := db.GetMeasurementAsOf(id, r.CreatedAt.String())
+		if deleted := errors.Is(err, ErrRecordNotFound); deleted != r.Deleted {
+			t.Errorf("as of revision %v (%s): %v, want deleted %v", i+1, r.Reason, err, r.Deleted)
+		}
+	}
+	//nanoseconds before the insert it did not exist yet
+	if _, err := db.GetMeasurementAsOf(id, (revisions[0].CreatedAt - 1).String()); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("as of just before the insert: %v, want ErrRecordNotFound", err)
+	}
+}
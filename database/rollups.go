@@ -0,0 +1,350 @@
+// continuous aggregates: per sensor rollups (minute, hour, day) that are maintained with every write of raw data,
+// by unit and quality
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+// RollupResolutions are the bucket sizes in seconds that are maintained, from fine to coarse
+var RollupResolutions = []int64{60, 3600, 86400}
+
+// execer is implemented by *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+type Aggregate struct {
+	BucketStart string  `json:"bucket_start"`
+	Unit        string  `json:"unit"`
+	Count       int64   `json:"count"`
+	Mean        float64 `json:"mean"`
+	Min         float64 `json:"min"`
+	Max         float64 `json:"max"`
+	Stddev      float64 `json:"stddev"`
+}
+
+type AggregateResult struct {
+	SensorID int64       `json:"sensor_id"`
+	Bucket   string      `json:"bucket"`
+	Source   string      `json:"source"` // "raw" or "rollup_<seconds>s"
+	Buckets  []Aggregate `json:"buckets"`
+}
+
+// nanosPerSecond converts the integer timestamps to epoch seconds in SQL
+const nanosPerSecond = int64(time.Second)
+
+func bucketStart(timestamp Timestamp, resolution int64) int64 {
+	return timestamp.Time().Unix() / resolution * resolution
+}
+
+func epochToDateTime(epoch int64) string {
+	return time.Unix(epoch, 0).UTC().Format(time.DateTime)
+}
+
+// rollupAdd counts a measurement into its buckets, deleted measurements are not counted
+func rollupAdd(e execer, m *Measurement) error {
+	if m.DeletedAt != nil {
+		return nil
+	}
+	for _, resolution := range RollupResolutions {
+		start := bucketStart(m.Timestamp, resolution)
+		_, err := e.Exec(`INSERT INTO measurement_rollups
+		(sensors_id, resolution_seconds, bucket_start, unit, quality, count, sum, min, max, sum_sq)
+		VALUES (?, ?, ?, ?, ?, 1, ?, ?, ?, ?)
+		ON CONFLICT (sensors_id, resolution_seconds, bucket_start, unit, quality) DO UPDATE SET
+			count = count + 1,
+			sum = sum + excluded.sum,
+			min = MIN(min, excluded.min),
+			max = MAX(max, excluded.max),
+			sum_sq = sum_sq + excluded.sum_sq;`,
+			m.SensorsId, resolution, start, m.Unit, m.Quality, m.Value, m.Value, m.Value, m.Value*m.Value)
+		if err != nil {
+			return fmt.Errorf("error adding measurement(id=%v) to rollup %vs: %w", m.ID, resolution, err)
+		}
+	}
+	return nil
+}
+
+// rollupRemove takes a measurement out of its buckets. It has to be called after the raw row was changed,
+// because min and max are recomputed from the remaining raw data of the bucket if the removed value was one of them.
+func rollupRemove(e execer, m *Measurement) error {
+	if m.DeletedAt != nil {
+		return nil
+	}
+	for _, resolution := range RollupResolutions {
+		start := bucketStart(m.Timestamp, resolution)
+		key := []any{m.SensorsId, resolution, start, m.Unit, m.Quality}
+		where := ` WHERE sensors_id = ? AND resolution_seconds = ? AND bucket_start = ? AND unit = ? AND quality = ?`
+
+		_, err := e.Exec(`UPDATE measurement_rollups SET count = count - 1, sum = sum - ?, sum_sq = sum_sq - ?`+where+`;`,
+			append([]any{m.Value, m.Value * m.Value}, key...)...)
+		if err != nil {
+			return fmt.Errorf("error removing measurement(id=%v) from rollup %vs: %w", m.ID, resolution, err)
+		}
+		if _, err = e.Exec(`DELETE FROM measurement_rollups`+where+` AND count <= 0;`, key...); err != nil {
+			return fmt.Errorf("error removing empty rollup %vs: %w", resolution, err)
+		}
+
+		//raw data of the bucket that was already purged by retention keeps its old min/max
+		rawRange := []any{m.SensorsId, m.Unit, m.Quality, start * nanosPerSecond, (start + resolution) * nanosPerSecond}
+		rawWhere := ` FROM measurements WHERE sensors_id = ? AND unit = ? AND quality = ? AND deleted_at IS NULL
+			AND timestamp >= ? AND timestamp < ?`
+		args := append(append(append([]any{}, rawRange...), rawRange...), key...)
+		args = append(args, m.Value, m.Value)
+		_, err = e.Exec(`UPDATE measurement_rollups SET
+			min = COALESCE((SELECT MIN(value)`+rawWhere+`), min),
+			max = COALESCE((SELECT MAX(value)`+rawWhere+`), max)`+where+` AND (? <= min OR ? >= max);`, args...)
+		if err != nil {
+			return fmt.Errorf("error recomputing min/max of rollup %vs: %w", resolution, err)
+		}
+	}
+	return nil
+}
+
+// rollupRange adds the measurements of the sensor in [since, until) to their buckets, or subtracts them with
+// subtract. Bulk changes of the quality subtract the rows before and add them after the change, then
+// rollupMinMax fixes the extremes.
+func rollupRange(e execer, sensorID int64, since, until Timestamp, subtract bool) error {
+	raw := `SELECT (timestamp / ? / ?) * ? AS bucket, unit, quality,
+		COUNT(*) AS count, SUM(value) AS sum, MIN(value) AS min, MAX(value) AS max, SUM(value * value) AS sum_sq
+	FROM measurements
+	WHERE sensors_id = ? AND deleted_at IS NULL AND timestamp >= ? AND timestamp < ?
+	GROUP BY bucket, unit, quality`
+	for _, resolution := range RollupResolutions {
+		args := []any{nanosPerSecond, resolution, resolution, sensorID, since, until}
+		var err error
+		if subtract {
+			_, err = e.Exec(`UPDATE measurement_rollups SET
+				count = measurement_rollups.count - r.count,
+				sum = measurement_rollups.sum - r.sum,
+				sum_sq = measurement_rollups.sum_sq - r.sum_sq
+			FROM (`+raw+`) AS r
+			WHERE measurement_rollups.sensors_id = ? AND measurement_rollups.resolution_seconds = ?
+				AND measurement_rollups.bucket_start = r.bucket AND measurement_rollups.unit = r.unit
+				AND measurement_rollups.quality = r.quality;`, append(args, sensorID, resolution)...)
+			if err == nil {
+				_, err = e.Exec(`DELETE FROM measurement_rollups WHERE sensors_id = ? AND resolution_seconds = ? AND count <= 0;`,
+					sensorID, resolution)
+			}
+		} else {
+			_, err = e.Exec(`INSERT INTO measurement_rollups
+			(sensors_id, resolution_seconds, bucket_start, unit, quality, count, sum, min, max, sum_sq)
+			SELECT ?, ?, bucket, unit, quality, count, sum, min, max, sum_sq FROM (`+raw+`) WHERE true
+			ON CONFLICT (sensors_id, resolution_seconds, bucket_start, unit, quality) DO UPDATE SET
+				count = count + excluded.count,
+				sum = sum + excluded.sum,
+				min = MIN(min, excluded.min),
+				max = MAX(max, excluded.max),
+				sum_sq = sum_sq + excluded.sum_sq;`, append([]any{sensorID, resolution}, args...)...)
+		}
+		if err != nil {
+			return fmt.Errorf("error changing rollup %vs of sensor %v: %w", resolution, sensorID, err)
+		}
+	}
+	return nil
+}
+
+// rollupMinMax recomputes min and max of the buckets of the sensor that overlap [since, until) from the raw data.
+// Buckets whose raw data was partly purged by retention keep their old extremes.
+func rollupMinMax(e execer, sensorID int64, since, until Timestamp) error {
+	raw := ` FROM measurements WHERE sensors_id = measurement_rollups.sensors_id AND unit = measurement_rollups.unit
+		AND quality = measurement_rollups.quality AND deleted_at IS NULL
+		AND timestamp >= measurement_rollups.bucket_start * ?
+		AND timestamp < (measurement_rollups.bucket_start + measurement_rollups.resolution_seconds) * ?`
+	for _, resolution := range RollupResolutions {
+		_, err := e.Exec(`UPDATE measurement_rollups SET min = (SELECT MIN(value)`+raw+`), max = (SELECT MAX(value)`+raw+`)
+		WHERE sensors_id = ? AND resolution_seconds = ? AND bucket_start >= ? AND bucket_start * ? < ?
+			AND count = (SELECT COUNT(*)`+raw+`);`,
+			nanosPerSecond, nanosPerSecond, nanosPerSecond, nanosPerSecond, sensorID, resolution,
+			bucketStart(since, resolution), nanosPerSecond, until, nanosPerSecond, nanosPerSecond)
+		if err != nil {
+			return fmt.Errorf("error recomputing min/max of rollup %vs of sensor %v: %w", resolution, sensorID, err)
+		}
+	}
+	return nil
+}
+
+// backfillRollups builds the rollups of all existing raw data, used by the migration.
+// It runs before migration 5, so the timestamps are still TEXT. Old databases can have measurements
+// without a unit, their rollups get the empty unit like the ones of inserts.
+func backfillRollups(tx *sql.Tx) error {
+	for _, resolution := range RollupResolutions {
+		_, err := tx.Exec(`INSERT INTO measurement_rollups
+		(sensors_id, resolution_seconds, bucket_start, unit, count, sum, min, max, sum_sq)
+		SELECT sensors_id, ?, (CAST(strftime('%s', timestamp) AS INTEGER) / ?) * ? AS bucket, COALESCE(unit, '') AS bucket_unit,
+			COUNT(*), SUM(value), MIN(value), MAX(value), SUM(value * value)
+		FROM measurements
+		WHERE deleted_at IS NULL
+		GROUP BY sensors_id, bucket, bucket_unit;`, resolution, resolution, resolution)
+		if err != nil {
+			return fmt.Errorf("error backfilling rollup %vs: %w", resolution, err)
+		}
+	}
+	return nil
+}
+
+// rebuildRollups recomputes all rollups from the raw data after the values were changed in bulk, used by the
+// migration to canonical units. It runs before migration 11, all rollups get the default quality.
+func rebuildRollups(tx *sql.Tx) error {
+	if _, err := tx.Exec(`DELETE FROM measurement_rollups;`); err != nil {
+		return fmt.Errorf("error clearing rollups: %w", err)
+	}
+	for _, resolution := range RollupResolutions {
+		_, err := tx.Exec(`INSERT INTO measurement_rollups
+		(sensors_id, resolution_seconds, bucket_start, unit, count, sum, min, max, sum_sq)
+		SELECT sensors_id, ?, (timestamp / ? / ?) * ? AS bucket, COALESCE(unit, '') AS bucket_unit,
+			COUNT(*), SUM(value), MIN(value), MAX(value), SUM(value * value)
+		FROM measurements
+		WHERE deleted_at IS NULL
+		GROUP BY sensors_id, bucket, bucket_unit;`, resolution, nanosPerSecond, resolution, resolution)
+		if err != nil {
+			return fmt.Errorf("error rebuilding rollup %vs: %w", resolution, err)
+		}
+	}
+	return nil
+}
+
+// qualityAggregates is the migration that adds the quality to the keys of the rollups and downsamples, a primary key
+// can not be altered. Rollups whose raw data is complete are rebuilt by quality. Rollups of purged raw data and
+// downsamples keep their values with the empty quality, what they contained is not known any more.
+func qualityAggregates(tx *sql.Tx) error {
+	statements := []string{
+		`CREATE TABLE measurement_rollups_new (
+			sensors_id INTEGER NOT NULL,
+			resolution_seconds INTEGER NOT NULL,
+			bucket_start INTEGER NOT NULL,
+			unit TEXT NOT NULL DEFAULT '',
+			quality TEXT NOT NULL DEFAULT '',
+			count INTEGER NOT NULL,
+			sum REAL NOT NULL,
+			min REAL,
+			max REAL,
+			sum_sq REAL NOT NULL,
+			PRIMARY KEY (sensors_id, resolution_seconds, bucket_start, unit, quality)
+		);`,
+		`INSERT INTO measurement_rollups_new
+		(sensors_id, resolution_seconds, bucket_start, unit, quality, count, sum, min, max, sum_sq)
+		SELECT sensors_id, resolution_seconds, bucket_start, unit, '', count, sum, min, max, sum_sq
+		FROM measurement_rollups
+		WHERE count > (SELECT COUNT(*) FROM measurements m WHERE m.sensors_id = measurement_rollups.sensors_id
+			AND COALESCE(m.unit, '') = measurement_rollups.unit AND m.deleted_at IS NULL
+			AND m.timestamp >= measurement_rollups.bucket_start * 1000000000
+			AND m.timestamp < (measurement_rollups.bucket_start + measurement_rollups.resolution_seconds) * 1000000000);`,
+		`DROP TABLE measurement_rollups;`,
+		`ALTER TABLE measurement_rollups_new RENAME TO measurement_rollups;`,
+		`CREATE TABLE measurement_downsamples_new (
+			sensors_id INTEGER NOT NULL,
+			interval_seconds INTEGER NOT NULL,
+			bucket_start TEXT NOT NULL,
+			unit TEXT,
+			quality TEXT NOT NULL DEFAULT '',
+			count INTEGER NOT NULL,
+			avg REAL,
+			min REAL,
+			max REAL,
+			PRIMARY KEY (sensors_id, interval_seconds, bucket_start, unit, quality)
+		);`,
+		`INSERT INTO measurement_downsamples_new (sensors_id, interval_seconds, bucket_start, unit, quality, count, avg, min, max)
+		SELECT sensors_id, interval_seconds, bucket_start, unit, '', count, avg, min, max FROM measurement_downsamples;`,
+		`DROP TABLE measurement_downsamples;`,
+		`ALTER TABLE measurement_downsamples_new RENAME TO measurement_downsamples;`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("error executing statement: %s, error: %w", stmt, err)
+		}
+	}
+
+	//the buckets that were kept above have raw data that is counted in them already
+	for _, resolution := range RollupResolutions {
+		_, err := tx.Exec(`INSERT INTO measurement_rollups
+		(sensors_id, resolution_seconds, bucket_start, unit, quality, count, sum, min, max, sum_sq)
+		SELECT sensors_id, ?, bucket, unit, quality, COUNT(*), SUM(value), MIN(value), MAX(value), SUM(value * value)
+		FROM (SELECT sensors_id, (timestamp / ? / ?) * ? AS bucket, COALESCE(unit, '') AS unit, quality, value
+			FROM measurements WHERE deleted_at IS NULL) AS raw
+		WHERE NOT EXISTS (SELECT 1 FROM measurement_rollups r WHERE r.sensors_id = raw.sensors_id
+			AND r.resolution_seconds = ? AND r.bucket_start = raw.bucket AND r.unit = raw.unit AND r.quality = '')
+		GROUP BY sensors_id, bucket, unit, quality;`, resolution, nanosPerSecond, resolution, resolution, resolution)
+		if err != nil {
+			return fmt.Errorf("error rebuilding rollup %vs by quality: %w", resolution, err)
+		}
+	}
+	return nil
+}
+
+// rollupFor returns the coarsest rollup that adds up exactly to the requested buckets, 0 if there is none
+func rollupFor(bucket, since, until int64) int64 {
+	for i := len(RollupResolutions) - 1; i >= 0; i-- {
+		r := RollupResolutions[i]
+		if bucket%r == 0 && since%r == 0 && until%r == 0 {
+			return r
+		}
+	}
+	return 0
+}
+
+// rawAggregateSQL takes nanosPerSecond, the bucket size twice, the sensor and the time range,
+// the quality condition goes between it and rawAggregateGroupSQL
+const rawAggregateSQL = `SELECT (timestamp / ? / ?) * ? AS bucket, unit,
+	COUNT(*), SUM(value), MIN(value), MAX(value), SUM(value * value)
+FROM measurements
+WHERE sensors_id = ? AND deleted_at IS NULL AND timestamp >= ? AND timestamp < ?`
+
+const rawAggregateGroupSQL = `
+GROUP BY bucket, unit
+ORDER BY bucket, unit;`
+
+// AggregateSensor returns count, mean, min, max and stddev per bucket in [since, until).
+// It reads the rollups if the bucket size and range allow it, otherwise the raw measurements.
+// Rollups of raw data purged before they were kept by quality have no quality and only count without a filter.
+func (d *Database) AggregateSensor(sensorID int64, bucket time.Duration, since, until time.Time, qualities []string) (*AggregateResult, error) {
+	bucketSeconds := int64(bucket / time.Second)
+	if bucketSeconds < 1 {
+		return nil, fmt.Errorf("%w: bucket must be at least 1s", ErrInvalidField)
+	}
+	result := &AggregateResult{SensorID: sensorID, Bucket: bucket.String(), Buckets: []Aggregate{}}
+
+	var rows *sql.Rows
+	var err error
+	if resolution := rollupFor(bucketSeconds, since.Unix(), until.Unix()); resolution > 0 {
+		result.Source = fmt.Sprintf("rollup_%vs", resolution)
+		where, params := qualitySQL("measurement_rollups", qualities)
+		rows, err = d.readConn.Query(`SELECT (bucket_start / ?) * ? AS bucket, unit,
+			SUM(count), SUM(sum), MIN(min), MAX(max), SUM(sum_sq)
+		FROM measurement_rollups
+		WHERE sensors_id = ? AND resolution_seconds = ? AND bucket_start >= ? AND bucket_start < ?`+where+`
+		GROUP BY bucket, unit
+		ORDER BY bucket, unit;`, append([]any{bucketSeconds, bucketSeconds, sensorID, resolution, since.Unix(), until.Unix()}, params...)...)
+	} else {
+		result.Source = "raw"
+		where, params := qualitySQL("measurements", qualities)
+		rows, err = d.readConn.Query(rawAggregateSQL+where+rawAggregateGroupSQL, append([]any{nanosPerSecond, bucketSeconds,
+			bucketSeconds, sensorID, NewTimestamp(since), NewTimestamp(until)}, params...)...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error aggregating sensor %v: %w", sensorID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a Aggregate
+		var start int64
+		var sum, sumSq float64
+		if err := rows.Scan(&start, &a.Unit, &a.Count, &sum, &a.Min, &a.Max, &sumSq); err != nil {
+			return nil, fmt.Errorf("error scanning aggregate: %w", err)
+		}
+		a.BucketStart = epochToDateTime(start)
+		a.Mean = sum / float64(a.Count)
+		//population stddev, rounding can make the variance slightly negative
+		a.Stddev = math.Sqrt(math.Max(0, sumSq/float64(a.Count)-a.Mean*a.Mean))
+		result.Buckets = append(result.Buckets, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over aggregates: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQualityAggregatesAfterPurge(t *testing.T) {
+	db := openTestDB(t)
+	actor := Actor{Name: "test"}
+	base := time.Now().UTC().Truncate(time.Hour).Add(-48 * time.Hour)
+	for i, value := range []float64{1, 2, 3, 4} {
+		m := &Measurement{SensorsId: 1, Value: value, Unit: "hPa", Timestamp: NewTimestamp(base.Add(time.Duration(i+1) * time.Minute))}
+		if _, err := db.InsertMeasurement(m, actor); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flag := &QualityFlag{SensorID: 1, Since: NewTimestamp(base.Add(3 * time.Minute)), Until: NewTimestamp(base.Add(5 * time.Minute)),
+		Quality: QualityBad}
+	if err := db.FlagSensorRange(flag, actor); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(state string, qualities []string, count int64, mean, min, max float64) {
+		t.Helper()
+		result, err := db.AggregateSensor(1, time.Hour, base, base.Add(time.Hour), qualities)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Source != "rollup_3600s" || len(result.Buckets) != 1 {
+			t.Fatalf("%s, quality %v: source %s with %v buckets, want one bucket of rollup_3600s", state, qualities, result.Source, len(result.Buckets))
+		}
+		b := result.Buckets[0]
+		if b.Count != count || b.Mean != mean || b.Min != min || b.Max != max {
+			t.Errorf("%s, quality %v: count %v mean %v min %v max %v, want %v %v %v %v", state, qualities,
+				b.Count, b.Mean, b.Min, b.Max, count, mean, min, max)
+		}
+	}
+	check("flagged", []string{QualityGood}, 2, 1.5, 1, 2)
+	check("flagged", []string{QualityBad}, 2, 3.5, 3, 4)
+	check("flagged", nil, 4, 2.5, 1, 4)
+
+	sensorID := int64(1)
+	rule := &RetentionRule{SensorID: &sensorID, RawRetention: Duration(time.Hour), DownsampleInterval: Duration(time.Hour)}
+	if err := db.CreateRetentionRule(rule, actor); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ApplyRetention(false); err != nil {
+		t.Fatal(err)
+	}
+	check("purged", []string{QualityGood}, 2, 1.5, 1, 2)
+	check("purged", []string{QualityBad}, 2, 3.5, 3, 4)
+
+	for _, tc := range []struct {
+		qualities []string
+		count     int64
+		avg       float64
+	}{{nil, 4, 2.5}, {[]string{QualityBad}, 2, 3.5}} {
+		downsamples, err := db.GetDownsamples(1, 3600, "", "", tc.qualities)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(downsamples) != 1 || downsamples[0].Count != tc.count || downsamples[0].Avg != tc.avg {
+			t.Errorf("downsamples of quality %v: %+v, want count %v and avg %v", tc.qualities, downsamples, tc.count, tc.avg)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package database
+
+import (
+	"fmt"
+	"iter"
+)
+
+// queryRows runs the query when the iteration starts and yields one scanned row at a time,
+// so a result never has to fit into memory. The rows are closed when the loop ends or breaks.
+// After an error nothing more is yielded.
+func queryRows[T any](q querier, scan func(rowScanner) (T, error), query string, args ...any) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		rows, err := q.Query(query, args...)
+		if err != nil {
+			yield(zero, fmt.Errorf("error querying rows: %w", err))
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			row, err := scan(rows)
+			if err != nil {
+				yield(zero, fmt.Errorf("error scanning row: %w", err))
+				return
+			}
+			if !yield(row, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(zero, fmt.Errorf("error during row iteration: %w", err))
+		}
+	}
+}
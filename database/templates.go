@@ -0,0 +1,400 @@
+// experiment templates: the configuration of a rig, new experiments are created from a template or cloned
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"measurements-api-stdlib-docker/units"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// TemplateSensor is a sensor of a template, its alert rules are created for every sensor made from it
+type TemplateSensor struct {
+	SensorType string      `json:"sensor_type"`
+	Unit       string      `json:"unit,omitempty"`        // fixes the quantity of the sensor, see package units
+	AlertRules []AlertRule `json:"alert_rules,omitempty"` // without sensor_id and sensor_type
+	// see Sensor.ExpectedInterval
+	ExpectedInterval Duration `json:"expected_interval,omitempty"`
+}
+
+type ExperimentTemplate struct {
+	ID          int64            `json:"id"`
+	Name        string           `json:"name"`
+	Description string           `json:"description"` // of the experiments created from it
+	Sensors     []TemplateSensor `json:"sensors"`
+	// rules of the sensor types, created with an experiment unless an equal rule exists
+	ValidationRules []ValidationRule `json:"validation_rules,omitempty"`
+	CreatedAt       string           `json:"created_at"`
+}
+
+// NewExperiment is the request to create an experiment, from a template if TemplateID is set.
+// Without a description the one of the template or of the cloned experiment is taken.
+type NewExperiment struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	TemplateID  int64  `json:"template_id,omitempty"`
+}
+
+func (t *ExperimentTemplate) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("%w: a template needs a name", ErrInvalidField)
+	}
+	if len(t.Sensors) == 0 {
+		return fmt.Errorf("%w: a template needs sensors", ErrInvalidField)
+	}
+	for i := range t.Sensors {
+		s := &t.Sensors[i]
+		if s.SensorType == "" {
+			return fmt.Errorf("%w: sensor %v of the template needs a sensor_type", ErrInvalidField, i)
+		}
+		if s.Unit != "" {
+			u, ok := units.Lookup(s.Unit)
+			if !ok {
+				return fmt.Errorf("%w: unknown unit %q, see GET /units", ErrInvalidField, s.Unit)
+			}
+			s.Unit = u.Symbol
+		}
+		if err := checkExpectedInterval(s.ExpectedInterval); err != nil {
+			return err
+		}
+		for j := range s.AlertRules {
+			rule := &s.AlertRules[j]
+			if rule.SensorID != nil || rule.SensorType != nil {
+				return fmt.Errorf("%w: alert rules of a template sensor apply to it, they take no sensor_id or sensor_type", ErrInvalidField)
+			}
+			//validate needs a target, the sensor does not exist yet
+			rule.SensorID = new(int64)
+			err := rule.validate()
+			rule.SensorID = nil
+			if err != nil {
+				return fmt.Errorf("alert rule %s of sensor %v: %w", rule.Name, i, err)
+			}
+		}
+	}
+	for i := range t.ValidationRules {
+		if err := t.ValidationRules[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateTemplate stores the template, a name that is taken fails with ErrDuplicate
+func (d *Database) CreateTemplate(t *ExperimentTemplate, actor Actor) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	return d.WithTransaction(func(tx *sql.Tx) error {
+		return insertTemplate(tx, t, actor)
+	})
+}
+
+func insertTemplate(tx *sql.Tx, t *ExperimentTemplate, actor Actor) error {
+	sensors, err := json.Marshal(t.Sensors)
+	if err != nil {
+		return fmt.Errorf("error marshalling sensors of template: %w", err)
+	}
+	rules, err := json.Marshal(t.ValidationRules)
+	if err != nil {
+		return fmt.Errorf("error marshalling validation rules of template: %w", err)
+	}
+	t.CreatedAt = nowUTC()
+	res, err := tx.Exec(`INSERT INTO experiment_templates (name, description, sensors, validation_rules, created_at)
+	VALUES (?, ?, ?, ?, ?);`, t.Name, t.Description, string(sensors), string(rules), t.CreatedAt)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return fmt.Errorf("%w: template %s exists", ErrDuplicate, t.Name)
+	} else if err != nil {
+		return fmt.Errorf("error inserting template: %w", err)
+	}
+	if t.ID, err = res.LastInsertId(); err != nil {
+		return fmt.Errorf("error retrieving last insert ID: %w", err)
+	}
+	return writeAudit(tx, actor, AuditInsert, "experiment_template", t.ID, nil, t)
+}
+
+// DeleteTemplate removes the template, experiments created from it are not changed
+func (d *Database) DeleteTemplate(id int64, actor Actor) error {
+	return d.WithTransaction(func(tx *sql.Tx) error {
+		before, err := getTemplate(tx, id)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM experiment_templates WHERE id = ?;`, id); err != nil {
+			return fmt.Errorf("error deleting template %v: %w", id, err)
+		}
+		return writeAudit(tx, actor, AuditDelete, "experiment_template", id, before, nil)
+	})
+}
+
+func (d *Database) GetTemplate(id int64) (*ExperimentTemplate, error) {
+	return getTemplate(d.readConn, id)
+}
+
+func (d *Database) GetTemplates() ([]ExperimentTemplate, error) {
+	templates := []ExperimentTemplate{}
+	for t, err := range queryRows(d.readConn, scanTemplate, `SELECT `+templateColumns+` FROM experiment_templates ORDER BY id;`) {
+		if err != nil {
+			return nil, fmt.Errorf("error querying templates: %w", err)
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+const templateColumns = `id, name, description, sensors, validation_rules, created_at`
+
+func scanTemplate(row rowScanner) (ExperimentTemplate, error) {
+	var t ExperimentTemplate
+	var sensors, rules string
+	if err := row.Scan(&t.ID, &t.Name, &t.Description, &sensors, &rules, &t.CreatedAt); err != nil {
+		return t, err
+	}
+	if err := json.Unmarshal([]byte(sensors), &t.Sensors); err != nil {
+		return t, fmt.Errorf("error reading sensors of template %v: %w", t.ID, err)
+	}
+	if err := json.Unmarshal([]byte(rules), &t.ValidationRules); err != nil {
+		return t, fmt.Errorf("error reading validation rules of template %v: %w", t.ID, err)
+	}
+	return t, nil
+}
+
+func getTemplate(q rowQuerier, id int64) (*ExperimentTemplate, error) {
+	t, err := scanTemplate(q.QueryRow(`SELECT `+templateColumns+` FROM experiment_templates WHERE id = ?;`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: template %v", ErrRecordNotFound, id)
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting template %v: %w", id, err)
+	}
+	return &t, nil
+}
+
+// CreateExperiment creates a draft experiment, with the sensors, alert rules and validation rules of the
+// template if one is given
+func (d *Database) CreateExperiment(n NewExperiment, actor Actor) (*Experiment, []Sensor, error) {
+	var created *Experiment
+	var sensors []Sensor
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		var config []TemplateSensor
+		if n.TemplateID != 0 {
+			t, err := getTemplate(tx, n.TemplateID)
+			if err != nil {
+				return err
+			}
+			if n.Description == "" {
+				n.Description = t.Description
+			}
+			if err := ensureValidationRules(tx, t.ValidationRules, actor); err != nil {
+				return err
+			}
+			config = t.Sensors
+		}
+		var err error
+		created, sensors, err = createExperiment(tx, n, config, actor)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	d.notifyExperiment(ExperimentChange{Experiment: *created, To: created.State})
+	return created, sensors, nil
+}
+
+// CloneExperiment creates a draft experiment with the sensors and alert rules of the sensors of ref, but
+// without its measurements. Validation rules apply to the sensor types and so to the clone as well.
+func (d *Database) CloneExperiment(ref string, n NewExperiment, actor Actor) (*Experiment, []Sensor, error) {
+	var created *Experiment
+	var sensors []Sensor
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		source, err := getExperiment(tx, ref, false)
+		if err != nil {
+			return err
+		}
+		config, err := experimentConfig(tx, source.ID)
+		if err != nil {
+			return err
+		}
+		if n.Description == "" {
+			n.Description = source.Description
+		}
+		created, sensors, err = createExperiment(tx, n, config, actor)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	d.notifyExperiment(ExperimentChange{Experiment: *created, To: created.State})
+	return created, sensors, nil
+}
+
+// SaveTemplate stores the configuration of the experiment ref as a template named name,
+// with the validation rules of its sensor types
+func (d *Database) SaveTemplate(ref, name string, actor Actor) (*ExperimentTemplate, error) {
+	var t *ExperimentTemplate
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		source, err := getExperiment(tx, ref, false)
+		if err != nil {
+			return err
+		}
+		config, err := experimentConfig(tx, source.ID)
+		if err != nil {
+			return err
+		}
+		t = &ExperimentTemplate{Name: name, Description: source.Description, Sensors: config}
+		var sensorTypes []any
+		for _, s := range config {
+			sensorTypes = append(sensorTypes, s.SensorType)
+		}
+		if len(sensorTypes) > 0 {
+			rules, err := getValidationRules(tx, ` WHERE sensor_type IN (?`+strings.Repeat(", ?", len(sensorTypes)-1)+`)`, sensorTypes...)
+			if err != nil {
+				return err
+			}
+			for _, rule := range rules {
+				rule.ID, rule.CreatedAt = 0, ""
+				t.ValidationRules = append(t.ValidationRules, rule)
+			}
+		}
+		if err := t.validate(); err != nil {
+			return err
+		}
+		return insertTemplate(tx, t, actor)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// experimentConfig returns the sensors of the experiment with their alert rules, ordered by id
+func experimentConfig(tx *sql.Tx, experimentID int) ([]TemplateSensor, error) {
+	var rows []Sensor
+	for s, err := range queryRows(tx, scanSensor, `SELECT `+sensorColumns+` FROM sensors
+	WHERE experiment_id = ? ORDER BY id;`, experimentID) {
+		if err != nil {
+			return nil, fmt.Errorf("error reading sensors of experiment %v: %w", experimentID, err)
+		}
+		rows = append(rows, s)
+	}
+
+	config := []TemplateSensor{}
+	for _, s := range rows {
+		sensor := TemplateSensor{SensorType: s.SensorType, ExpectedInterval: s.ExpectedInterval}
+		if canonical, ok := units.Canonical(s.Quantity); ok {
+			sensor.Unit = canonical.Symbol
+		}
+		rules, err := getAlertRules(tx, ` WHERE sensor_id = ?`, s.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			rule.ID, rule.SensorID, rule.CreatedAt = 0, nil, ""
+			sensor.AlertRules = append(sensor.AlertRules, rule)
+		}
+		config = append(config, sensor)
+	}
+	return config, nil
+}
+
+// createExperiment inserts a draft experiment with the sensors of config
+func createExperiment(tx *sql.Tx, n NewExperiment, config []TemplateSensor, actor Actor) (*Experiment, []Sensor, error) {
+	if n.Name == "" {
+		return nil, nil, fmt.Errorf("%w: an experiment needs a name", ErrInvalidField)
+	}
+	//experiments are addressed by id or name, a number would be taken for an id
+	if _, err := strconv.Atoi(n.Name); err == nil {
+		return nil, nil, fmt.Errorf("%w: the name of an experiment must not be a number", ErrInvalidField)
+	}
+	if _, err := getExperiment(tx, n.Name, false); err == nil {
+		return nil, nil, fmt.Errorf("%w: experiment %s exists", ErrDuplicate, n.Name)
+	} else if !errors.Is(err, ErrRecordNotFound) {
+		return nil, nil, err
+	}
+
+	res, err := tx.Exec(`INSERT INTO experiments (name, description, date, state) VALUES (?, ?, ?, ?);`,
+		n.Name, n.Description, time.Now().UTC().Format(time.DateOnly), ExperimentDraft)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error inserting experiment %s: %w", n.Name, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error retrieving last insert ID: %w", err)
+	}
+	created, err := getExperiment(tx, strconv.FormatInt(id, 10), false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeAudit(tx, actor, AuditInsert, "experiment", id, nil, created); err != nil {
+		return nil, nil, err
+	}
+
+	sensors := []Sensor{}
+	for _, s := range config {
+		sensor := Sensor{ExperimentID: created.ID, SensorType: s.SensorType, ExpectedInterval: s.ExpectedInterval}
+		if u, ok := units.Lookup(s.Unit); ok {
+			sensor.Quantity = u.Quantity
+		}
+		res, err := tx.Exec(`INSERT INTO sensors (experiment_id, sensor_type, quantity, expected_interval_seconds, expected_interval_since)
+		VALUES (?, ?, ?, ?, ?);`, sensor.ExperimentID, sensor.SensorType, sensor.Quantity, sensor.ExpectedInterval.seconds(),
+			NewTimestamp(time.Now()))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error inserting sensor of experiment %s: %w", n.Name, err)
+		}
+		sensorID, err := res.LastInsertId()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error retrieving last insert ID: %w", err)
+		}
+		sensor.ID = int(sensorID)
+		if err := writeAudit(tx, actor, AuditInsert, "sensor", sensorID, nil, sensor); err != nil {
+			return nil, nil, err
+		}
+		for _, rule := range s.AlertRules {
+			rule.SensorID, rule.SensorType = &sensorID, nil
+			if err := insertAlertRule(tx, &rule, actor); err != nil {
+				return nil, nil, err
+			}
+		}
+		sensors = append(sensors, sensor)
+	}
+	return created, sensors, nil
+}
+
+// ensureValidationRules creates the rules that do not exist yet
+func ensureValidationRules(tx *sql.Tx, rules []ValidationRule, actor Actor) error {
+	for _, rule := range rules {
+		existing, err := getValidationRules(tx, ` WHERE sensor_type = ?`, rule.SensorType)
+		if err != nil {
+			return err
+		}
+		if !containsValidationRule(existing, rule) {
+			if err := insertValidationRule(tx, &rule, actor); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// containsValidationRule compares the checks of the rules, not their id and creation time
+func containsValidationRule(rules []ValidationRule, rule ValidationRule) bool {
+	normalize := func(r ValidationRule) ValidationRule {
+		r.ID, r.CreatedAt = 0, ""
+		if len(r.AllowedUnits) == 0 {
+			r.AllowedUnits = nil
+		}
+		return r
+	}
+	for _, existing := range rules {
+		if reflect.DeepEqual(normalize(existing), normalize(rule)) {
+			return true
+		}
+	}
+	return false
+}
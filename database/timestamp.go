@@ -0,0 +1,94 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// TimestampLayout is time.DateTime with optional fractional seconds, whole seconds are written without them
+const TimestampLayout = "2006-01-02 15:04:05.999999999"
+
+// Timestamp is the time of a reading, stored as integer nanoseconds since the epoch (UTC)
+// and written as "YYYY-MM-DD HH:MM:SS[.fraction]" in JSON. 0 means not set.
+type Timestamp int64
+
+func NewTimestamp(t time.Time) Timestamp {
+	return Timestamp(t.UnixNano())
+}
+
+// ParseTimestamp reads TimestampLayout (with or without fraction) or RFC 3339
+func ParseTimestamp(value string) (Timestamp, error) {
+	t, err := time.Parse(TimestampLayout, value)
+	if err != nil {
+		var rfcErr error
+		if t, rfcErr = time.Parse(time.RFC3339Nano, value); rfcErr != nil {
+			return 0, fmt.Errorf("invalid timestamp %q, expected YYYY-MM-DD HH:MM:SS: %w", value, err)
+		}
+	}
+	return NewTimestamp(t), nil
+}
+
+func (t Timestamp) Time() time.Time {
+	return time.Unix(0, int64(t)).UTC()
+}
+
+func (t Timestamp) IsZero() bool {
+	return t == 0
+}
+
+func (t Timestamp) String() string {
+	return t.Time().Format(TimestampLayout)
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("timestamp must be a string: %w", err)
+	}
+	if s == "" {
+		*t = 0
+		return nil
+	}
+	parsed, err := ParseTimestamp(s)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+func (t Timestamp) Value() (driver.Value, error) {
+	return int64(t), nil
+}
+
+// Scan also reads the TEXT timestamps of databases that were not migrated yet
+func (t *Timestamp) Scan(src any) error {
+	switch v := src.(type) {
+	case int64:
+		*t = Timestamp(v)
+	case nil:
+		*t = 0
+	case string:
+		return t.scanText(v)
+	case []byte:
+		return t.scanText(string(v))
+	default:
+		return fmt.Errorf("can not scan %T into a timestamp", src)
+	}
+	return nil
+}
+
+func (t *Timestamp) scanText(value string) error {
+	parsed, err := ParseTimestamp(value)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
@@ -0,0 +1,93 @@
+// hard deletion of soft deleted rows after the retention period
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type PurgeResult struct {
+	Measurements int64 `json:"measurements"`
+	Experiments  int64 `json:"experiments"`
+}
+
+// PurgeDeleted hard deletes everything that is in the trash since before the cutoff,
+// experiments are removed together with their sensors and measurements
+func (d *Database) PurgeDeleted(cutoff time.Time) (PurgeResult, error) {
+	var result PurgeResult
+	deletedBefore := cutoff.UTC().Format(time.DateTime)
+
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT id FROM experiments WHERE deleted_at IS NOT NULL AND deleted_at < ?;`, deletedBefore)
+		if err != nil {
+			return fmt.Errorf("error querying experiments to purge: %w", err)
+		}
+		var experimentIDs []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return fmt.Errorf("error scanning experiment id: %w", err)
+			}
+			experimentIDs = append(experimentIDs, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating over experiments to purge: %w", err)
+		}
+
+		for _, id := range experimentIDs {
+			res, err := tx.Exec(`DELETE FROM measurements
+			WHERE sensors_id IN (SELECT id FROM sensors WHERE experiment_id = ?);`, id)
+			if err != nil {
+				return fmt.Errorf("error purging measurements of experiment %v: %w", id, err)
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return fmt.Errorf("error retrieving rows affected: %w", err)
+			}
+			result.Measurements += n
+			_, err = tx.Exec(`DELETE FROM measurement_rollups
+			WHERE sensors_id IN (SELECT id FROM sensors WHERE experiment_id = ?);`, id)
+			if err != nil {
+				return fmt.Errorf("error purging rollups of experiment %v: %w", id, err)
+			}
+			_, err = tx.Exec(`DELETE FROM sensor_calibrations
+			WHERE sensors_id IN (SELECT id FROM sensors WHERE experiment_id = ?);`, id)
+			if err != nil {
+				return fmt.Errorf("error purging calibrations of experiment %v: %w", id, err)
+			}
+			if _, err := tx.Exec(`DELETE FROM sensors WHERE experiment_id = ?;`, id); err != nil {
+				return fmt.Errorf("error purging sensors of experiment %v: %w", id, err)
+			}
+			if _, err := tx.Exec(`DELETE FROM experiments WHERE id = ?;`, id); err != nil {
+				return fmt.Errorf("error purging experiment %v: %w", id, err)
+			}
+			if err := writeAudit(tx, SystemActor, AuditPurge, "experiment", id, nil, nil); err != nil {
+				return err
+			}
+			result.Experiments++
+		}
+
+		res, err := tx.Exec(`DELETE FROM measurements WHERE deleted_at IS NOT NULL AND deleted_at < ?;`, deletedBefore)
+		if err != nil {
+			return fmt.Errorf("error purging measurements: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("error retrieving rows affected: %w", err)
+		}
+		result.Measurements += n
+		if n > 0 {
+			//one summary entry, the single measurements are already in the log with their delete
+			summary := map[string]any{"count": n, "deleted_before": deletedBefore}
+			return writeAudit(tx, SystemActor, AuditPurge, "measurement", 0, nil, summary)
+		}
+		return nil
+	})
+	if err != nil {
+		return PurgeResult{}, err
+	}
+	return result, nil
+}
@@ -0,0 +1,281 @@
+// units of measurements: values are stored in the canonical unit of the quantity their sensor measures
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"measurements-api-stdlib-docker/units"
+	"strings"
+	"time"
+)
+
+// sensorQuantity returns what the sensor measures, "" if that is not known yet
+func sensorQuantity(q rowQuerier, sensorID int64) (string, error) {
+	var quantity string
+	err := q.QueryRow(`SELECT quantity FROM sensors WHERE id = ?;`, sensorID).Scan(&quantity)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("%w: sensor %v does not exist", ErrInvalidField, sensorID)
+	} else if err != nil {
+		return "", fmt.Errorf("error getting quantity of sensor %v: %w", sensorID, err)
+	}
+	return quantity, nil
+}
+
+// toCanonicalUnit converts the value of m into the canonical unit and checks that the unit fits the sensor,
+// values in the canonical unit are stored as posted.
+// A sensor without quantity takes the one of its first measurement with a unit, without a unit
+// the value is taken to be in the canonical unit of the sensor.
+func toCanonicalUnit(tx *sql.Tx, m *Measurement) error {
+	quantity, err := sensorQuantity(tx, m.SensorsId)
+	if err != nil {
+		return err
+	}
+	if m.Unit == "" {
+		if canonical, ok := units.Canonical(quantity); ok {
+			m.Unit = canonical.Symbol
+		}
+		return nil
+	}
+	u, ok := units.Lookup(m.Unit)
+	if !ok {
+		return fmt.Errorf("%w: unknown unit %q, see GET /units", ErrInvalidField, m.Unit)
+	}
+	if quantity == "" {
+		if _, err := tx.Exec(`UPDATE sensors SET quantity = ? WHERE id = ?;`, u.Quantity, m.SensorsId); err != nil {
+			return fmt.Errorf("error setting quantity of sensor %v: %w", m.SensorsId, err)
+		}
+	} else if u.Quantity != quantity {
+		return fmt.Errorf("%w: %s measures %s but sensor %v measures %s", ErrInvalidField, u.Symbol, u.Quantity, m.SensorsId, quantity)
+	}
+	canonical, _ := units.Canonical(u.Quantity)
+	if u.Symbol != canonical.Symbol {
+		m.Value = u.ToCanonical(m.Value)
+	}
+	m.Unit = canonical.Symbol
+	return nil
+}
+
+// correctedReading applies a correction of sensors_id, value or unit to m and converts it into the canonical unit.
+// A unit without a value means the stored value was read in that unit.
+func correctedReading(tx *sql.Tx, m Measurement, reading map[string]any) (*Measurement, error) {
+	if value, ok := reading["sensors_id"]; ok {
+		id, ok := value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%w: sensors_id must be a number", ErrInvalidField)
+		}
+		m.SensorsId = int64(id)
+	}
+	if value, ok := reading["value"]; ok {
+		if m.Value, ok = value.(float64); !ok {
+			return nil, fmt.Errorf("%w: value must be a number", ErrInvalidField)
+		}
+	}
+	if value, ok := reading["unit"]; ok {
+		if m.Unit, ok = value.(string); !ok {
+			return nil, fmt.Errorf("%w: unit must be a string", ErrInvalidField)
+		}
+	}
+	if err := toCanonicalUnit(tx, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+const sensorColumns = `id, COALESCE(experiment_id, 0), COALESCE(sensor_type, ''), quantity, expected_interval_seconds`
+
+func scanSensor(row rowScanner) (Sensor, error) {
+	var s Sensor
+	var intervalSeconds int64
+	err := row.Scan(&s.ID, &s.ExperimentID, &s.SensorType, &s.Quantity, &intervalSeconds)
+	s.ExpectedInterval = Duration(time.Duration(intervalSeconds) * time.Second)
+	return s, err
+}
+
+func (d *Database) GetSensor(id int64) (*Sensor, error) {
+	s, err := scanSensor(d.readConn.QueryRow(`SELECT `+sensorColumns+` FROM sensors WHERE id = ?;`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: sensor %v", ErrRecordNotFound, id)
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting sensor %v: %w", id, err)
+	}
+	return &s, nil
+}
+
+// SetSensorQuantity fixes what a sensor measures, it fails if the sensor has measurements of another quantity
+func (d *Database) SetSensorQuantity(id int64, quantity string, actor Actor) (*Sensor, error) {
+	canonical, ok := units.Canonical(quantity)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown quantity %q, valid are %v", ErrInvalidField, quantity, units.Quantities())
+	}
+	var after *Sensor
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		before, err := scanSensor(tx.QueryRow(`SELECT `+sensorColumns+` FROM sensors WHERE id = ?;`, id))
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: sensor %v", ErrRecordNotFound, id)
+		} else if err != nil {
+			return fmt.Errorf("error getting sensor %v: %w", id, err)
+		}
+		if err := checkWritable(tx, id); err != nil {
+			return err
+		}
+		var other string
+		err = tx.QueryRow(`SELECT unit FROM measurements WHERE sensors_id = ? AND unit != '' AND unit != ? LIMIT 1;`,
+			id, canonical.Symbol).Scan(&other)
+		if err == nil {
+			return fmt.Errorf("%w: sensor %v has measurements in %s", ErrInvalidField, id, other)
+		} else if err != sql.ErrNoRows {
+			return fmt.Errorf("error checking units of sensor %v: %w", id, err)
+		}
+		if _, err := tx.Exec(`UPDATE sensors SET quantity = ? WHERE id = ?;`, quantity, id); err != nil {
+			return fmt.Errorf("error setting quantity of sensor %v: %w", id, err)
+		}
+		after = &before
+		after.Quantity = quantity
+		return writeAudit(tx, actor, AuditUpdate, "sensor", id, before, after)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return after, nil
+}
+
+// sensor types whose quantity is known, used by the migration for sensors without measurements
+var sensorTypeQuantities = map[string]string{
+	"barometer":   units.Pressure,
+	"thermometer": units.Temperature,
+	"hygrometer":  units.Humidity,
+}
+
+// canonicalUnits is the migration to canonical storage: measurements in a known unit are converted (as a new
+// revision), downsamples are converted and merged, the rollups rebuilt, and sensors whose measurements all
+// measure one quantity get it. Sensors with measurements of several quantities get the quantity of most of them,
+// sensors without measurements a quantity known from their type. Conflicts are logged.
+// Measurements in unknown units are kept as they are.
+func canonicalUnits(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "sensors", "quantity", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	type sensorUnit struct {
+		sensorID int64
+		unit     string
+		count    int64
+	}
+	scan := func(row rowScanner) (sensorUnit, error) {
+		var su sensorUnit
+		err := row.Scan(&su.sensorID, &su.unit, &su.count)
+		return su, err
+	}
+	//measurements per quantity of each sensor
+	quantities := make(map[int64]map[string]int64)
+	converted := make(map[string]bool)
+	for su, err := range queryRows(tx, scan, `SELECT sensors_id, unit, COUNT(*) FROM measurements WHERE unit != ''
+	GROUP BY sensors_id, unit;`) {
+		if err != nil {
+			return fmt.Errorf("error reading units of measurements: %w", err)
+		}
+		u, ok := units.Lookup(su.unit)
+		if !ok {
+			log.Printf("migrating: unit %q of sensor %v is unknown, its measurements are not converted", su.unit, su.sensorID)
+			continue
+		}
+		if quantities[su.sensorID] == nil {
+			quantities[su.sensorID] = make(map[string]int64)
+		}
+		quantities[su.sensorID][u.Quantity] += su.count
+		converted[su.unit] = true
+	}
+
+	createdAt := nowUTC()
+	for unit := range converted {
+		u, _ := units.Lookup(unit)
+		canonical, _ := units.Canonical(u.Quantity)
+		if unit == canonical.Symbol {
+			continue
+		}
+		log.Printf("migrating: converting measurements in %s to %s", unit, canonical.Symbol)
+		statements := []struct {
+			sql  string
+			args []any
+		}{
+			{`INSERT INTO measurement_revisions
+			(measurement_id, revision, sensors_id, value, unit, timestamp, reason, author, created_at)
+			SELECT id, revision + 1, sensors_id, value * ? + ?, ?, timestamp, 'unit conversion', 'system', ?
+			FROM measurements WHERE unit = ?;`, []any{u.Factor, u.Offset, canonical.Symbol, createdAt, unit}},
+			{`UPDATE measurements SET value = value * ? + ?, unit = ?, revision = revision + 1, version = version + 1
+			WHERE unit = ?;`, []any{u.Factor, u.Offset, canonical.Symbol, unit}},
+			//a bucket can exist in both units, SET reads the values from before the update
+			{`INSERT INTO measurement_downsamples (sensors_id, interval_seconds, bucket_start, unit, count, avg, min, max)
+			SELECT sensors_id, interval_seconds, bucket_start, ?, count, avg * ? + ?, min * ? + ?, max * ? + ?
+			FROM measurement_downsamples WHERE unit = ?
+			ON CONFLICT (sensors_id, interval_seconds, bucket_start, unit) DO UPDATE SET
+				count = count + excluded.count,
+				avg = (avg * count + excluded.avg * excluded.count) / (count + excluded.count),
+				min = MIN(min, excluded.min),
+				max = MAX(max, excluded.max);`,
+				[]any{canonical.Symbol, u.Factor, u.Offset, u.Factor, u.Offset, u.Factor, u.Offset, unit}},
+			{`DELETE FROM measurement_downsamples WHERE unit = ?;`, []any{unit}},
+		}
+		for _, stmt := range statements {
+			if _, err := tx.Exec(stmt.sql, stmt.args...); err != nil {
+				return fmt.Errorf("error converting %s to %s: %w", unit, canonical.Symbol, err)
+			}
+		}
+	}
+	if err := rebuildRollups(tx); err != nil {
+		return err
+	}
+
+	for sensorID, counts := range quantities {
+		var sensorType string
+		if err := tx.QueryRow(`SELECT COALESCE(sensor_type, '') FROM sensors WHERE id = ?;`, sensorID).Scan(&sensorType); err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error getting type of sensor %v: %w", sensorID, err)
+		}
+		typeQuantity := sensorTypeQuantities[strings.ToLower(sensorType)]
+		quantity := majorityQuantity(counts, typeQuantity)
+		if quantity == "" {
+			log.Printf("migrating: sensor %v (%s) has as many measurements of each of %v, its quantity is left empty",
+				sensorID, sensorType, counts)
+			continue
+		}
+		if len(counts) > 1 || (typeQuantity != "" && quantity != typeQuantity) {
+			log.Printf("migrating: sensor %v (%s) has measurements of %v, its quantity is set to %s, the others are kept but new ones are rejected",
+				sensorID, sensorType, counts, quantity)
+		}
+		if _, err := tx.Exec(`UPDATE sensors SET quantity = ? WHERE id = ? AND quantity = '';`, quantity, sensorID); err != nil {
+			return fmt.Errorf("error setting quantity of sensor %v: %w", sensorID, err)
+		}
+	}
+	for sensorType, quantity := range sensorTypeQuantities {
+		_, err := tx.Exec(`UPDATE sensors SET quantity = ? WHERE lower(sensor_type) = ? AND quantity = ''
+		AND NOT EXISTS (SELECT 1 FROM measurements WHERE sensors_id = sensors.id AND unit != '');`, quantity, sensorType)
+		if err != nil {
+			return fmt.Errorf("error setting quantity of %s sensors: %w", sensorType, err)
+		}
+	}
+	return nil
+}
+
+// majorityQuantity is the quantity of most of the measurements of a sensor. A tie goes to the quantity known
+// from the sensor type, without one the quantity is left empty.
+func majorityQuantity(counts map[string]int64, typeQuantity string) string {
+	quantity, most, tie := "", int64(0), false
+	for q, count := range counts {
+		switch {
+		case count > most:
+			quantity, most, tie = q, count, false
+		case count == most:
+			tie = true
+		}
+	}
+	if !tie {
+		return quantity
+	}
+	if typeQuantity != "" && counts[typeQuantity] == most {
+		return typeQuantity
+	}
+	return ""
+}
@@ -0,0 +1,20 @@
+package database
+
+import "testing"
+
+func TestCanonicalValueKeepsPrecision(t *testing.T) {
+	db := openTestDB(t)
+	for _, unit := range []string{"hPa", ""} {
+		m := &Measurement{SensorsId: 1, Value: 1013.1234567890123, Unit: unit}
+		if _, err := db.InsertMeasurement(m, Actor{Name: "test"}); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := db.GetMeasurementById(int(m.ID), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Value != 1013.1234567890123 {
+			t.Errorf("value posted in %q stored as %v, want 1013.1234567890123", unit, stored.Value)
+		}
+	}
+}
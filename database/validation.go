@@ -0,0 +1,227 @@
+// validation rules of sensor types, checked on every write of a measurement
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"measurements-api-stdlib-docker/units"
+	"slices"
+	"strings"
+)
+
+// what happens to a measurement that breaks a rule
+const (
+	ValidationReject = "reject" // the write fails with ErrInvalidField
+	ValidationFlag   = "flag"   // it is stored with quality suspect
+)
+
+// ValidationRule applies to all sensors of a type, a type can have several rules with different actions.
+// Min, Max and MaxStep are in the canonical unit of the quantity of the sensor (see package units),
+// MaxStep limits the change to the previous reading of the sensor.
+type ValidationRule struct {
+	ID               int64    `json:"id"`
+	SensorType       string   `json:"sensor_type"`
+	AllowedUnits     []string `json:"allowed_units,omitempty"`
+	Min              *float64 `json:"min,omitempty"`
+	Max              *float64 `json:"max,omitempty"`
+	MaxStep          *float64 `json:"max_step,omitempty"`
+	RequireUnit      bool     `json:"require_unit"`
+	RequireTimestamp bool     `json:"require_timestamp"`
+	Action           string   `json:"action"`
+	CreatedAt        string   `json:"created_at"`
+}
+
+func (r *ValidationRule) validate() error {
+	if r.SensorType == "" {
+		return fmt.Errorf("%w: a rule needs a sensor_type", ErrInvalidField)
+	}
+	switch r.Action {
+	case ValidationReject, ValidationFlag:
+	default:
+		return fmt.Errorf("%w: action must be %s or %s", ErrInvalidField, ValidationReject, ValidationFlag)
+	}
+	for i, symbol := range r.AllowedUnits {
+		u, ok := units.Lookup(symbol)
+		if !ok {
+			return fmt.Errorf("%w: unknown unit %q, see GET /units", ErrInvalidField, symbol)
+		}
+		r.AllowedUnits[i] = u.Symbol
+	}
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+		return fmt.Errorf("%w: min must not be above max", ErrInvalidField)
+	}
+	if r.MaxStep != nil && *r.MaxStep < 0 {
+		return fmt.Errorf("%w: max_step must not be negative", ErrInvalidField)
+	}
+	if len(r.AllowedUnits) == 0 && r.Min == nil && r.Max == nil && r.MaxStep == nil && !r.RequireUnit && !r.RequireTimestamp {
+		return fmt.Errorf("%w: the rule checks nothing", ErrInvalidField)
+	}
+	return nil
+}
+
+// sentFields is what the client sent: the unit before the conversion (nil for a correction that
+// keeps the unit) and whether the timestamp was given
+type sentFields struct {
+	unit      *string
+	timestamp bool
+}
+
+// violations returns what m breaks, previous is the reading of the sensor before m (nil if there is none)
+func (r *ValidationRule) violations(m *Measurement, sent sentFields, previous *Measurement) []string {
+	var broken []string
+	if sent.unit != nil {
+		if r.RequireUnit && *sent.unit == "" {
+			broken = append(broken, "unit is required")
+		}
+		if u, ok := units.Lookup(*sent.unit); len(r.AllowedUnits) > 0 && *sent.unit != "" && (!ok || !slices.Contains(r.AllowedUnits, u.Symbol)) {
+			broken = append(broken, fmt.Sprintf("unit %s is not one of %v", *sent.unit, r.AllowedUnits))
+		}
+	}
+	if r.RequireTimestamp && !sent.timestamp {
+		broken = append(broken, "timestamp is required")
+	}
+	if r.Min != nil && m.Value < *r.Min {
+		broken = append(broken, fmt.Sprintf("value %v is below the minimum %v", m.Value, *r.Min))
+	}
+	if r.Max != nil && m.Value > *r.Max {
+		broken = append(broken, fmt.Sprintf("value %v is above the maximum %v", m.Value, *r.Max))
+	}
+	if r.MaxStep != nil && previous != nil && math.Abs(m.Value-previous.Value) > *r.MaxStep {
+		broken = append(broken, fmt.Sprintf("step of %v from the previous reading is above %v", math.Abs(m.Value-previous.Value), *r.MaxStep))
+	}
+	return broken
+}
+
+// validateMeasurement checks m (already in the canonical unit) against the rules of its sensor type.
+// A broken reject rule fails with ErrInvalidField, a broken flag rule marks a good or corrected m as suspect,
+// other qualities (bad, interpolated) are kept. Without a quality m is good. Values that are not finite are always rejected.
+func validateMeasurement(tx *sql.Tx, m *Measurement, sent sentFields) error {
+	if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+		return fmt.Errorf("%w: value must be a finite number", ErrInvalidField)
+	}
+	if m.Quality == "" {
+		m.Quality, m.QualityReason = QualityGood, ""
+	} else if err := checkQuality(m.Quality); err != nil {
+		return err
+	}
+
+	rules, err := getValidationRules(tx, ` WHERE sensor_type = (SELECT sensor_type FROM sensors WHERE id = ?)`, m.SensorsId)
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+	var previous *Measurement
+	for _, rule := range rules {
+		if rule.MaxStep != nil {
+			if previous, err = previousMeasurement(tx, m.SensorsId, m.Timestamp, m.ID); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	var rejected, flagged []string
+	for _, rule := range rules {
+		broken := rule.violations(m, sent, previous)
+		if rule.Action == ValidationReject {
+			rejected = append(rejected, broken...)
+		} else {
+			flagged = append(flagged, broken...)
+		}
+	}
+	if len(rejected) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidField, strings.Join(rejected, ", "))
+	}
+	if len(flagged) > 0 && (m.Quality == QualityGood || m.Quality == QualityCorrected) {
+		m.Quality, m.QualityReason = QualitySuspect, strings.Join(flagged, ", ")
+	}
+	return nil
+}
+
+func (d *Database) CreateValidationRule(rule *ValidationRule, actor Actor) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	return d.WithTransaction(func(tx *sql.Tx) error {
+		return insertValidationRule(tx, rule, actor)
+	})
+}
+
+// insertValidationRule stores a validated rule
+func insertValidationRule(tx *sql.Tx, rule *ValidationRule, actor Actor) error {
+	var allowedUnits []byte
+	if len(rule.AllowedUnits) > 0 {
+		var err error
+		if allowedUnits, err = json.Marshal(rule.AllowedUnits); err != nil {
+			return fmt.Errorf("error marshalling allowed units: %w", err)
+		}
+	}
+	rule.CreatedAt = nowUTC()
+	res, err := tx.Exec(`INSERT INTO validation_rules
+	(sensor_type, allowed_units, min, max, max_step, require_unit, require_timestamp, action, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`, rule.SensorType, string(allowedUnits), rule.Min, rule.Max, rule.MaxStep,
+		rule.RequireUnit, rule.RequireTimestamp, rule.Action, rule.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error inserting validation rule: %w", err)
+	}
+	if rule.ID, err = res.LastInsertId(); err != nil {
+		return fmt.Errorf("error retrieving last insert ID: %w", err)
+	}
+	return writeAudit(tx, actor, AuditInsert, "validation_rule", rule.ID, nil, rule)
+}
+
+// DeleteValidationRule removes the rule, measurements it flagged keep their quality
+func (d *Database) DeleteValidationRule(id int64, actor Actor) error {
+	return d.WithTransaction(func(tx *sql.Tx) error {
+		rules, err := getValidationRules(tx, ` WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		if len(rules) == 0 {
+			return fmt.Errorf("%w: validation rule %v", ErrRecordNotFound, id)
+		}
+		if _, err := tx.Exec(`DELETE FROM validation_rules WHERE id = ?;`, id); err != nil {
+			return fmt.Errorf("error deleting validation rule %v: %w", id, err)
+		}
+		return writeAudit(tx, actor, AuditDelete, "validation_rule", id, rules[0], nil)
+	})
+}
+
+// GetValidationRules returns the rules of the sensor type, all rules if it is empty
+func (d *Database) GetValidationRules(sensorType string) ([]ValidationRule, error) {
+	if sensorType != "" {
+		return getValidationRules(d.readConn, ` WHERE sensor_type = ?`, sensorType)
+	}
+	return getValidationRules(d.readConn, "")
+}
+
+func getValidationRules(q querier, where string, args ...any) ([]ValidationRule, error) {
+	rows, err := q.Query(`SELECT id, sensor_type, allowed_units, min, max, max_step, require_unit, require_timestamp,
+	action, created_at
+	FROM validation_rules`+where+` ORDER BY id;`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying validation rules: %w", err)
+	}
+	defer rows.Close()
+
+	rules := []ValidationRule{}
+	for rows.Next() {
+		var r ValidationRule
+		var allowedUnits string
+		if err := rows.Scan(&r.ID, &r.SensorType, &allowedUnits, &r.Min, &r.Max, &r.MaxStep, &r.RequireUnit,
+			&r.RequireTimestamp, &r.Action, &r.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning validation rule: %w", err)
+		}
+		if allowedUnits != "" {
+			if err := json.Unmarshal([]byte(allowedUnits), &r.AllowedUnits); err != nil {
+				return nil, fmt.Errorf("error reading allowed units of validation rule %v: %w", r.ID, err)
+			}
+		}
+		rules = append(rules, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over validation rules: %w", err)
+	}
+	return rules, nil
+}
@@ -0,0 +1,368 @@
+// webhook subscriptions and their deliveries, pending deliveries are retried from here after a restart
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// event types a webhook can subscribe to, test events are only sent on request
+const (
+	EventMeasurementCreated = "measurement.created"
+	EventAlertFiring        = "alert.firing"
+	EventAlertResolved      = "alert.resolved"
+	EventExperimentState    = "experiment.state_changed"
+	EventTest               = "test"
+)
+
+var webhookEvents = []string{EventMeasurementCreated, EventAlertFiring, EventAlertResolved, EventExperimentState}
+
+// states of a delivery, a pending delivery is retried until it is delivered or failed too often
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook payloads are signed with Secret, it is only shown when the webhook is created
+type Webhook struct {
+	ID        int64    `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt string   `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID            int64           `json:"id"`
+	WebhookID     int64           `json:"webhook_id"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt Timestamp       `json:"next_attempt_at"`
+	ResponseCode  int             `json:"response_code"` // of the last attempt, 0 if there was no response
+	LastError     string          `json:"last_error"`
+	CreatedAt     string          `json:"created_at"`
+	DeliveredAt   *string         `json:"delivered_at,omitempty"`
+}
+
+// DueDelivery is a delivery with the address and the secret of its webhook
+type DueDelivery struct {
+	WebhookDelivery
+	URL    string
+	Secret string
+}
+
+func (w *Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http or https url", ErrInvalidField)
+	}
+	if len(w.Events) == 0 {
+		return fmt.Errorf("%w: a webhook needs at least one event type", ErrInvalidField)
+	}
+	for _, event := range w.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return fmt.Errorf("%w: unknown event type %q, valid are %v", ErrInvalidField, event, webhookEvents)
+		}
+	}
+	if len(w.Secret) < 16 {
+		return fmt.Errorf("%w: the secret must have at least 16 characters", ErrInvalidField)
+	}
+	return nil
+}
+
+func (d *Database) CreateWebhook(w *Webhook, actor Actor) error {
+	if err := w.validate(); err != nil {
+		return err
+	}
+	events, err := json.Marshal(w.Events)
+	if err != nil {
+		return fmt.Errorf("error marshalling event types: %w", err)
+	}
+	defer d.resetSubscriptions()
+	return d.WithTransaction(func(tx *sql.Tx) error {
+		w.CreatedAt = nowUTC()
+		res, err := tx.Exec(`INSERT INTO webhooks (url, events, secret, created_at) VALUES (?, ?, ?, ?);`,
+			w.URL, string(events), w.Secret, w.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("error inserting webhook: %w", err)
+		}
+		if w.ID, err = res.LastInsertId(); err != nil {
+			return fmt.Errorf("error retrieving last insert ID: %w", err)
+		}
+		//the secret stays out of the audit log
+		logged := *w
+		logged.Secret = ""
+		return writeAudit(tx, actor, AuditInsert, "webhook", w.ID, nil, logged)
+	})
+}
+
+// DeleteWebhook removes the webhook with its delivery log
+func (d *Database) DeleteWebhook(id int64, actor Actor) error {
+	defer d.resetSubscriptions()
+	return d.WithTransaction(func(tx *sql.Tx) error {
+		webhooks, err := getWebhooks(tx, ` WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		if len(webhooks) == 0 {
+			return fmt.Errorf("%w: webhook %v", ErrRecordNotFound, id)
+		}
+		if _, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id = ?;`, id); err != nil {
+			return fmt.Errorf("error deleting deliveries of webhook %v: %w", id, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM webhooks WHERE id = ?;`, id); err != nil {
+			return fmt.Errorf("error deleting webhook %v: %w", id, err)
+		}
+		return writeAudit(tx, actor, AuditDelete, "webhook", id, webhooks[0], nil)
+	})
+}
+
+// GetWebhooks returns all webhooks without their secrets
+func (d *Database) GetWebhooks() ([]Webhook, error) {
+	return getWebhooks(d.readConn, "")
+}
+
+func (d *Database) GetWebhook(id int64) (*Webhook, error) {
+	webhooks, err := getWebhooks(d.readConn, ` WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(webhooks) == 0 {
+		return nil, fmt.Errorf("%w: webhook %v", ErrRecordNotFound, id)
+	}
+	return &webhooks[0], nil
+}
+
+func getWebhooks(q querier, where string, args ...any) ([]Webhook, error) {
+	rows, err := q.Query(`SELECT id, url, events, created_at FROM webhooks`+where+` ORDER BY id;`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var w Webhook
+		var events string
+		if err := rows.Scan(&w.ID, &w.URL, &events, &w.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning webhook: %w", err)
+		}
+		if err := json.Unmarshal([]byte(events), &w.Events); err != nil {
+			return nil, fmt.Errorf("error reading event types of webhook %v: %w", w.ID, err)
+		}
+		webhooks = append(webhooks, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over webhooks: %w", err)
+	}
+	return webhooks, nil
+}
+
+// Subscribed reports whether any webhook subscribes to event. The subscriptions are read once and cached
+// until a webhook is created or deleted, so the insert path does not query them every time.
+func (d *Database) Subscribed(event string) (bool, error) {
+	return d.subscribed(d.readConn, event)
+}
+
+func (d *Database) subscribed(q querier, event string) (bool, error) {
+	d.subscriptionsMu.Lock()
+	defer d.subscriptionsMu.Unlock()
+	if d.subscriptions == nil {
+		webhooks, err := getWebhooks(q, "")
+		if err != nil {
+			return false, err
+		}
+		d.subscriptions = make(map[string]bool)
+		for _, w := range webhooks {
+			for _, e := range w.Events {
+				d.subscriptions[e] = true
+			}
+		}
+	}
+	return d.subscriptions[event], nil
+}
+
+// resetSubscriptions is called after the webhooks changed, a read that is still running finishes before
+func (d *Database) resetSubscriptions() {
+	d.subscriptionsMu.Lock()
+	defer d.subscriptionsMu.Unlock()
+	d.subscriptions = nil
+}
+
+// QueueEvent queues the event for the subscribed webhooks in the transaction tx of the change it is about,
+// payload is only called if a webhook subscribes to it
+func (d *Database) QueueEvent(tx *sql.Tx, event string, payload func() ([]byte, error)) error {
+	subscribed, err := d.subscribed(tx, event)
+	if err != nil || !subscribed {
+		return err
+	}
+	body, err := payload()
+	if err != nil {
+		return err
+	}
+	_, err = queueDeliveries(tx, WebhookEvent{Event: event, Payload: body})
+	return err
+}
+
+// WebhookEvent is an event with its serialized payload
+type WebhookEvent struct {
+	Event   string
+	Payload []byte
+}
+
+// CreateDeliveries queues one delivery of every event for each webhook subscribed to it
+// and returns the number of deliveries
+func (d *Database) CreateDeliveries(events []WebhookEvent) (int64, error) {
+	var created int64
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		var err error
+		created, err = queueDeliveries(tx, events...)
+		return err
+	})
+	return created, err
+}
+
+func queueDeliveries(tx *sql.Tx, events ...WebhookEvent) (int64, error) {
+	var created int64
+	for _, e := range events {
+		res, err := tx.Exec(`INSERT INTO webhook_deliveries
+		(webhook_id, event, payload, status, attempts, next_attempt_at, created_at)
+		SELECT webhooks.id, ?, ?, ?, 0, ?, ?
+		FROM webhooks, json_each(webhooks.events) WHERE json_each.value = ?;`,
+			e.Event, string(e.Payload), DeliveryPending, NewTimestamp(time.Now()), nowUTC(), e.Event)
+		if err != nil {
+			return 0, fmt.Errorf("error queueing deliveries of %s: %w", e.Event, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("error retrieving rows affected: %w", err)
+		}
+		created += n
+	}
+	return created, nil
+}
+
+// CreateDelivery queues the event for one webhook, regardless of its subscriptions (test events).
+// It is not due before notBefore.
+func (d *Database) CreateDelivery(webhookID int64, event string, payload []byte, notBefore time.Time) (int64, error) {
+	var id int64
+	err := d.WithTransaction(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`INSERT INTO webhook_deliveries
+		(webhook_id, event, payload, status, attempts, next_attempt_at, created_at)
+		VALUES (?, ?, ?, ?, 0, ?, ?);`, webhookID, event, string(payload), DeliveryPending, NewTimestamp(notBefore), nowUTC())
+		if err != nil {
+			return fmt.Errorf("error queueing delivery of %s to webhook %v: %w", event, webhookID, err)
+		}
+		id, err = res.LastInsertId()
+		return err
+	})
+	return id, err
+}
+
+const deliveryColumns = `webhook_deliveries.id, webhook_deliveries.webhook_id, webhook_deliveries.event,
+	webhook_deliveries.payload, webhook_deliveries.status, webhook_deliveries.attempts,
+	webhook_deliveries.next_attempt_at, webhook_deliveries.response_code, webhook_deliveries.last_error,
+	webhook_deliveries.created_at, webhook_deliveries.delivered_at`
+
+func scanDelivery(row rowScanner, extra ...any) (WebhookDelivery, error) {
+	var w WebhookDelivery
+	var payload string
+	var lastError sql.NullString
+	var responseCode sql.NullInt64
+	dest := []any{&w.ID, &w.WebhookID, &w.Event, &payload, &w.Status, &w.Attempts,
+		&w.NextAttemptAt, &responseCode, &lastError, &w.CreatedAt, &w.DeliveredAt}
+	err := row.Scan(append(dest, extra...)...)
+	w.Payload, w.LastError, w.ResponseCode = json.RawMessage(payload), lastError.String, int(responseCode.Int64)
+	return w, err
+}
+
+// DueDeliveries returns up to limit pending deliveries whose next attempt is due, oldest first
+func (d *Database) DueDeliveries(now time.Time, limit int) ([]DueDelivery, error) {
+	return d.dueDeliveries(` AND webhook_deliveries.next_attempt_at <= ? ORDER BY webhook_deliveries.next_attempt_at LIMIT ?`,
+		NewTimestamp(now), limit)
+}
+
+// GetDueDelivery returns the delivery for an attempt right now, even if its next attempt is later
+func (d *Database) GetDueDelivery(id int64) (*DueDelivery, error) {
+	due, err := d.dueDeliveries(` AND webhook_deliveries.id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(due) == 0 {
+		return nil, fmt.Errorf("%w: pending delivery %v", ErrRecordNotFound, id)
+	}
+	return &due[0], nil
+}
+
+func (d *Database) dueDeliveries(where string, args ...any) ([]DueDelivery, error) {
+	queryDB := `SELECT ` + deliveryColumns + `, webhooks.url, webhooks.secret
+	FROM webhook_deliveries
+	INNER JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id
+	WHERE webhook_deliveries.status = '` + DeliveryPending + `'` + where + `;`
+	scan := func(row rowScanner) (DueDelivery, error) {
+		var due DueDelivery
+		var err error
+		due.WebhookDelivery, err = scanDelivery(row, &due.URL, &due.Secret)
+		return due, err
+	}
+	due := []DueDelivery{}
+	for delivery, err := range queryRows(d.readConn, scan, queryDB, args...) {
+		if err != nil {
+			return nil, fmt.Errorf("error querying due deliveries: %w", err)
+		}
+		due = append(due, delivery)
+	}
+	return due, nil
+}
+
+// SaveDeliveryAttempt stores the outcome of an attempt: status, attempts, next attempt and the response
+func (d *Database) SaveDeliveryAttempt(w *WebhookDelivery) error {
+	return d.WithTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE webhook_deliveries
+		SET status = ?, attempts = ?, next_attempt_at = ?, response_code = ?, last_error = ?, delivered_at = ?
+		WHERE id = ?;`, w.Status, w.Attempts, w.NextAttemptAt, w.ResponseCode, w.LastError, w.DeliveredAt, w.ID)
+		if err != nil {
+			return fmt.Errorf("error saving attempt of delivery %v: %w", w.ID, err)
+		}
+		return nil
+	})
+}
+
+func (d *Database) GetWebhookDelivery(id int64) (*WebhookDelivery, error) {
+	w, err := scanDelivery(d.readConn.QueryRow(`SELECT `+deliveryColumns+` FROM webhook_deliveries WHERE id = ?;`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: delivery %v", ErrRecordNotFound, id)
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting delivery %v: %w", id, err)
+	}
+	return &w, nil
+}
+
+// GetWebhookDeliveries is the delivery log of a webhook, newest first, only deliveries in status if it is not empty
+func (d *Database) GetWebhookDeliveries(webhookID int64, status string, limit, offset int) ([]WebhookDelivery, error) {
+	queryDB := `SELECT ` + deliveryColumns + ` FROM webhook_deliveries WHERE webhook_id = ?`
+	params := []any{webhookID}
+	if status != "" {
+		queryDB += ` AND status = ?`
+		params = append(params, status)
+	}
+	queryDB += ` ORDER BY id DESC LIMIT ? OFFSET ?;`
+	params = append(params, limit, offset)
+
+	deliveries := make([]WebhookDelivery, 0, limit)
+	scan := func(row rowScanner) (WebhookDelivery, error) { return scanDelivery(row) }
+	for delivery, err := range queryRows(d.readConn, scan, queryDB, params...) {
+		if err != nil {
+			return nil, fmt.Errorf("error querying deliveries of webhook %v: %w", webhookID, err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
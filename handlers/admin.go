@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"measurements-api-stdlib-docker/ratelimit"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *Handler) isAdmin(c *gin.Context) bool {
+	if h.cfg.AdminAPIKey == "" {
+		return false
+	}
+	apiKey := c.GetHeader("X-API-Key")
+	return subtle.ConstantTimeCompare([]byte(apiKey), []byte(h.cfg.AdminAPIKey)) == 1
+}
+
+// Authenticate marks requests with the admin API key as authenticated, so the rate limiters key them by
+// API key. It must run before the limiters.
+func (h *Handler) Authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if h.isAdmin(c) {
+			ratelimit.SetAuthenticated(c)
+		}
+		c.Next()
+	}
+}
+
+// RequireAdmin protects routes that only the holder of the admin API key may use
+func (h *Handler) RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !h.isAdmin(c) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin api key required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// includeDeleted reads ?include_deleted=true, which is only allowed for admins.
+// On false the response was already written.
+func (h *Handler) includeDeleted(c *gin.Context) (bool, bool) {
+	if c.Query("include_deleted") != "true" {
+		return false, true
+	}
+	if !h.isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "include_deleted requires the admin api key"})
+		return false, false
+	}
+	return true, true
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/util"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleSensorAggregate returns per bucket statistics in [since, until), answered from the rollups when possible
+func (h *Handler) HandleSensorAggregate(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	bucket := time.Hour
+	if value := c.Query("bucket"); value != "" {
+		if bucket, err = time.ParseDuration(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid bucket (%s)", err)})
+			return
+		}
+	}
+	since, until, err := timeRange(c, 24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	unit, ok := requestedUnit(c)
+	if !ok {
+		return
+	}
+	qualities, ok := requestedQualities(c)
+	if !ok {
+		return
+	}
+	result, err := h.db.AggregateSensor(int64(id), bucket, since, until, qualities)
+	if errors.Is(err, database.ErrInvalidField) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range result.Buckets {
+		unit.aggregate(&result.Buckets[i])
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// timeRange reads since and until, by default the range ends at the start of the next day and spans fallback
+func timeRange(c *gin.Context, fallback time.Duration) (time.Time, time.Time, error) {
+	until := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	if value, err := util.GetQueryTime(c, "until"); err != nil {
+		return time.Time{}, time.Time{}, err
+	} else if value != "" {
+		until, _ = time.Parse(time.DateTime, value)
+	}
+	since := until.Add(-fallback)
+	if value, err := util.GetQueryTime(c, "since"); err != nil {
+		return time.Time{}, time.Time{}, err
+	} else if value != "" {
+		since, _ = time.Parse(time.DateTime, value)
+	}
+	if !since.Before(until) {
+		return time.Time{}, time.Time{}, fmt.Errorf("since must be before until")
+	}
+	return since, until, nil
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/util"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleAlerts lists the current alert of every rule and sensor, ?state= filters (pending, firing, resolved)
+func (h *Handler) HandleAlerts(c *gin.Context) {
+	state := c.Query("state")
+	switch state {
+	case "", database.AlertPending, database.AlertFiring, database.AlertResolved:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "state must be pending, firing or resolved"})
+		return
+	}
+	states, err := h.db.GetAlertStates(state)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, states)
+}
+
+// HandleAlertHistory lists the state changes newest first, by ?rule_id= and ?sensor_id=
+func (h *Handler) HandleAlertHistory(c *gin.Context) {
+	var filter database.AlertEventFilter
+	ruleID, err := util.GetQueryInt(c, "rule_id", 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sensorID, err := util.GetQueryInt(c, "sensor_id", 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.RuleID, filter.SensorID = int64(ruleID), int64(sensorID)
+	if filter.Limit, err = util.GetQueryInt(c, "limit", defaultPageSize); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.Limit = min(max(filter.Limit, 1), maxPageSize)
+	if filter.Offset, err = util.GetQueryInt(c, "offset", 0); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	events, err := h.db.GetAlertEvents(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"events": events,
+		"limit":  filter.Limit,
+		"offset": filter.Offset,
+	})
+}
+
+func (h *Handler) HandleAlertRulesGet(c *gin.Context) {
+	rules, err := h.db.GetAlertRules()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+func (h *Handler) HandleAlertRulePost(c *gin.Context) {
+	rule := &database.AlertRule{}
+	if err := c.ShouldBindJSON(rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON Data: %s", err)})
+		return
+	}
+	if err := h.db.CreateAlertRule(rule, actor(c)); err != nil {
+		if errors.Is(err, database.ErrInvalidField) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, rule)
+}
+
+func (h *Handler) HandleAlertRuleDelete(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.db.DeleteAlertRule(int64(id), actor(c)); err != nil {
+		if errors.Is(err, database.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("succesfully deleted alert rule %v", id)})
+}
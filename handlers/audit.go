@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/util"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+func (h *Handler) HandleAuditLog(c *gin.Context) {
+	filter := database.AuditFilter{
+		Actor:     c.Query("actor"),
+		Action:    c.Query("action"),
+		Entity:    c.Query("entity"),
+		RequestID: c.Query("request_id"),
+	}
+	entityID, err := util.GetQueryInt(c, "entity_id", 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.EntityID = int64(entityID)
+	if filter.Since, err = util.GetQueryTime(c, "since"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if filter.Until, err = util.GetQueryTime(c, "until"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if filter.Limit, err = util.GetQueryInt(c, "limit", defaultPageSize); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.Limit = min(max(filter.Limit, 1), maxPageSize)
+	if filter.Offset, err = util.GetQueryInt(c, "offset", 0); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	entries, total, err := h.db.GetAuditLog(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"entries": entries,
+		"total":   total,
+		"limit":   filter.Limit,
+		"offset":  filter.Offset,
+	})
+}
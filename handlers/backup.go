@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"measurements-api-stdlib-docker/util"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleBackupCreate takes a snapshot while the server keeps running, ?compress=false overrides BACKUP_COMPRESS
+func (h *Handler) HandleBackupCreate(c *gin.Context) {
+	if h.maintenance.Active() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "server is in maintenance mode"})
+		return
+	}
+	compress := h.cfg.Backup.Compress
+	if value := c.Query("compress"); value != "" {
+		compress = value == "true"
+	}
+	info, err := h.backups.Create(compress)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("backup %s created by %s", info.Name, actor(c).Name)
+	c.JSON(http.StatusCreated, info)
+}
+
+func (h *Handler) HandleBackupList(c *gin.Context) {
+	backups, err := h.backups.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, backups)
+}
+
+func (h *Handler) HandleBackupDelete(c *gin.Context) {
+	name := c.Param("name")
+	if err := h.backups.Delete(name); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("succesfully deleted backup %s", name)})
+}
+
+// HandleBackupPrune keeps the newest ?keep= backups (default BACKUP_KEEP)
+func (h *Handler) HandleBackupPrune(c *gin.Context) {
+	keep, err := util.GetQueryInt(c, "keep", h.cfg.Backup.Keep)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	pruned, err := h.backups.Prune(keep)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "pruned": pruned})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"pruned": pruned})
+}
+
+// HandleBackupRestore replaces the database with a backup, all other requests get 503 meanwhile
+func (h *Handler) HandleBackupRestore(c *gin.Context) {
+	name := c.Param("name")
+	err := h.maintenance.Run(func() error {
+		return h.backups.Restore(name)
+	})
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("database restored from backup %s by %s", name, actor(c).Name)
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("succesfully restored backup %s", name)})
+}
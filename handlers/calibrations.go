@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/util"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *Handler) HandleCalibrationsGet(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	calibrations, err := h.db.GetCalibrations(int64(id))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, calibrations)
+}
+
+// HandleCalibrationPost adds a calibration to the sensor,
+// {"coefficients": [0.2, 1.01], "valid_from": "2026-01-01 00:00:00", "certificate": "DAkkS 1234"}
+func (h *Handler) HandleCalibrationPost(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	calibration := &database.Calibration{}
+	if err := c.ShouldBindJSON(calibration); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON Data: %s", err)})
+		return
+	}
+	calibration.SensorID = int64(id)
+	err = h.db.CreateCalibration(calibration, actor(c))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrExperimentState) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrInvalidField) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, calibration)
+}
+
+func (h *Handler) HandleCalibrationDelete(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	calibrationID, err := util.GetParamInt(c, "calibration")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.db.DeleteCalibration(int64(id), int64(calibrationID), actor(c)); err != nil {
+		if errors.Is(err, database.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, database.ErrExperimentState) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("succesfully deleted calibration %v", calibrationID)})
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"measurements-api-stdlib-docker/database"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleCompare overlays experiments on the time since their start,
+// ?experiments=Exp1,Exp2&sensor_type=Thermometer&step=1m[&duration=2h]
+func (h *Handler) HandleCompare(c *gin.Context) {
+	query := database.ComparisonQuery{SensorType: c.Query("sensor_type"), Step: time.Minute}
+	for _, ref := range strings.Split(c.Query("experiments"), ",") {
+		if ref = strings.TrimSpace(ref); ref != "" {
+			query.Experiments = append(query.Experiments, ref)
+		}
+	}
+	var err error
+	if value := c.Query("step"); value != "" {
+		if query.Step, err = time.ParseDuration(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid step (%s)", err)})
+			return
+		}
+	}
+	if value := c.Query("duration"); value != "" {
+		if query.Duration, err = time.ParseDuration(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid duration (%s)", err)})
+			return
+		}
+	}
+	unit, ok := requestedUnit(c)
+	if !ok {
+		return
+	}
+	if query.Qualities, ok = requestedQualities(c); !ok {
+		return
+	}
+	result, err := h.db.CompareRuns(query)
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrInvalidField) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	unit.comparison(result)
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// parseETags splits an If-Match/If-None-Match header, weak tags are compared like strong ones
+func parseETags(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// notModified answers 304 if the client already has the current version (If-None-Match)
+func notModified(c *gin.Context, version int) bool {
+	current := etag(version)
+	for _, tag := range parseETags(c.GetHeader("If-None-Match")) {
+		if tag == "*" || tag == current {
+			c.Status(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// expectedVersion reads If-Match, 0 means any version. On false the response was already written.
+func (h *Handler) expectedVersion(c *gin.Context) (int, bool) {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		if h.cfg.RequireIfMatch {
+			c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header required"})
+			return 0, false
+		}
+		return 0, true
+	}
+	tags := parseETags(header)
+	if len(tags) == 1 && tags[0] == "*" {
+		//* matches any version, so it would defeat a required check
+		if h.cfg.RequireIfMatch {
+			c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match must contain the ETag of the current version, not *"})
+			return 0, false
+		}
+		return 0, true
+	}
+	if len(tags) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "If-Match must contain exactly one ETag"})
+		return 0, false
+	}
+	version, err := strconv.Atoi(strings.Trim(tags[0], `"`))
+	if err != nil || version < 1 {
+		// can never match a current version
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "ETag does not match"})
+		return 0, false
+	}
+	return version, true
+}
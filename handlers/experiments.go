@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"errors"
+	"measurements-api-stdlib-docker/database"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleExperimentsGet lists the experiments, ?state= filters by lifecycle state
+func (h *Handler) HandleExperimentsGet(c *gin.Context) {
+	experiments, err := h.db.GetExperiments(c.Query("state"))
+	if errors.Is(err, database.ErrInvalidField) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, experiments)
+}
+
+func (h *Handler) HandleExperimentGet(c *gin.Context) {
+	experiment, err := h.db.GetExperiment(c.Param("exp"), false)
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, experiment)
+}
+
+// HandleExperimentTransition returns the handler of a lifecycle action (start, pause, resume, complete, archive),
+// an action that is not allowed in the current state is answered with 409
+func (h *Handler) HandleExperimentTransition(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		experiment, err := h.db.TransitionExperiment(c.Param("exp"), action, actor(c))
+		if errors.Is(err, database.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, database.ErrExperimentState) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, experiment)
+	}
+}
@@ -1,10 +1,19 @@
 package handlers
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"measurements-api-stdlib-docker/backup"
+	"measurements-api-stdlib-docker/config"
 	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/ingest"
+	"measurements-api-stdlib-docker/live"
+	"measurements-api-stdlib-docker/maintenance"
+	"measurements-api-stdlib-docker/ratelimit"
 	"measurements-api-stdlib-docker/util"
+	"measurements-api-stdlib-docker/webhooks"
 	"net/http"
 	"time"
 
@@ -12,11 +21,28 @@ import (
 )
 
 type Handler struct {
-	db *database.Database
+	db          *database.Database
+	limits      *ratelimit.Limits
+	cfg         *config.Config
+	backups     *backup.Manager
+	maintenance *maintenance.Mode
+	queue       *ingest.Queue // nil if inserts are not group committed
+	live        *live.Broker
+	webhooks    *webhooks.Dispatcher
 }
 
-func NewHandler(db *database.Database) *Handler {
-	return &Handler{db: db}
+func NewHandler(db *database.Database, limits *ratelimit.Limits, cfg *config.Config, backups *backup.Manager, mode *maintenance.Mode, queue *ingest.Queue, broker *live.Broker, dispatcher *webhooks.Dispatcher) *Handler {
+	return &Handler{db: db, limits: limits, cfg: cfg, backups: backups, maintenance: mode, queue: queue, live: broker, webhooks: dispatcher}
+}
+
+// actor names the caller in the audit log. X-Actor can not be verified, so it is only taken from requests
+// with the API key, everyone else is recorded by the client key.
+func actor(c *gin.Context) database.Actor {
+	name := c.GetHeader("X-Actor")
+	if name == "" || !ratelimit.IsAuthenticated(c) {
+		name = ratelimit.ClientKey(c)
+	}
+	return database.Actor{Name: name, RequestID: util.GetRequestID(c)}
 }
 
 func (h *Handler) HandleMeasurementPost(c *gin.Context) {
@@ -26,16 +52,28 @@ func (h *Handler) HandleMeasurementPost(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON Data"})
 		return
 	}
-	//struct to database
-	if err := h.db.InsertMeasurement(newPoint); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database INSERT error"})
+	//struct to database, counted on the daily quota of the experiment the sensor belongs to
+	measurements := []database.Measurement{*newPoint}
+	results, err := h.ingest(c, measurements)
+	if err != nil {
+		writeInsertError(c, err)
 		return
 	}
-	fmt.Println(*newPoint)
-	location := fmt.Sprintf("/measurements/%d", newPoint.ID) //The ID is set to the actual ID in the database
+	*newPoint = measurements[0] //The ID is set to the actual ID in the database
+	result := results[0]
+	location := fmt.Sprintf("/measurements/%d", newPoint.ID)
 	c.Header("Location", location)
-	c.JSON(http.StatusCreated, gin.H{
-		"message":  "Point created",
+	c.Header("ETag", etag(newPoint.Version))
+
+	status, message := http.StatusCreated, "Point created"
+	switch result {
+	case database.InsertIgnored:
+		status, message = http.StatusOK, "Point already exists"
+	case database.InsertOverwritten:
+		status, message = http.StatusOK, "Point overwritten"
+	}
+	c.JSON(status, gin.H{
+		"message":  message,
 		"location": location,
 		"data":     *newPoint,
 	})
@@ -43,12 +81,28 @@ func (h *Handler) HandleMeasurementPost(c *gin.Context) {
 
 func (h *Handler) HandleMeasurementGetAll(c *gin.Context) {
 	//w.Header().Set("Content-Type", "application/json") //gin does the header when I do json stuff
-	measurements, err := h.db.GetAllMeasurements()
+	includeDeleted, ok := h.includeDeleted(c)
+	if !ok {
+		return
+	}
+	unit, ok := requestedUnit(c)
+	if !ok {
+		return
+	}
+	qualities, ok := requestedQualities(c)
+	if !ok {
+		return
+	}
+	asOf, err := util.GetQueryTime(c, "as_of")
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if asOf != "" {
+		streamJSON(c, inUnit(unit, h.db.StreamMeasurementsAsOf(asOf, qualities), unit.measurement))
 		return
 	}
-	c.JSON(http.StatusOK, measurements) //write json data back
+	streamJSON(c, inUnit(unit, h.db.StreamMeasurements(includeDeleted, qualities), unit.measurement))
 }
 
 func (h *Handler) HandleMeasurementGetById(c *gin.Context) {
@@ -57,11 +111,40 @@ func (h *Handler) HandleMeasurementGetById(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	point, err := h.db.GetMeasurementById(id)
+	includeDeleted, ok := h.includeDeleted(c)
+	if !ok {
+		return
+	}
+	unit, ok := requestedUnit(c)
+	if !ok {
+		return
+	}
+	asOf, err := util.GetQueryTime(c, "as_of")
 	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var point *database.Measurement
+	if asOf != "" {
+		point, err = h.db.GetMeasurementAsOf(id, asOf)
+	} else {
+		point, err = h.db.GetMeasurementById(id, includeDeleted)
+	}
+	if errors.Is(err, database.ErrRecordNotFound) || errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("measurement %v not found", id)})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if asOf == "" {
+		//historic versions are not cacheable by ETag
+		if notModified(c, point.Version) {
+			return
+		}
+		c.Header("ETag", etag(point.Version))
+	}
+	unit.measurement(point)
 	c.JSON(http.StatusOK, point)
 }
 
@@ -71,8 +154,21 @@ func (h *Handler) HandleMeasurementDelete(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	err = h.db.DeleteMeasurement(id)
-	if err != nil {
+	version, ok := h.expectedVersion(c)
+	if !ok {
+		return
+	}
+	err = h.db.DeleteMeasurement(id, version, actor(c))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrVersionConflict) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrExperimentState) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -86,17 +182,39 @@ func (h *Handler) HandleMeasurementUpdate(c *gin.Context) {
 		return
 	}
 
+	version, ok := h.expectedVersion(c)
+	if !ok {
+		return
+	}
+
 	var updateData map[string]any
 	if err := c.BindJSON(&updateData); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	//every correction needs a reason, it is kept with the new revision
+	reason, ok := updateData["reason"].(string)
+	if !ok || reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reason for the correction required"})
+		return
+	}
+	delete(updateData, "reason")
 
-	if err := h.db.UpdateMeasurement(id, updateData); err != nil {
-		if err.Error() == "record not found" {
+	updated, err := h.db.UpdateMeasurement(id, updateData, reason, version, actor(c))
+	if err != nil {
+		if errors.Is(err, database.ErrRecordNotFound) {
 			// Return 404 if record not found
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			return
+		} else if errors.Is(err, database.ErrVersionConflict) {
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, database.ErrExperimentState) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, database.ErrInvalidField) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		} else {
 			//Internal Server Error
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -104,36 +222,73 @@ func (h *Handler) HandleMeasurementUpdate(c *gin.Context) {
 		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Successfully updated measurement"})
+	c.Header("ETag", etag(updated.Version))
+	c.JSON(http.StatusOK, gin.H{"message": "Successfully updated measurement", "data": updated})
 }
 
 func (h *Handler) HandleGetMeasurementsByExperiment(c *gin.Context) {
-	expName := c.Param("exp")
-	if expName == "" {
+	ref := c.Param("exp")
+	if ref == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "empty parameter"})
 		return
 	}
 	startTime := c.Query("startTime")
 	endTime := c.Query("endTime")
-	fmt.Println(startTime)
-	fmt.Println(endTime)
-	measurements, err := h.db.GetMeasurementsByExperiment(expName, startTime, endTime)
-	if err != nil {
-		//we could check for different errors here
+	includeDeleted, ok := h.includeDeleted(c)
+	if !ok {
+		return
+	}
+	unit, ok := requestedUnit(c)
+	if !ok {
+		return
+	}
+	qualities, ok := requestedQualities(c)
+	if !ok {
+		return
+	}
+	measurements, err := h.db.StreamMeasurementsByExperiment(ref, startTime, endTime, includeDeleted, qualities)
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrInvalidField) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, measurements)
+	streamJSON(c, inUnit(unit, measurements, unit.response))
 }
 
+// HandleMeasurementMinMax returns the extremes of every unit, with ?unit= only those of its quantity, converted
 func (h *Handler) HandleMeasurementMinMax(c *gin.Context) {
-	start := time.Now()
-	Measurements, err := h.db.GetMeasurementMinMax()
-	log.Printf("Time to get MinMax: %s", time.Since(start))
+	unit, ok := requestedUnit(c)
+	if !ok {
+		return
+	}
+	qualities, ok := requestedQualities(c)
+	if !ok {
+		return
+	}
+	//only the time spent reading the rows, not the time the client takes to receive them
+	var elapsed time.Duration
+	streamJSON(c, inUnit(unit, timed(h.db.StreamMeasurementMinMax(unit.storedUnit(), qualities), &elapsed), unit.measurement))
+	log.Printf("Time to get MinMax: %s", elapsed)
+}
+
+func (h *Handler) HandleMeasurementRevisions(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
 	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	revisions, err := h.db.GetMeasurementRevisions(id)
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("measurement %v not found", id)})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	log.Printf("Number of MinMax: %v", len(Measurements))
-	c.JSON(http.StatusOK, Measurements)
+	c.JSON(http.StatusOK, revisions)
 }
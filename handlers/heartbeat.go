@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/util"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// silentIntervals reads ?intervals=, how many expected intervals without a reading make a gap or an offline sensor
+func silentIntervals(c *gin.Context) (float64, bool) {
+	value := c.Query("intervals")
+	if value == "" {
+		return database.DefaultSilentIntervals, true
+	}
+	intervals, err := strconv.ParseFloat(value, 64)
+	if err != nil || intervals < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid intervals %q, must be a number of at least 1", value)})
+		return 0, false
+	}
+	return intervals, true
+}
+
+// HandleSensorIntervalPut sets how often readings are expected, {"expected_interval": "1m"}, "0s" disables monitoring
+func (h *Handler) HandleSensorIntervalPut(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var body struct {
+		ExpectedInterval database.Duration `json:"expected_interval"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON Data: %s", err)})
+		return
+	}
+	sensor, err := h.db.SetSensorInterval(int64(id), body.ExpectedInterval, actor(c))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrExperimentState) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrInvalidField) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sensor)
+}
+
+// HandleSensorStatuses lists the online status of the sensors, ?experiment= limits it to one experiment
+func (h *Handler) HandleSensorStatuses(c *gin.Context) {
+	filter := database.SensorStatusFilter{}
+	var ok bool
+	if filter.Intervals, ok = silentIntervals(c); !ok {
+		return
+	}
+	if ref := c.Query("experiment"); ref != "" {
+		experiment, err := h.db.GetExperiment(ref, false)
+		if errors.Is(err, database.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		filter.ExperimentID = experiment.ID
+	}
+	statuses, err := h.db.GetSensorStatuses(filter, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, statuses)
+}
+
+func (h *Handler) HandleSensorStatus(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	intervals, ok := silentIntervals(c)
+	if !ok {
+		return
+	}
+	statuses, err := h.db.GetSensorStatuses(database.SensorStatusFilter{SensorID: int64(id), Intervals: intervals}, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(statuses) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("%s: sensor %v", database.ErrRecordNotFound, id)})
+		return
+	}
+	c.JSON(http.StatusOK, statuses[0])
+}
+
+// HandleSensorGaps lists the gaps of a sensor in [since, until), by default of the last day
+func (h *Handler) HandleSensorGaps(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	since, until, intervals, ok := gapQuery(c)
+	if !ok {
+		return
+	}
+	gaps, err := h.db.SensorGaps(int64(id), since, until, intervals)
+	respondGaps(c, gaps, err)
+}
+
+// HandleExperimentGaps lists the gaps of the sensors of :exp that have an expected interval
+func (h *Handler) HandleExperimentGaps(c *gin.Context) {
+	since, until, intervals, ok := gapQuery(c)
+	if !ok {
+		return
+	}
+	gaps, err := h.db.ExperimentGaps(c.Param("exp"), since, until, intervals)
+	respondGaps(c, gaps, err)
+}
+
+func gapQuery(c *gin.Context) (time.Time, time.Time, float64, bool) {
+	since, until, err := timeRange(c, 24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return time.Time{}, time.Time{}, 0, false
+	}
+	intervals, ok := silentIntervals(c)
+	return since, until, intervals, ok
+}
+
+func respondGaps(c *gin.Context, gaps []database.Gap, err error) {
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrInvalidField) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gaps)
+}
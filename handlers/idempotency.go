@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"measurements-api-stdlib-docker/ratelimit"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recordingWriter keeps a copy of the response body for replays
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotent replays the stored response for a repeated Idempotency-Key instead of executing the request again.
+// Requests without the header are not affected.
+func (h *Handler) Idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "error reading body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(append([]byte(c.Request.Method+" "+c.Request.URL.Path+"\n"), body...))
+		requestHash := hex.EncodeToString(hash[:])
+
+		client := ratelimit.ClientKey(c)
+		stored, err := h.db.ReserveIdempotencyKey(client, key, requestHash, h.cfg.IdempotencyTTL)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if stored != nil {
+			switch {
+			case stored.RequestHash != requestHash:
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was used for a different request"})
+			case stored.Status == 0:
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "request with this Idempotency-Key is still in progress"})
+			default:
+				if stored.Location != "" {
+					c.Header("Location", stored.Location)
+				}
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(stored.Status, "application/json; charset=utf-8", stored.Body)
+				c.Abort()
+			}
+			return
+		}
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		//a panicking handler never completes the key, release it so a retry is not stuck in progress
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if err := h.db.ReleaseIdempotencyKey(client, key); err != nil {
+					log.Println(err)
+				}
+				panic(recovered)
+			}
+		}()
+		c.Next()
+
+		//server errors and throttling are not final, the client may retry them with the same key
+		status := writer.Status()
+		if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+			if err := h.db.ReleaseIdempotencyKey(client, key); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+		if err := h.db.CompleteIdempotencyKey(client, key, status, writer.body.Bytes(), writer.Header().Get("Location")); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/ingest"
+	"measurements-api-stdlib-docker/ratelimit"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxBatchSize = 10000
+
+// limitError is a rate limit or quota rejection, answered with 429 and Retry-After
+type limitError struct {
+	retryAfter time.Duration
+	msg        string
+}
+
+func (e *limitError) Error() string {
+	return e.msg
+}
+
+// reservation is the share of the daily quota booked for the measurements of one request
+type reservation struct {
+	quota              *ratelimit.Quota
+	experimentOfSensor map[int64]int
+}
+
+// release gives the quota of measurements back that were not stored
+func (r *reservation) release(measurements []database.Measurement) {
+	perExperiment := make(map[int]int)
+	for _, m := range measurements {
+		perExperiment[r.experimentOfSensor[m.SensorsId]]++
+	}
+	for experimentID, n := range perExperiment {
+		r.quota.Release(experimentID, n)
+	}
+}
+
+// reserveQuota books the measurements on the daily quota of their experiments
+func (h *Handler) reserveQuota(measurements []database.Measurement) (*reservation, error) {
+	r := &reservation{quota: h.limits.Quota, experimentOfSensor: make(map[int64]int)}
+	perExperiment := make(map[int]int)
+	for _, m := range measurements {
+		experimentID, ok := r.experimentOfSensor[m.SensorsId]
+		if !ok {
+			var err error
+			experimentID, err = h.db.GetSensorExperimentID(m.SensorsId)
+			if errors.Is(err, database.ErrRecordNotFound) {
+				return nil, fmt.Errorf("%w: sensor %v does not exist", database.ErrInvalidField, m.SensorsId)
+			} else if err != nil {
+				return nil, err
+			}
+			r.experimentOfSensor[m.SensorsId] = experimentID
+		}
+		perExperiment[experimentID]++
+	}
+
+	reserved := make(map[int]int, len(perExperiment))
+	releaseReserved := func() {
+		for experimentID, n := range reserved {
+			h.limits.Quota.Release(experimentID, n)
+		}
+	}
+	for experimentID, n := range perExperiment {
+		ok, retryAfter, err := h.limits.Quota.Reserve(experimentID, n)
+		if err != nil {
+			releaseReserved()
+			return nil, err
+		} else if !ok {
+			releaseReserved()
+			return nil, &limitError{retryAfter, fmt.Sprintf("daily ingestion quota of experiment %v exhausted", experimentID)}
+		}
+		reserved[experimentID] = n
+	}
+	return r, nil
+}
+
+// ingest is the insert path of every write API: the measurements of one request are booked on the
+// quota and stored (all or none), through the group commit queue if it is enabled. Ignored duplicates
+// do not count against the quota.
+func (h *Handler) ingest(c *gin.Context, measurements []database.Measurement) ([]database.InsertResult, error) {
+	r, err := h.reserveQuota(measurements)
+	if err != nil {
+		return nil, err
+	}
+	var results []database.InsertResult
+	if h.queue == nil {
+		results, err = h.db.InsertMeasurements(measurements, actor(c))
+	} else {
+		results, err = h.queue.Submit(ratelimit.ClientKey(c), measurements, actor(c))
+	}
+	if err != nil {
+		r.release(measurements)
+		return nil, err
+	}
+	var ignored []database.Measurement
+	for i, result := range results {
+		if result == database.InsertIgnored {
+			ignored = append(ignored, measurements[i])
+		}
+	}
+	r.release(ignored)
+	return results, nil
+}
+
+// insertErrorStatus maps an error of ingest to the status code, retryAfter is 0 if the client should not retry
+func insertErrorStatus(err error) (status int, retryAfter time.Duration, msg string) {
+	var limitErr *limitError
+	switch {
+	case errors.As(err, &limitErr):
+		return http.StatusTooManyRequests, limitErr.retryAfter, err.Error()
+	case errors.Is(err, ingest.ErrQueueFull), errors.Is(err, ingest.ErrClosed):
+		return http.StatusServiceUnavailable, time.Second, err.Error()
+	case errors.Is(err, ingest.ErrClientQuota):
+		return http.StatusTooManyRequests, time.Second, err.Error()
+	case errors.Is(err, database.ErrDuplicate), errors.Is(err, database.ErrExperimentState):
+		return http.StatusConflict, 0, err.Error()
+	case errors.Is(err, database.ErrInvalidField):
+		return http.StatusBadRequest, 0, err.Error()
+	default:
+		log.Printf("error inserting measurements: %s", err)
+		return http.StatusInternalServerError, 0, "Database INSERT error"
+	}
+}
+
+func writeInsertError(c *gin.Context, err error) {
+	status, retryAfter, msg := insertErrorStatus(err)
+	switch status {
+	case http.StatusTooManyRequests:
+		ratelimit.TooManyRequests(c, retryAfter, msg)
+	case http.StatusServiceUnavailable:
+		c.Header("Retry-After", "1")
+		c.JSON(status, gin.H{"error": msg})
+	default:
+		c.JSON(status, gin.H{"error": msg})
+	}
+}
+
+// HandleMeasurementBatchPost inserts a JSON array of measurements in one transaction
+func (h *Handler) HandleMeasurementBatchPost(c *gin.Context) {
+	var measurements []database.Measurement
+	if err := c.ShouldBindJSON(&measurements); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON Data"})
+		return
+	}
+	if len(measurements) == 0 || len(measurements) > maxBatchSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("batch must contain 1 to %v measurements", maxBatchSize)})
+		return
+	}
+
+	results, err := h.ingest(c, measurements)
+	if err != nil {
+		writeInsertError(c, err)
+		return
+	}
+
+	counts := make(map[database.InsertResult]int)
+	for _, result := range results {
+		counts[result]++
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"message": fmt.Sprintf("%v measurements processed", len(measurements)),
+		"results": counts,
+		"data":    measurements,
+	})
+}
+
+// HandleIngestMetrics shows the state of the group commit queue
+func (h *Handler) HandleIngestMetrics(c *gin.Context) {
+	if h.queue == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "queue": h.queue.Metrics()})
+}
@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/util"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleExperimentStream sends the new measurements of all sensors of the experiment as server-sent events
+func (h *Handler) HandleExperimentStream(c *gin.Context) {
+	sensorIDs, err := h.db.GetExperimentSensorIDs(c.Param("exp"))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.streamLive(c, sensorIDs)
+}
+
+// HandleSensorStream sends the new measurements of one sensor as server-sent events
+func (h *Handler) HandleSensorStream(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := h.db.GetSensorExperimentID(int64(id)); errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.streamLive(c, []int64{int64(id)})
+}
+
+// lastEventID is the id of the last measurement the client has seen, sent by EventSource on a reconnect.
+// ?last_event_id= does the same for the first connection.
+func lastEventID(c *gin.Context) (int64, bool, error) {
+	value := c.GetHeader("Last-Event-ID")
+	if value == "" {
+		value = c.Query("last_event_id")
+	}
+	if value == "" {
+		return 0, false, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return 0, false, fmt.Errorf("invalid Last-Event-ID %q", value)
+	}
+	return id, true, nil
+}
+
+var errMaintenance = errors.New("server is entering maintenance mode")
+
+// follow passes the measurements of the sensors with an id above lastID to emit, in batches ordered by id.
+// It subscribes before reading the database, so nothing committed in between is lost: with resume it reads
+// the database from lastID on, otherwise it starts at the current last id, then live measurements follow.
+// A subscriber that falls behind is dropped by the broker and catches up from the database the same way.
+// idle (may be nil) is called every STREAM_HEARTBEAT. follow returns when ctx is done, maintenance starts
+// or emit fails.
+func (h *Handler) follow(ctx context.Context, sensorIDs []int64, lastID int64, resume bool,
+	emit func([]database.Measurement) error, idle func() error) error {
+	sub := h.live.Subscribe(sensorIDs)
+	defer func() { h.live.Unsubscribe(sub) }()
+	if !resume {
+		var err error
+		if lastID, err = h.db.LastMeasurementID(); err != nil {
+			return err
+		}
+	}
+
+	send := func(batch []database.Measurement) error {
+		//ids are increasing, only the start of a live batch can have been read from the database already
+		for len(batch) > 0 && batch[0].ID <= lastID {
+			batch = batch[1:]
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := h.db.Calibrate(batch); err != nil {
+			return err
+		}
+		if err := emit(batch); err != nil {
+			return err
+		}
+		lastID = batch[len(batch)-1].ID
+		return nil
+	}
+	catchUp := func() error {
+		for {
+			measurements, err := h.db.MeasurementsAfter(lastID, sensorIDs, streamFlushRows)
+			if err != nil {
+				return err
+			}
+			if err := send(measurements); err != nil {
+				return err
+			}
+			if len(measurements) < streamFlushRows {
+				return nil
+			}
+		}
+	}
+	if resume {
+		if err := catchUp(); err != nil {
+			return err
+		}
+	}
+
+	var heartbeat <-chan time.Time
+	if idle != nil && h.cfg.Stream.Heartbeat > 0 {
+		ticker := time.NewTicker(h.cfg.Stream.Heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	maintenance := h.maintenance.Starting()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-maintenance:
+			return errMaintenance
+		case m := <-sub.C:
+			//take what else is buffered, so a burst is sent at once
+			batch := []database.Measurement{m}
+		drain:
+			for len(batch) < streamFlushRows {
+				select {
+				case m := <-sub.C:
+					batch = append(batch, m)
+				default:
+					break drain
+				}
+			}
+			if err := send(batch); err != nil {
+				return err
+			}
+		case <-sub.Lagged():
+			sub = h.live.Subscribe(sensorIDs)
+			if err := catchUp(); err != nil {
+				return err
+			}
+		case <-heartbeat:
+			if err := idle(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// streamLive writes the measurements as server-sent events, the event id is the measurement id
+func (h *Handler) streamLive(c *gin.Context, sensorIDs []int64) {
+	lastID, resume, err := lastEventID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	qualities, ok := requestedQualities(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	emit := func(batch []database.Measurement) error {
+		for _, m := range batch {
+			if !qualityMatches(qualities, m) {
+				continue
+			}
+			data, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(c.Writer, "id: %d\nevent: measurement\ndata: %s\n\n", m.ID, data); err != nil {
+				return err
+			}
+		}
+		c.Writer.Flush()
+		return nil
+	}
+	keepalive := func() error {
+		if _, err := c.Writer.WriteString(": keepalive\n\n"); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+	err = h.follow(c.Request.Context(), sensorIDs, lastID, resume, emit, keepalive)
+	if err != nil && c.Request.Context().Err() == nil {
+		//the client reconnects with its Last-Event-ID, after maintenance as well
+		log.Printf("live stream of sensors %v ended: %s", sensorIDs, err)
+		data, _ := json.Marshal(gin.H{"error": err.Error()})
+		fmt.Fprintf(c.Writer, "event: error\ndata: %s\n\n", data)
+		c.Writer.Flush()
+	}
+}
+
+// HandleStreamMetrics shows the number of live stream subscribers and how many fell behind
+func (h *Handler) HandleStreamMetrics(c *gin.Context) {
+	c.JSON(http.StatusOK, h.live.Metrics())
+}
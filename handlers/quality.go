@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/util"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestedQualities reads ?quality=good,corrected, an unknown quality is answered with 400
+func requestedQualities(c *gin.Context) ([]string, bool) {
+	qualities, err := database.ParseQualities(c.Query("quality"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return qualities, true
+}
+
+// qualityMatches is true if m has one of the qualities or there are none
+func qualityMatches(qualities []string, m database.Measurement) bool {
+	return len(qualities) == 0 || slices.Contains(qualities, m.Quality)
+}
+
+// HandleMeasurementQualityPut flags one measurement, {"quality": "bad", "reason": "sensor unplugged"}
+func (h *Handler) HandleMeasurementQualityPut(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	version, ok := h.expectedVersion(c)
+	if !ok {
+		return
+	}
+	var body struct {
+		Quality string `json:"quality"`
+		Reason  string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON Data: %s", err)})
+		return
+	}
+	flagged, err := h.db.SetMeasurementQuality(int64(id), body.Quality, body.Reason, version, actor(c))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrVersionConflict) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrExperimentState) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrInvalidField) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("ETag", etag(flagged.Version))
+	c.JSON(http.StatusOK, flagged)
+}
+
+// HandleSensorQualityPost flags all measurements of a sensor in [since, until),
+// {"since": "2024-01-01 10:00:00", "until": "2024-01-01 12:00:00", "quality": "bad", "reason": "..."}
+func (h *Handler) HandleSensorQualityPost(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	flag := &database.QualityFlag{}
+	if err := c.ShouldBindJSON(flag); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON Data: %s", err)})
+		return
+	}
+	flag.SensorID = int64(id)
+	err = h.db.FlagSensorRange(flag, actor(c))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrExperimentState) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrInvalidField) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, flag)
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/util"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *Handler) HandleRetentionRulesGet(c *gin.Context) {
+	rules, err := h.db.GetRetentionRules()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+func (h *Handler) HandleRetentionRulePost(c *gin.Context) {
+	rule := &database.RetentionRule{}
+	if err := c.ShouldBindJSON(rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON Data: %s", err)})
+		return
+	}
+	if err := h.db.CreateRetentionRule(rule, actor(c)); err != nil {
+		if errors.Is(err, database.ErrInvalidField) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, rule)
+}
+
+func (h *Handler) HandleRetentionRuleDelete(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.db.DeleteRetentionRule(int64(id), actor(c)); err != nil {
+		if errors.Is(err, database.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("succesfully deleted retention rule %v", id)})
+}
+
+// HandleRetentionPreview shows what the next retention run would purge without changing anything
+func (h *Handler) HandleRetentionPreview(c *gin.Context) {
+	report, err := h.db.ApplyRetention(true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func (h *Handler) HandleRetentionRun(c *gin.Context) {
+	report, err := h.db.ApplyRetention(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func (h *Handler) HandleRetentionMetrics(c *gin.Context) {
+	metrics, err := h.db.GetRetentionMetrics()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, metrics)
+}
+
+func (h *Handler) HandleSensorDownsamples(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var interval time.Duration
+	if value := c.Query("interval"); value != "" {
+		if interval, err = time.ParseDuration(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid interval (%s)", err)})
+			return
+		}
+	}
+	since, err := util.GetQueryTime(c, "since")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	until, err := util.GetQueryTime(c, "until")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	unit, ok := requestedUnit(c)
+	if !ok {
+		return
+	}
+	qualities, ok := requestedQualities(c)
+	if !ok {
+		return
+	}
+	downsamples, err := h.db.GetDownsamples(int64(id), int64(interval/time.Second), since, until, qualities)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range downsamples {
+		unit.downsample(&downsamples[i])
+	}
+	c.JSON(http.StatusOK, downsamples)
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"iter"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rows are flushed to the client in chunks of this size
+const streamFlushRows = 1000
+
+// wantsNDJSON is true for ?format=ndjson or an Accept header asking for application/x-ndjson
+func wantsNDJSON(c *gin.Context) bool {
+	return c.Query("format") == "ndjson" || strings.Contains(c.GetHeader("Accept"), "application/x-ndjson")
+}
+
+// streamErrorTrailer is the HTTP trailer with the error that ended a stream after the status was sent
+const streamErrorTrailer = "X-Stream-Error"
+
+// streamJSON writes the rows as a JSON array (or NDJSON, one object per line) while they are read,
+// so the response never has to fit into memory. An error before the first row is a normal 500,
+// later the status is already sent: the last element of the array (or the last NDJSON line) is
+// {"error": ...} and the error is sent in the X-Stream-Error trailer.
+func streamJSON[T any](c *gin.Context, rows iter.Seq2[T, error]) {
+	ndjson := wantsNDJSON(c)
+	enc := json.NewEncoder(c.Writer)
+	started := false
+	start := func() {
+		started = true
+		if ndjson {
+			c.Header("Content-Type", "application/x-ndjson")
+		} else {
+			c.Header("Content-Type", "application/json; charset=utf-8")
+		}
+		c.Header("Trailer", streamErrorTrailer)
+		c.Status(http.StatusOK)
+		if !ndjson {
+			c.Writer.WriteString("[")
+		}
+	}
+
+	n := 0
+	for row, err := range rows {
+		if err != nil {
+			log.Printf("error streaming response after %v rows: %s", n, err)
+			if !started {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !ndjson && n > 0 {
+				c.Writer.WriteString(",")
+			}
+			enc.Encode(gin.H{"error": err.Error()})
+			if !ndjson {
+				c.Writer.WriteString("]")
+			}
+			c.Writer.Header().Set(streamErrorTrailer, err.Error())
+			return
+		}
+		if !started {
+			start()
+		}
+		if !ndjson && n > 0 {
+			c.Writer.WriteString(",")
+		}
+		if err := enc.Encode(row); err != nil {
+			//the client went away, breaking the loop closes the rows
+			log.Printf("error writing streamed response after %v rows: %s", n, err)
+			return
+		}
+		n++
+		if n%streamFlushRows == 0 {
+			c.Writer.Flush()
+		}
+	}
+	if !started {
+		start()
+	}
+	if !ndjson {
+		c.Writer.WriteString("]")
+	}
+}
+
+// timed adds the time spent reading the rows to elapsed, without the time the consumer takes for each row
+func timed[T any](rows iter.Seq2[T, error], elapsed *time.Duration) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		start := time.Now()
+		for row, err := range rows {
+			*elapsed += time.Since(start)
+			if !yield(row, err) {
+				return
+			}
+			start = time.Now()
+		}
+		*elapsed += time.Since(start)
+	}
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/util"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *Handler) HandleTemplatesGet(c *gin.Context) {
+	templates, err := h.db.GetTemplates()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, templates)
+}
+
+func (h *Handler) HandleTemplateGet(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	template, err := h.db.GetTemplate(int64(id))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, template)
+}
+
+// HandleTemplatePost stores a template, {"name": "...", "sensors": [{"sensor_type": "Barometer", "unit": "hPa"}]}
+func (h *Handler) HandleTemplatePost(c *gin.Context) {
+	template := &database.ExperimentTemplate{}
+	if err := c.ShouldBindJSON(template); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON Data: %s", err)})
+		return
+	}
+	err := h.db.CreateTemplate(template, actor(c))
+	if errors.Is(err, database.ErrInvalidField) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrDuplicate) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, template)
+}
+
+func (h *Handler) HandleTemplateDelete(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err = h.db.DeleteTemplate(int64(id), actor(c))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("succesfully deleted template %v", id)})
+}
+
+// HandleExperimentPost creates a draft experiment, {"name": "...", "template_id": 1} adds the configuration of the template
+func (h *Handler) HandleExperimentPost(c *gin.Context) {
+	var body database.NewExperiment
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON Data: %s", err)})
+		return
+	}
+	if body.TemplateID != 0 && !h.isAdmin(c) {
+		//validation rules apply to every sensor of their type in all experiments, templates are never changed
+		//after they were stored, so the check holds until the experiment is created
+		template, err := h.db.GetTemplate(body.TemplateID)
+		if errors.Is(err, database.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(template.ValidationRules) > 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "the template has validation rules, which apply to all sensors of their types, creating an experiment from it requires the admin api key"})
+			return
+		}
+	}
+	experiment, sensors, err := h.db.CreateExperiment(body, actor(c))
+	h.respondCreatedExperiment(c, experiment, sensors, err)
+}
+
+// HandleExperimentClone creates a draft experiment with the sensors and alert rules of :exp, {"name": "..."}
+func (h *Handler) HandleExperimentClone(c *gin.Context) {
+	var body database.NewExperiment
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON Data: %s", err)})
+		return
+	}
+	experiment, sensors, err := h.db.CloneExperiment(c.Param("exp"), body, actor(c))
+	h.respondCreatedExperiment(c, experiment, sensors, err)
+}
+
+func (h *Handler) respondCreatedExperiment(c *gin.Context, experiment *database.Experiment, sensors []database.Sensor, err error) {
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrInvalidField) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrDuplicate) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"experiment": experiment, "sensors": sensors})
+}
+
+// HandleExperimentTemplatePost saves the configuration of :exp as a template, {"name": "..."}
+func (h *Handler) HandleExperimentTemplatePost(c *gin.Context) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON Data: %s", err)})
+		return
+	}
+	template, err := h.db.SaveTemplate(c.Param("exp"), body.Name, actor(c))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrInvalidField) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrDuplicate) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, template)
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/util"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *Handler) HandleTrashMeasurements(c *gin.Context) {
+	measurements, err := h.db.GetDeletedMeasurements()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, measurements)
+}
+
+func (h *Handler) HandleTrashExperiments(c *gin.Context) {
+	experiments, err := h.db.GetDeletedExperiments()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, experiments)
+}
+
+func (h *Handler) HandleMeasurementRestore(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	measurement, err := h.db.RestoreMeasurement(id, actor(c))
+	if errors.Is(err, database.ErrExperimentState) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, measurement)
+}
+
+func (h *Handler) HandleExperimentDelete(c *gin.Context) {
+	expRef := c.Param("exp")
+	if err := h.db.DeleteExperiment(expRef, actor(c)); err != nil {
+		if errors.Is(err, database.ErrExperimentState) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("succesfully deleted experiment %s", expRef)})
+}
+
+func (h *Handler) HandleExperimentRestore(c *gin.Context) {
+	experiment, err := h.db.RestoreExperiment(c.Param("exp"), actor(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, experiment)
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/units"
+	"measurements-api-stdlib-docker/util"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleUnits lists the unit catalogue, the first unit of every quantity is the one values are stored in
+func (h *Handler) HandleUnits(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"quantities": units.Quantities(),
+		"units":      units.All(),
+	})
+}
+
+func (h *Handler) HandleSensorGet(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sensor, err := h.db.GetSensor(int64(id))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sensor)
+}
+
+// HandleSensorQuantityPut sets what a sensor measures, {"quantity": "pressure"}
+func (h *Handler) HandleSensorQuantityPut(c *gin.Context) {
+	id, err := util.GetParamInt(c, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var body struct {
+		Quantity string `json:"quantity"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid JSON Data: %s", err)})
+		return
+	}
+	sensor, err := h.db.SetSensorQuantity(int64(id), body.Quantity, actor(c))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrExperimentState) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, database.ErrInvalidField) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sensor)
+}
+
+// unitConversion converts values from their stored unit into the unit of ?unit=. Values of another
+// quantity or in an unknown unit are left as they are, their unit field tells which they are in.
+type unitConversion struct {
+	target *units.Unit // nil without ?unit=
+}
+
+// requestedUnit reads ?unit=, an unknown unit is answered with 400
+func requestedUnit(c *gin.Context) (unitConversion, bool) {
+	symbol := c.Query("unit")
+	if symbol == "" {
+		return unitConversion{}, true
+	}
+	target, ok := units.Lookup(symbol)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown unit %q, see GET /units", symbol)})
+		return unitConversion{}, false
+	}
+	return unitConversion{&target}, true
+}
+
+// storedUnit is the unit values of the target quantity are stored in, "" without ?unit=
+func (u unitConversion) storedUnit() string {
+	if u.target == nil {
+		return ""
+	}
+	canonical, _ := units.Canonical(u.target.Quantity)
+	return canonical.Symbol
+}
+
+// convert returns the function that converts a value from unit, nil if it stays as it is
+func (u unitConversion) convert(unit string) func(float64) float64 {
+	if u.target == nil {
+		return nil
+	}
+	from, ok := units.Lookup(unit)
+	if !ok || from.Quantity != u.target.Quantity {
+		return nil
+	}
+	return func(value float64) float64 {
+		converted, _ := units.Convert(value, from, *u.target)
+		return converted
+	}
+}
+
+func (u unitConversion) measurement(m *database.Measurement) {
+	if convert := u.convert(m.Unit); convert != nil {
+		m.Value, m.Unit = convert(m.Value), u.target.Symbol
+		m.CalibratedValue = convertOptional(convert, m.CalibratedValue)
+	}
+}
+
+func (u unitConversion) response(m *database.MeasurementResponse) {
+	if convert := u.convert(m.Unit); convert != nil {
+		m.Value, m.Unit = convert(m.Value), u.target.Symbol
+		m.CalibratedValue = convertOptional(convert, m.CalibratedValue)
+	}
+}
+
+func convertOptional(convert func(float64) float64, value *float64) *float64 {
+	if value == nil {
+		return nil
+	}
+	converted := convert(*value)
+	return &converted
+}
+
+// aggregate converts the statistics, the spread only changes with the factor of the units
+func (u unitConversion) aggregate(a *database.Aggregate) {
+	convert := u.convert(a.Unit)
+	if convert == nil {
+		return
+	}
+	spread := convert(1) - convert(0)
+	a.Mean, a.Min, a.Max, a.Stddev = convert(a.Mean), convert(a.Min), convert(a.Max), a.Stddev*spread
+	a.Unit = u.target.Symbol
+}
+
+func (u unitConversion) downsample(ds *database.Downsample) {
+	if convert := u.convert(ds.Unit); convert != nil {
+		ds.Avg, ds.Min, ds.Max, ds.Unit = convert(ds.Avg), convert(ds.Min), convert(ds.Max), u.target.Symbol
+	}
+}
+
+// comparison converts the series and the point-wise statistics
+func (u unitConversion) comparison(r *database.RunComparison) {
+	convert := u.convert(r.Unit)
+	if convert == nil {
+		return
+	}
+	for _, values := range [][]*float64{r.Mean, r.Min, r.Max} {
+		for i := range values {
+			values[i] = convertOptional(convert, values[i])
+		}
+	}
+	for _, run := range r.Runs {
+		for i := range run.Values {
+			run.Values[i] = convertOptional(convert, run.Values[i])
+		}
+	}
+	r.Unit = u.target.Symbol
+}
+
+// inUnit applies convert to every streamed row, it does nothing without ?unit=
+func inUnit[T any](u unitConversion, rows iter.Seq2[T, error], convert func(*T)) iter.Seq2[T, error] {
+	if u.target == nil {
+		return rows
+	}
+	return func(yield func(T, error) bool) {
+		for row, err := range rows {
+			if err == nil {
+				convert(&row)
+			}
+			if !yield(row, err) {
+				return
+			}
+		}
+	}
+}
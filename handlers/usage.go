@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"measurements-api-stdlib-docker/ratelimit"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleUsage shows the remaining rate limit tokens of the caller, admins also see the ingestion quotas
+// of all experiments today
+func (h *Handler) HandleUsage(c *gin.Context) {
+	client := ratelimit.ClientKey(c)
+	usage := gin.H{
+		"client":      client,
+		"rate_limits": h.limits.Usage(client),
+	}
+	if h.isAdmin(c) {
+		usage["quotas"] = h.limits.Quota.Usage()
+	}
+	c.JSON(http.StatusOK, usage)
+}
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/ratelimit"
+	"measurements-api-stdlib-docker/units"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// socketRequest is a message from the client, Ref is echoed in the reply
+type socketRequest struct {
+	Type string `json:"type"` // subscribe, unsubscribe or publish
+	Ref  string `json:"ref"`
+	// subscribe: sensors by id and experiments by id or name, after resumes behind a measurement id
+	Sensors     []int64      `json:"sensors"`
+	Experiments []string     `json:"experiments"`
+	Filter      socketFilter `json:"filter"`
+	After       *int64       `json:"after"`
+	// unsubscribe
+	Subscription int `json:"subscription"`
+	// publish
+	Measurements []database.Measurement `json:"measurements"`
+}
+
+// socketMessage is a reply or a batch of measurements of a subscription
+type socketMessage struct {
+	Type         string                  `json:"type"`
+	Ref          string                  `json:"ref,omitempty"`
+	Subscription int                     `json:"subscription,omitempty"`
+	Sensors      []int64                 `json:"sensors,omitempty"`
+	Measurements []database.Measurement  `json:"measurements,omitempty"`
+	Results      []database.InsertResult `json:"results,omitempty"`
+	Status       int                     `json:"status,omitempty"`
+	Error        string                  `json:"error,omitempty"`
+}
+
+// socketFilter is applied on the server, unset fields match everything. A known unit matches every
+// unit of its quantity, above and below are then compared in that unit.
+type socketFilter struct {
+	Above   *float64 `json:"above"`
+	Below   *float64 `json:"below"`
+	Unit    string   `json:"unit"`
+	Quality []string `json:"quality"`
+}
+
+func (f socketFilter) match(m database.Measurement) bool {
+	value := m.Value
+	if f.Unit != "" && m.Unit != f.Unit {
+		target, ok := units.Lookup(f.Unit)
+		from, known := units.Lookup(m.Unit)
+		if !ok || !known || from.Quantity != target.Quantity {
+			return false
+		}
+		value, _ = units.Convert(value, from, target)
+	}
+	return (f.Above == nil || value > *f.Above) &&
+		(f.Below == nil || value < *f.Below) &&
+		qualityMatches(f.Quality, m)
+}
+
+// HandleWebSocket serves subscriptions to several sensors and experiments and inserts over one socket
+func (h *Handler) HandleWebSocket(c *gin.Context) {
+	server := websocket.Server{
+		//control software is no browser and sends no Origin, the API has no cookies to protect
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   func(ws *websocket.Conn) { h.serveSocket(c, ws) },
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+// socket is one connection. Only the writer goroutine writes to the connection, replies and
+// measurements are queued on out. A subscription that waits for out falls behind in the broker
+// and catches up from the database later, ingestion is never blocked by the client.
+type socket struct {
+	h   *Handler
+	c   *gin.Context
+	ctx context.Context
+	out chan socketMessage
+
+	mu            sync.Mutex
+	subscriptions map[int]context.CancelFunc
+	next          int
+}
+
+func (h *Handler) serveSocket(c *gin.Context, ws *websocket.Conn) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	s := &socket{h: h, c: c, ctx: ctx, out: make(chan socketMessage, h.cfg.Stream.Buffer), subscriptions: make(map[int]context.CancelFunc)}
+
+	maintenance := h.maintenance.Starting()
+	go func() {
+		defer ws.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-maintenance:
+				websocket.JSON.Send(ws, socketMessage{Type: "error", Status: http.StatusServiceUnavailable, Error: errMaintenance.Error()})
+				return
+			case msg := <-s.out:
+				if err := websocket.JSON.Send(ws, msg); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		var req socketRequest
+		err := websocket.JSON.Receive(ws, &req)
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			s.reply(socketMessage{Type: "error", Status: http.StatusBadRequest, Error: "Invalid JSON Data"})
+			continue
+		} else if err != nil {
+			//closed by the client, or by the writer after an error or for maintenance
+			return
+		}
+		switch req.Type {
+		case "subscribe":
+			s.subscribe(req)
+		case "unsubscribe":
+			s.unsubscribe(req)
+		case "publish":
+			s.publish(req)
+		default:
+			s.reply(socketMessage{Type: "error", Ref: req.Ref, Status: http.StatusBadRequest, Error: fmt.Sprintf("unknown message type %q", req.Type)})
+		}
+	}
+}
+
+// reply is false once the connection is closed
+func (s *socket) reply(msg socketMessage) bool {
+	select {
+	case s.out <- msg:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+func (s *socket) replyError(ref string, status int, err error) {
+	s.reply(socketMessage{Type: "error", Ref: ref, Status: status, Error: err.Error()})
+}
+
+// sensorIDs resolves the sensors and experiments of a subscribe request, without duplicates
+func (s *socket) sensorIDs(req socketRequest) ([]int64, error) {
+	seen := make(map[int64]bool)
+	ids := []int64{}
+	add := func(id int64) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range req.Sensors {
+		if _, err := s.h.db.GetSensorExperimentID(id); err != nil {
+			return nil, err
+		}
+		add(id)
+	}
+	for _, ref := range req.Experiments {
+		sensors, err := s.h.db.GetExperimentSensorIDs(ref)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range sensors {
+			add(id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *socket) subscribe(req socketRequest) {
+	ids, err := s.sensorIDs(req)
+	if errors.Is(err, database.ErrRecordNotFound) {
+		s.replyError(req.Ref, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		s.replyError(req.Ref, http.StatusInternalServerError, err)
+		return
+	}
+	if len(ids) == 0 {
+		s.replyError(req.Ref, http.StatusBadRequest, errors.New("subscribe needs sensors or experiments"))
+		return
+	}
+	for _, q := range req.Filter.Quality {
+		if !slices.Contains(database.Qualities, q) {
+			s.replyError(req.Ref, http.StatusBadRequest, fmt.Errorf("unknown quality %q, valid are %v", q, database.Qualities))
+			return
+		}
+	}
+
+	//without after the subscription starts now, before the reply, so the client can publish right away
+	var lastID int64
+	if req.After != nil {
+		lastID = *req.After
+	} else if lastID, err = s.h.db.LastMeasurementID(); err != nil {
+		s.replyError(req.Ref, http.StatusInternalServerError, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.mu.Lock()
+	s.next++
+	id := s.next
+	s.subscriptions[id] = cancel
+	s.mu.Unlock()
+	if !s.reply(socketMessage{Type: "subscribed", Ref: req.Ref, Subscription: id, Sensors: ids}) {
+		return
+	}
+
+	emit := func(batch []database.Measurement) error {
+		matching := []database.Measurement{}
+		for _, m := range batch {
+			if req.Filter.match(m) {
+				matching = append(matching, m)
+			}
+		}
+		if len(matching) == 0 {
+			return nil
+		}
+		select {
+		case s.out <- socketMessage{Type: "measurements", Subscription: id, Measurements: matching}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	go func() {
+		err := s.h.follow(ctx, ids, lastID, true, emit, nil)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("websocket subscription %v of sensors %v ended: %s", id, ids, err)
+			s.reply(socketMessage{Type: "error", Subscription: id, Status: http.StatusInternalServerError, Error: err.Error()})
+		}
+		s.mu.Lock()
+		delete(s.subscriptions, id)
+		s.mu.Unlock()
+		cancel()
+	}()
+}
+
+func (s *socket) unsubscribe(req socketRequest) {
+	s.mu.Lock()
+	cancel, ok := s.subscriptions[req.Subscription]
+	delete(s.subscriptions, req.Subscription)
+	s.mu.Unlock()
+	if !ok {
+		s.replyError(req.Ref, http.StatusNotFound, fmt.Errorf("subscription %v does not exist", req.Subscription))
+		return
+	}
+	cancel()
+	s.reply(socketMessage{Type: "unsubscribed", Ref: req.Ref, Subscription: req.Subscription})
+}
+
+// publish takes the insert path of POST /measurements/batch, including the write rate limit
+func (s *socket) publish(req socketRequest) {
+	if len(req.Measurements) == 0 || len(req.Measurements) > maxBatchSize {
+		s.replyError(req.Ref, http.StatusBadRequest, fmt.Errorf("publish must contain 1 to %v measurements", maxBatchSize))
+		return
+	}
+	if ok, retryAfter := s.h.limits.Write.Allow(ratelimit.ClientKey(s.c)); !ok {
+		s.replyError(req.Ref, http.StatusTooManyRequests, fmt.Errorf("rate limit exceeded, retry after %s", retryAfter))
+		return
+	}
+	results, err := s.h.ingest(s.c, req.Measurements)
+	if err != nil {
+		status, _, msg := insertErrorStatus(err)
+		s.replyError(req.Ref, status, errors.New(msg))
+		return
+	}
+	s.reply(socketMessage{Type: "published", Ref: req.Ref, Results: results, Measurements: req.Measurements})
+}
@@ -0,0 +1,239 @@
+// Group commit: measurements of concurrent requests are collected and stored in one transaction
+package ingest
+
+import (
+	"context"
+	"errors"
+	"log"
+	"measurements-api-stdlib-docker/database"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueFull   = errors.New("ingestion queue is full")
+	ErrClientQuota = errors.New("too many pending measurements of this client")
+	ErrClosed      = errors.New("ingestion queue is shut down")
+)
+
+type request struct {
+	client string
+	batch  *database.InsertBatch
+	done   chan struct{}
+	err    error // the whole group failed
+}
+
+type Queue struct {
+	db       *database.Database
+	maxBatch int           // flush as soon as this many measurements are waiting
+	maxDelay time.Duration // or when the oldest waited this long
+	capacity int           // pending measurements before requests are rejected
+
+	mu        sync.Mutex
+	pending   []*request
+	depth     int            // pending measurements
+	perClient map[string]int // pending measurements per client
+	wake      chan struct{}
+	closed    bool
+	metrics   Metrics
+}
+
+type Metrics struct {
+	Depth           int     `json:"depth"`
+	PendingRequests int     `json:"pending_requests"`
+	Capacity        int     `json:"capacity"`
+	MaxBatch        int     `json:"max_batch"`
+	MaxDelayMs      int64   `json:"max_delay_ms"`
+	Commits         int64   `json:"commits"`
+	FailedCommits   int64   `json:"failed_commits"`
+	Requests        int64   `json:"requests"`
+	Measurements    int64   `json:"measurements"`
+	RejectedFull    int64   `json:"rejected_full"`
+	RejectedClient  int64   `json:"rejected_client"`
+	AvgBatch        float64 `json:"avg_batch"`
+	LastBatch       int     `json:"last_batch"`
+	LastCommitMs    float64 `json:"last_commit_ms"`
+	MaxDepth        int     `json:"max_depth"`
+}
+
+func NewQueue(db *database.Database, maxBatch int, maxDelay time.Duration, capacity int) *Queue {
+	if maxBatch < 1 {
+		maxBatch = 1
+	}
+	return &Queue{
+		db:        db,
+		maxBatch:  maxBatch,
+		maxDelay:  maxDelay,
+		capacity:  capacity,
+		perClient: make(map[string]int),
+		wake:      make(chan struct{}, 1),
+		metrics:   Metrics{Capacity: capacity, MaxBatch: maxBatch, MaxDelayMs: maxDelay.Milliseconds()},
+	}
+}
+
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Submit queues the measurements of one request and returns after the transaction containing them committed.
+// They are stored all or none, like InsertMeasurements.
+func (q *Queue) Submit(client string, measurements []database.Measurement, actor database.Actor) ([]database.InsertResult, error) {
+	n := len(measurements)
+	req := &request{
+		client: client,
+		batch:  &database.InsertBatch{Measurements: measurements, Actor: actor},
+		done:   make(chan struct{}),
+	}
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil, ErrClosed
+	}
+	//an empty queue takes any request, so a batch larger than the capacity is not rejected forever
+	if q.depth > 0 && q.depth+n > q.capacity {
+		q.metrics.RejectedFull++
+		q.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	//a single client may fill at most half of the queue
+	if used := q.perClient[client]; used > 0 && used+n > q.capacity/2 {
+		q.metrics.RejectedClient++
+		q.mu.Unlock()
+		return nil, ErrClientQuota
+	}
+	q.pending = append(q.pending, req)
+	q.depth += n
+	q.perClient[client] += n
+	q.metrics.MaxDepth = max(q.metrics.MaxDepth, q.depth)
+	q.mu.Unlock()
+	q.signal()
+
+	<-req.done
+	if req.err != nil {
+		return nil, req.err
+	}
+	return req.batch.Results, req.batch.Err
+}
+
+// Run commits the queued requests until ctx is cancelled, then commits what is left
+func (q *Queue) Run(ctx context.Context) {
+	for {
+		select {
+		case <-q.wake:
+		case <-ctx.Done():
+			q.mu.Lock()
+			q.closed = true
+			q.mu.Unlock()
+			q.flush()
+			return
+		}
+
+		//wait until the batch is full or the deadline is reached
+		deadline := time.NewTimer(q.maxDelay)
+	wait:
+		for !q.full() {
+			select {
+			case <-q.wake:
+			case <-deadline.C:
+				break wait
+			case <-ctx.Done():
+				break wait
+			}
+		}
+		deadline.Stop()
+		q.flush()
+	}
+}
+
+func (q *Queue) full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.depth >= q.maxBatch
+}
+
+// flush commits everything that is pending, in groups of up to maxBatch measurements
+func (q *Queue) flush() {
+	for {
+		group := q.take()
+		if len(group) == 0 {
+			return
+		}
+		q.commit(group)
+	}
+}
+
+// take removes the next group from the queue, at least one request even if it is larger than maxBatch
+func (q *Queue) take() []*request {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	size, count := 0, 0
+	for count < len(q.pending) {
+		n := len(q.pending[count].batch.Measurements)
+		if count > 0 && size+n > q.maxBatch {
+			break
+		}
+		size += n
+		count++
+	}
+	group := q.pending[:count:count]
+	q.pending = q.pending[count:]
+	q.depth -= size
+	for _, req := range group {
+		n := len(req.batch.Measurements)
+		if q.perClient[req.client] <= n {
+			delete(q.perClient, req.client)
+		} else {
+			q.perClient[req.client] -= n
+		}
+	}
+	return group
+}
+
+func (q *Queue) commit(group []*request) {
+	batches := make([]*database.InsertBatch, len(group))
+	size := 0
+	for i, req := range group {
+		batches[i] = req.batch
+		size += len(req.batch.Measurements)
+	}
+
+	start := time.Now()
+	err := q.db.InsertGroup(batches)
+	elapsed := time.Since(start)
+	if err != nil {
+		log.Printf("group commit of %v requests failed: %s", len(group), err)
+	}
+
+	q.mu.Lock()
+	if err != nil {
+		q.metrics.FailedCommits++
+	} else {
+		q.metrics.Commits++
+		q.metrics.Requests += int64(len(group))
+		q.metrics.Measurements += int64(size)
+		q.metrics.LastBatch = size
+		q.metrics.LastCommitMs = float64(elapsed.Microseconds()) / 1000
+	}
+	q.mu.Unlock()
+
+	for _, req := range group {
+		req.err = err
+		close(req.done)
+	}
+}
+
+func (q *Queue) Metrics() Metrics {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	metrics := q.metrics
+	metrics.Depth = q.depth
+	metrics.PendingRequests = len(q.pending)
+	if metrics.Commits > 0 {
+		metrics.AvgBatch = float64(metrics.Measurements) / float64(metrics.Commits)
+	}
+	return metrics
+}
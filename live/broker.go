@@ -0,0 +1,103 @@
+// Live streams: committed measurements are fanned out to the subscribers of their sensors
+package live
+
+import (
+	"measurements-api-stdlib-docker/database"
+	"sync"
+)
+
+// Subscription receives the new measurements of its sensors on C. When the buffer of C is full the
+// subscription is dropped and Lagged is closed, the subscriber has to catch up from the database.
+type Subscription struct {
+	C       <-chan database.Measurement
+	ch      chan database.Measurement
+	lagged  chan struct{}
+	sensors map[int64]bool
+}
+
+func (s *Subscription) Lagged() <-chan struct{} {
+	return s.lagged
+}
+
+// Broker never blocks the publisher, a slow subscriber only loses its own subscription
+type Broker struct {
+	buffer int
+
+	mu      sync.Mutex
+	subs    map[*Subscription]struct{}
+	metrics Metrics
+}
+
+type Metrics struct {
+	Subscribers int   `json:"subscribers"`
+	Buffer      int   `json:"buffer"`
+	Published   int64 `json:"published"`
+	Delivered   int64 `json:"delivered"`
+	Lagged      int64 `json:"lagged"`
+}
+
+func NewBroker(buffer int) *Broker {
+	if buffer < 1 {
+		buffer = 1
+	}
+	return &Broker{
+		buffer:  buffer,
+		subs:    make(map[*Subscription]struct{}),
+		metrics: Metrics{Buffer: buffer},
+	}
+}
+
+func (b *Broker) Subscribe(sensorIDs []int64) *Subscription {
+	ch := make(chan database.Measurement, b.buffer)
+	s := &Subscription{C: ch, ch: ch, lagged: make(chan struct{}), sensors: make(map[int64]bool, len(sensorIDs))}
+	for _, id := range sensorIDs {
+		s.sensors[id] = true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// Unsubscribe may be called more than once and after the subscription lagged
+func (b *Broker) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, s)
+}
+
+// Publish is registered with database.OnInsert
+func (b *Broker) Publish(measurements []database.Measurement) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.metrics.Published += int64(len(measurements))
+	for s := range b.subs {
+		for _, m := range measurements {
+			if s.sensors[m.SensorsId] && !b.send(s, m) {
+				break
+			}
+		}
+	}
+}
+
+// send drops the subscription if its buffer is full, must be called with mu held
+func (b *Broker) send(s *Subscription, m database.Measurement) bool {
+	select {
+	case s.ch <- m:
+		b.metrics.Delivered++
+		return true
+	default:
+		delete(b.subs, s)
+		close(s.lagged)
+		b.metrics.Lagged++
+		return false
+	}
+}
+
+func (b *Broker) Metrics() Metrics {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	metrics := b.metrics
+	metrics.Subscribers = len(b.subs)
+	return metrics
+}
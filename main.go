@@ -1,21 +1,49 @@
 package main
 
 import (
+	"context"
 	"log"
+	"measurements-api-stdlib-docker/alerts"
+	"measurements-api-stdlib-docker/backup"
+	"measurements-api-stdlib-docker/config"
 	"measurements-api-stdlib-docker/database"
 	"measurements-api-stdlib-docker/handlers"
+	"measurements-api-stdlib-docker/ingest"
+	"measurements-api-stdlib-docker/live"
+	"measurements-api-stdlib-docker/maintenance"
+	"measurements-api-stdlib-docker/ratelimit"
 	"measurements-api-stdlib-docker/router"
+	"measurements-api-stdlib-docker/scheduler"
+	"measurements-api-stdlib-docker/webhooks"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
-	measurementDB, err := database.InitDB()
+	cfg := config.Load()
+
+	measurementDB, err := database.InitDB(dbOptions(cfg))
 	if err != nil {
 		log.Fatal("Database connection/creation failed:", err)
 	}
 	defer measurementDB.Close()
+	log.Printf("database: journal mode %s, synchronous %s, %v read connections",
+		cfg.DBTuning.JournalMode, cfg.DBTuning.Synchronous, cfg.DBTuning.ReadConns)
+	backups := backup.NewManager(measurementDB, cfg.Backup.Dir)
+
+	//backup and restore can also be run from the command line, without the server
+	if len(os.Args) > 1 {
+		if err := runCommand(cfg, measurementDB, backups, os.Args[1:]); err != nil {
+			measurementDB.Close()
+			log.Fatal(err)
+		}
+		return
+	}
 
 	//count all rows
 	start := time.Now()
@@ -25,15 +53,143 @@ func main() {
 		return
 	}
 	log.Printf("measurement rows: %v; time %s", nRows, time.Since(start))
+	if _, err := measurementDB.CheckQueryPlans(); err != nil {
+		log.Printf("warning: %s", err)
+	}
+
+	mode := &maintenance.Mode{}
+
+	//Background jobs, they pause while a backup is restored
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	every := func(name string, interval time.Duration, job func() error) {
+		scheduler.Every(ctx, name, interval, func() (err error) {
+			mode.Hold(func() { err = job() })
+			return err
+		})
+	}
+	every("purge trash", cfg.Trash.PurgeInterval, func() error {
+		result, err := measurementDB.PurgeDeleted(time.Now().Add(-cfg.Trash.Retention))
+		if err != nil {
+			return err
+		}
+		log.Printf("purged %v measurements and %v experiments from trash", result.Measurements, result.Experiments)
+		return nil
+	})
+
+	every("purge idempotency keys", time.Hour, func() error {
+		_, err := measurementDB.PurgeIdempotencyKeys(time.Now().Add(-cfg.IdempotencyTTL))
+		return err
+	})
+
+	every("retention", cfg.RetentionInterval, func() error {
+		report, err := measurementDB.ApplyRetention(false)
+		if err != nil {
+			return err
+		}
+		log.Printf("retention: purged %v raw measurements, wrote %v buckets, purged %v downsamples",
+			report.RawPurged, report.BucketsWritten, report.DownsamplesPurged)
+		return nil
+	})
+
+	every("backup", cfg.Backup.Interval, func() error {
+		info, err := backups.Create(cfg.Backup.Compress)
+		if err != nil {
+			return err
+		}
+		pruned, err := backups.Prune(cfg.Backup.Keep)
+		if err != nil {
+			return err
+		}
+		log.Printf("backup %s created, pruned %v old backups", info.Name, len(pruned))
+		return nil
+	})
+
+	//group commit of inserts, on shutdown the queue commits what is left after the last request
+	var queue *ingest.Queue
+	queueDone := make(chan struct{})
+	if cfg.Ingest.QueueSize > 0 {
+		queue = ingest.NewQueue(measurementDB, cfg.Ingest.BatchSize, cfg.Ingest.MaxDelay, cfg.Ingest.QueueSize)
+		go func() {
+			queue.Run(ctx)
+			close(queueDone)
+		}()
+	} else {
+		close(queueDone)
+	}
+
+	//live streams get every committed insert
+	broker := live.NewBroker(cfg.Stream.Buffer)
+	measurementDB.OnInsert(broker.Publish)
+
+	//alert rules are checked in the background, after the commit, silent rules also periodically
+	alertEngine := alerts.NewEngine(measurementDB, mode, cfg.SilenceCheckInterval)
+	measurementDB.OnInsert(alertEngine.Enqueue)
+	go alertEngine.Run(ctx)
+
+	//webhooks are told about inserts, alerts and experiment changes, deliveries are retried from the database
+	dispatcher := webhooks.NewDispatcher(measurementDB, mode, cfg.Webhook.Timeout, cfg.Webhook.MaxAttempts, cfg.Webhook.Backoff)
+	measurementDB.OnInsertTx(dispatcher.MeasurementsCreated)
+	measurementDB.OnInsert(dispatcher.MeasurementsCommitted)
+	alertEngine.OnChange(dispatcher.AlertChanged)
+	measurementDB.OnExperimentChange(dispatcher.ExperimentChanged)
+	go dispatcher.Run(ctx)
+
+	//Setup rate limits and quotas
+	limits := &ratelimit.Limits{
+		Read:  ratelimit.NewLimiter("read", cfg.RateLimit.ReadRPS, cfg.RateLimit.ReadBurst),
+		Write: ratelimit.NewLimiter("write", cfg.RateLimit.WriteRPS, cfg.RateLimit.WriteBurst),
+		Quota: ratelimit.NewQuota(cfg.RateLimit.DailyQuota, measurementDB.CountExperimentMeasurementsOnDay),
+	}
 
 	//Setup API
-	measurementHandler := handlers.NewHandler(measurementDB)
+	measurementHandler := handlers.NewHandler(measurementDB, limits, cfg, backups, mode, queue, broker, dispatcher)
 	r := gin.Default()
-	router.SetupRoutes(r, measurementHandler)
+	//the client IP keys the rate limits, X-Forwarded-For is only believed from the configured proxies
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatal("invalid TRUSTED_PROXIES: ", err)
+	}
+	router.SetupRoutes(r, measurementHandler, limits, mode)
 
-	err = r.Run(":8080")
-	if err != nil {
+	srv := &http.Server{Addr: cfg.Addr, Handler: r}
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("listening on %s", cfg.Addr)
+		serverErr <- srv.ListenAndServe()
+	}()
+	stop, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	select {
+	case err := <-serverErr:
 		measurementDB.Close()             // Ensure proper cleanup
 		log.Fatal("Server failed: ", err) // Exit the program
+	case <-stop.Done():
+	}
+
+	//answer the running requests first, their inserts are still committed by the queue, streams end at once
+	log.Printf("shutting down")
+	mode.Shutdown()
+	shutdown, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdown); err != nil {
+		log.Printf("error shutting down the server: %s", err)
+	}
+	cancel()
+	select {
+	case <-queueDone:
+	case <-shutdown.Done():
+		log.Printf("ingest queue not drained within %s", cfg.ShutdownTimeout)
+	}
+}
+
+func dbOptions(cfg *config.Config) database.Options {
+	return database.Options{
+		Path:           cfg.DBPath,
+		ConflictPolicy: cfg.ConflictPolicy,
+		JournalMode:    cfg.DBTuning.JournalMode,
+		Synchronous:    cfg.DBTuning.Synchronous,
+		BusyTimeout:    cfg.DBTuning.BusyTimeout,
+		CacheSizeKB:    cfg.DBTuning.CacheSizeKB,
+		ReadConns:      cfg.DBTuning.ReadConns,
 	}
 }
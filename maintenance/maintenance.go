@@ -0,0 +1,94 @@
+// Maintenance mode: requests are answered with 503 while the database is swapped out
+package maintenance
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Mode struct {
+	active atomic.Bool
+	// requests hold a read lock while they run, maintenance takes the write lock
+	inFlight sync.RWMutex
+
+	mu       sync.Mutex
+	starting chan struct{}
+}
+
+func (m *Mode) Active() bool {
+	return m.active.Load()
+}
+
+// Starting is closed when the next maintenance starts. Long running requests (live streams) end on it,
+// so maintenance does not wait for them.
+func (m *Mode) Starting() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.starting == nil {
+		m.starting = make(chan struct{})
+	}
+	return m.starting
+}
+
+// Middleware rejects requests during maintenance and lets maintenance wait for running requests
+func (m *Mode) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if m.active.Load() {
+			c.Header("Retry-After", "30")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "server is in maintenance mode"})
+			return
+		}
+		m.inFlight.RLock()
+		defer m.inFlight.RUnlock()
+		c.Next()
+	}
+}
+
+// Shutdown rejects all further requests and ends the long running ones like maintenance does,
+// without waiting for the others. It can not be undone.
+func (m *Mode) Shutdown() {
+	m.active.Store(true)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.starting == nil {
+		m.starting = make(chan struct{})
+	}
+	select {
+	case <-m.starting:
+	default:
+		close(m.starting)
+	}
+}
+
+// Hold runs fn of a background job that uses the database like a request: it waits while maintenance
+// runs and maintenance waits for it. fn must not wait for a request, the ingest queue does not need Hold
+// because every queued measurement belongs to a request that holds the maintenance off.
+func (m *Mode) Hold(fn func()) {
+	m.inFlight.RLock()
+	defer m.inFlight.RUnlock()
+	fn()
+}
+
+// Run switches maintenance mode on, waits for the running requests and calls fn.
+// Only one maintenance can run at a time.
+func (m *Mode) Run(fn func() error) error {
+	if !m.active.CompareAndSwap(false, true) {
+		return fmt.Errorf("maintenance already running")
+	}
+	defer m.active.Store(false)
+
+	m.mu.Lock()
+	if m.starting != nil {
+		close(m.starting)
+		m.starting = nil
+	}
+	m.mu.Unlock()
+
+	m.inFlight.Lock()
+	defer m.inFlight.Unlock()
+	return fn()
+}
@@ -0,0 +1,176 @@
+// Token bucket rate limiting per client and daily ingestion quotas per experiment
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// buckets that were not touched for this long are full again and can be dropped
+const idleBucketTTL = 10 * time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type Limiter struct {
+	name      string
+	rate      float64 // tokens refilled per second
+	burst     float64
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type LimiterUsage struct {
+	Group     string  `json:"group"`
+	Rate      float64 `json:"rate_per_second"`
+	Burst     int     `json:"burst"`
+	Remaining int     `json:"remaining"`
+}
+
+// NewLimiter returns nil for a rate <= 0, a nil Limiter allows everything
+func NewLimiter(name string, rate float64, burst int) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		name:    name,
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// refill must be called with the mutex held
+func (l *Limiter) refill(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+		return b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < idleBucketTTL {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > idleBucketTTL {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Allow takes one token from the bucket of key, if none is left it returns the time until the next token
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	b := l.refill(key, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	missing := 1 - b.tokens
+	return false, time.Duration(missing / l.rate * float64(time.Second))
+}
+
+// Usage reports the tokens left in the bucket of key without creating or changing it
+func (l *Limiter) Usage(key string) LimiterUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	remaining := l.burst
+	if b, ok := l.buckets[key]; ok {
+		remaining = math.Min(l.burst, b.tokens+time.Since(b.last).Seconds()*l.rate)
+	}
+	return LimiterUsage{
+		Group:     l.name,
+		Rate:      l.rate,
+		Burst:     int(l.burst),
+		Remaining: int(remaining),
+	}
+}
+
+// authenticatedKey marks requests whose X-API-Key was verified, see SetAuthenticated
+const authenticatedKey = "ratelimit.authenticated"
+
+// SetAuthenticated marks the X-API-Key of the request as verified, it must run before the limiters
+func SetAuthenticated(c *gin.Context) {
+	c.Set(authenticatedKey, true)
+}
+
+// IsAuthenticated reports whether SetAuthenticated was called for the request
+func IsAuthenticated(c *gin.Context) bool {
+	return c.GetBool(authenticatedKey)
+}
+
+// ClientKey identifies the caller by its verified API key or else by client IP. Unverified headers like
+// X-Device-ID are not used, a client could rotate them to get a fresh bucket with every request.
+func ClientKey(c *gin.Context) string {
+	if IsAuthenticated(c) {
+		//never keep the raw key in memory or show it on the usage endpoint
+		sum := sha256.Sum256([]byte(c.GetHeader("X-API-Key")))
+		return "apikey:" + hex.EncodeToString(sum[:8])
+	}
+	return "ip:" + c.ClientIP()
+}
+
+func Middleware(l *Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ok, retryAfter := l.Allow(ClientKey(c))
+		if !ok {
+			TooManyRequests(c, retryAfter, "rate limit exceeded")
+			return
+		}
+		c.Next()
+	}
+}
+
+// TooManyRequests aborts with 429 and a Retry-After header in whole seconds
+func TooManyRequests(c *gin.Context, retryAfter time.Duration, msg string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": msg})
+}
+
+// Limits bundles the limiters of the route groups and the ingestion quota
+type Limits struct {
+	Read  *Limiter
+	Write *Limiter
+	Quota *Quota
+}
+
+func (l *Limits) Usage(key string) []LimiterUsage {
+	usage := make([]LimiterUsage, 0, 2)
+	for _, limiter := range []*Limiter{l.Read, l.Write} {
+		if limiter != nil {
+			usage = append(usage, limiter.Usage(key))
+		}
+	}
+	return usage
+}
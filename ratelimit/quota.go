@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SeedFunc returns how many measurements an experiment already ingested on a day (YYYY-MM-DD, UTC),
+// so a restart does not reset the quota
+type SeedFunc func(experimentID int, day string) (int, error)
+
+type Quota struct {
+	limit int
+	seed  SeedFunc
+	mu    sync.Mutex
+	day   string
+	used  map[int]int // experiment id -> measurements today
+}
+
+type QuotaUsage struct {
+	ExperimentID int    `json:"experiment_id"`
+	Day          string `json:"day"`
+	Used         int    `json:"used"`
+	Limit        int    `json:"limit"`
+}
+
+// NewQuota returns nil for a limit <= 0, a nil Quota allows everything
+func NewQuota(limit int, seed SeedFunc) *Quota {
+	if limit <= 0 {
+		return nil
+	}
+	return &Quota{limit: limit, seed: seed, used: make(map[int]int)}
+}
+
+func untilMidnight(now time.Time) time.Duration {
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC).Sub(now)
+}
+
+// Reserve books n measurements for the experiment, if the quota is exhausted it returns the time until the quota resets
+func (q *Quota) Reserve(experimentID, n int) (bool, time.Duration, error) {
+	if q == nil {
+		return true, 0, nil
+	}
+	now := time.Now().UTC()
+	day := now.Format(time.DateOnly)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if day != q.day {
+		//new day, forget yesterdays counters
+		q.day = day
+		q.used = make(map[int]int)
+	}
+
+	used, ok := q.used[experimentID]
+	if !ok {
+		seeded, err := q.seed(experimentID, day)
+		if err != nil {
+			return false, 0, fmt.Errorf("error seeding quota of experiment %v: %w", experimentID, err)
+		}
+		used = seeded
+	}
+	if used+n > q.limit {
+		q.used[experimentID] = used
+		return false, untilMidnight(now), nil
+	}
+	q.used[experimentID] = used + n
+	return true, 0, nil
+}
+
+// Release gives back reserved measurements when the insert failed
+func (q *Quota) Release(experimentID, n int) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.used[experimentID] >= n {
+		q.used[experimentID] -= n
+	}
+}
+
+func (q *Quota) Usage() []QuotaUsage {
+	if q == nil {
+		return []QuotaUsage{}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage := make([]QuotaUsage, 0, len(q.used))
+	for id, used := range q.used {
+		usage = append(usage, QuotaUsage{ExperimentID: id, Day: q.day, Used: used, Limit: q.limit})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].ExperimentID < usage[j].ExperimentID })
+	return usage
+}
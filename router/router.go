@@ -2,17 +2,123 @@ package router
 
 import (
 	"measurements-api-stdlib-docker/handlers"
+	"measurements-api-stdlib-docker/maintenance"
+	"measurements-api-stdlib-docker/ratelimit"
+	"measurements-api-stdlib-docker/util"
 
 	"github.com/gin-gonic/gin"
 )
 
-func SetupRoutes(r *gin.Engine, h *handlers.Handler) {
-	r.GET("/measurements", h.HandleMeasurementGetAll)
-	r.POST("/measurements", h.HandleMeasurementPost)
-	r.GET("/measurements/:id", h.HandleMeasurementGetById)
-	r.DELETE("/measurements/:id", h.HandleMeasurementDelete)
-	r.PUT("/measurements/:id", h.HandleMeasurementUpdate)
-	r.GET("/measurements/minmax", h.HandleMeasurementMinMax)
+func SetupRoutes(r *gin.Engine, h *handlers.Handler, limits *ratelimit.Limits, mode *maintenance.Mode) {
+	r.Use(util.RequestID(), h.Authenticate())
 
-	r.GET("experiments/:exp/measurements", h.HandleGetMeasurementsByExperiment)
+	//route groups with their own rate limiter, both are paused while a backup is restored
+	read := r.Group("/", ratelimit.Middleware(limits.Read), mode.Middleware())
+	write := r.Group("/", ratelimit.Middleware(limits.Write), mode.Middleware())
+
+	read.GET("/measurements", h.HandleMeasurementGetAll)
+	write.POST("/measurements", h.Idempotent(), h.HandleMeasurementPost)
+	write.POST("/measurements/batch", h.Idempotent(), h.HandleMeasurementBatchPost)
+	read.GET("/measurements/:id", h.HandleMeasurementGetById)
+	write.DELETE("/measurements/:id", h.HandleMeasurementDelete)
+	write.PUT("/measurements/:id", h.HandleMeasurementUpdate)
+	write.PATCH("/measurements/:id", h.HandleMeasurementUpdate)
+	write.PUT("/measurements/:id/quality", h.HandleMeasurementQualityPut)
+	read.GET("/measurements/minmax", h.HandleMeasurementMinMax)
+	read.GET("/ingest/metrics", h.HandleIngestMetrics)
+
+	write.POST("/measurements/:id/restore", h.HandleMeasurementRestore)
+	read.GET("/measurements/:id/revisions", h.HandleMeasurementRevisions)
+
+	// :exp is the name or the id of the experiment
+	read.GET("experiments/:exp/measurements", h.HandleGetMeasurementsByExperiment)
+	write.DELETE("/experiments/:exp", h.HandleExperimentDelete)
+	write.POST("/experiments/:exp/restore", h.HandleExperimentRestore)
+	read.GET("/experiments", h.HandleExperimentsGet)
+	read.GET("/experiments/:exp", h.HandleExperimentGet)
+	//lifecycle, only running experiments accept measurements and archived ones are read-only
+	for _, action := range []string{"start", "pause", "resume", "complete", "archive"} {
+		write.POST("/experiments/:exp/"+action, h.HandleExperimentTransition(action))
+	}
+	//new experiments start as drafts, from a template or as a clone without measurements
+	write.POST("/experiments", h.HandleExperimentPost)
+	write.POST("/experiments/:exp/clone", h.HandleExperimentClone)
+	//repeated runs overlaid on the time since their start
+	read.GET("/compare", h.HandleCompare)
+
+	//server-sent events with the measurements committed from now on (or after Last-Event-ID)
+	read.GET("/experiments/:exp/stream", h.HandleExperimentStream)
+	read.GET("/sensors/:id/stream", h.HandleSensorStream)
+	read.GET("/streams/metrics", h.HandleStreamMetrics)
+	//subscriptions and inserts over one socket, inserts count against the write rate limit per message
+	read.GET("/ws", h.HandleWebSocket)
+
+	read.GET("/trash/measurements", h.HandleTrashMeasurements)
+	read.GET("/trash/experiments", h.HandleTrashExperiments)
+
+	read.GET("/sensors/:id/downsampled", h.HandleSensorDownsamples)
+	read.GET("/sensors/:id/aggregate", h.HandleSensorAggregate)
+	read.GET("/sensors/:id", h.HandleSensorGet)
+	write.PUT("/sensors/:id/quantity", h.HandleSensorQuantityPut)
+	//heartbeat monitoring of sensors with an expected interval
+	write.PUT("/sensors/:id/interval", h.HandleSensorIntervalPut)
+	read.GET("/sensors/status", h.HandleSensorStatuses)
+	read.GET("/sensors/:id/status", h.HandleSensorStatus)
+	read.GET("/sensors/:id/gaps", h.HandleSensorGaps)
+	read.GET("/experiments/:exp/gaps", h.HandleExperimentGaps)
+	write.POST("/sensors/:id/quality", h.HandleSensorQualityPost)
+	read.GET("/sensors/:id/calibrations", h.HandleCalibrationsGet)
+	write.POST("/sensors/:id/calibrations", h.HandleCalibrationPost)
+	write.DELETE("/sensors/:id/calibrations/:calibration", h.HandleCalibrationDelete)
+	read.GET("/units", h.HandleUnits)
+
+	//alert rules are evaluated on every committed measurement
+	read.GET("/alerts", h.HandleAlerts)
+	read.GET("/alerts/history", h.HandleAlertHistory)
+	read.GET("/alerts/rules", h.HandleAlertRulesGet)
+	write.POST("/alerts/rules", h.HandleAlertRulePost)
+	write.DELETE("/alerts/rules/:id", h.HandleAlertRuleDelete)
+
+	//retention purges data, so changing rules and running it is for admins only
+	admin := write.Group("/", h.RequireAdmin())
+	adminRead := read.Group("/", h.RequireAdmin())
+	read.GET("/retention/rules", h.HandleRetentionRulesGet)
+	admin.POST("/retention/rules", h.HandleRetentionRulePost)
+	admin.DELETE("/retention/rules/:id", h.HandleRetentionRuleDelete)
+	read.GET("/retention/preview", h.HandleRetentionPreview)
+	admin.POST("/retention/run", h.HandleRetentionRun)
+	read.GET("/retention/metrics", h.HandleRetentionMetrics)
+
+	//validation rules decide which writes are accepted
+	read.GET("/validation/rules", h.HandleValidationRulesGet)
+	admin.POST("/validation/rules", h.HandleValidationRulePost)
+	admin.DELETE("/validation/rules/:id", h.HandleValidationRuleDelete)
+
+	//experiment templates, they can carry validation rules and so only admins change them
+	read.GET("/templates", h.HandleTemplatesGet)
+	read.GET("/templates/:id", h.HandleTemplateGet)
+	admin.POST("/templates", h.HandleTemplatePost)
+	admin.DELETE("/templates/:id", h.HandleTemplateDelete)
+	admin.POST("/experiments/:exp/template", h.HandleExperimentTemplatePost)
+
+	//the audit log shows who changed what, including the clients of other users
+	adminRead.GET("/audit", h.HandleAuditLog)
+
+	//webhook urls and delivery logs are for admins only
+	admin.GET("/webhooks", h.HandleWebhooksGet)
+	admin.POST("/webhooks", h.HandleWebhookPost)
+	admin.DELETE("/webhooks/:id", h.HandleWebhookDelete)
+	admin.GET("/webhooks/:id/deliveries", h.HandleWebhookDeliveries)
+	admin.POST("/webhooks/:id/test", h.HandleWebhookTest)
+
+	//backups are not paused by maintenance mode, the restore itself switches it on
+	backups := r.Group("/admin/backups", ratelimit.Middleware(limits.Write), h.RequireAdmin())
+	backups.GET("", h.HandleBackupList)
+	backups.POST("", h.HandleBackupCreate)
+	backups.POST("/prune", h.HandleBackupPrune)
+	backups.DELETE("/:name", h.HandleBackupDelete)
+	backups.POST("/:name/restore", h.HandleBackupRestore)
+
+	//not limited, so a throttled client can still look at its usage
+	r.GET("/usage", h.HandleUsage)
 }
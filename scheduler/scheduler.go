@@ -0,0 +1,33 @@
+// Background jobs that run inside the server on a fixed interval
+package scheduler
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Every runs job every interval until ctx is cancelled, an interval <= 0 disables the job
+func Every(ctx context.Context, name string, interval time.Duration, job func() error) {
+	if interval <= 0 {
+		log.Printf("job %s disabled", name)
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				start := time.Now()
+				if err := job(); err != nil {
+					log.Printf("job %s failed: %s", name, err)
+					continue
+				}
+				log.Printf("job %s done; time %s", name, time.Since(start))
+			}
+		}
+	}()
+}
@@ -0,0 +1,157 @@
+// Unit catalogue: every unit measures one quantity and converts linearly to the canonical unit of it
+package units
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// quantities, the first unit of each in the catalogue is its canonical unit
+const (
+	Pressure    = "pressure"
+	Temperature = "temperature"
+	Humidity    = "humidity"
+	Voltage     = "voltage"
+	Current     = "current"
+	Power       = "power"
+	Energy      = "energy"
+	Resistance  = "resistance"
+	Frequency   = "frequency"
+	Illuminance = "illuminance"
+)
+
+// Unit converts to the canonical unit of its quantity as value*Factor + Offset
+type Unit struct {
+	Symbol   string   `json:"symbol"`
+	Name     string   `json:"name"`
+	Quantity string   `json:"quantity"`
+	Factor   float64  `json:"factor"`
+	Offset   float64  `json:"offset"`
+	Aliases  []string `json:"aliases,omitempty"`
+}
+
+var catalogue = []Unit{
+	{Symbol: "hPa", Name: "hectopascal", Quantity: Pressure, Factor: 1},
+	{Symbol: "Pa", Name: "pascal", Quantity: Pressure, Factor: 0.01},
+	{Symbol: "kPa", Name: "kilopascal", Quantity: Pressure, Factor: 10},
+	{Symbol: "mbar", Name: "millibar", Quantity: Pressure, Factor: 1},
+	{Symbol: "bar", Name: "bar", Quantity: Pressure, Factor: 1000},
+	{Symbol: "atm", Name: "standard atmosphere", Quantity: Pressure, Factor: 1013.25},
+	{Symbol: "psi", Name: "pound per square inch", Quantity: Pressure, Factor: 68.947572931683},
+	{Symbol: "mmHg", Name: "millimetre of mercury", Quantity: Pressure, Factor: 1.33322387415},
+	{Symbol: "inHg", Name: "inch of mercury", Quantity: Pressure, Factor: 33.8638866667},
+
+	{Symbol: "°C", Name: "degree Celsius", Quantity: Temperature, Factor: 1, Aliases: []string{"C", "degC", "℃"}},
+	{Symbol: "K", Name: "kelvin", Quantity: Temperature, Factor: 1, Offset: -273.15},
+	{Symbol: "°F", Name: "degree Fahrenheit", Quantity: Temperature, Factor: 5.0 / 9, Offset: -160.0 / 9, Aliases: []string{"F", "degF", "℉"}},
+
+	{Symbol: "%", Name: "percent relative humidity", Quantity: Humidity, Factor: 1, Aliases: []string{"%RH", "RH"}},
+
+	{Symbol: "V", Name: "volt", Quantity: Voltage, Factor: 1},
+	{Symbol: "mV", Name: "millivolt", Quantity: Voltage, Factor: 1e-3},
+	{Symbol: "kV", Name: "kilovolt", Quantity: Voltage, Factor: 1e3},
+
+	{Symbol: "A", Name: "ampere", Quantity: Current, Factor: 1},
+	{Symbol: "mA", Name: "milliampere", Quantity: Current, Factor: 1e-3},
+	{Symbol: "µA", Name: "microampere", Quantity: Current, Factor: 1e-6, Aliases: []string{"uA"}},
+
+	{Symbol: "W", Name: "watt", Quantity: Power, Factor: 1},
+	{Symbol: "mW", Name: "milliwatt", Quantity: Power, Factor: 1e-3},
+	{Symbol: "kW", Name: "kilowatt", Quantity: Power, Factor: 1e3},
+
+	{Symbol: "Wh", Name: "watt hour", Quantity: Energy, Factor: 1},
+	{Symbol: "kWh", Name: "kilowatt hour", Quantity: Energy, Factor: 1e3},
+	{Symbol: "J", Name: "joule", Quantity: Energy, Factor: 1.0 / 3600},
+
+	{Symbol: "Ω", Name: "ohm", Quantity: Resistance, Factor: 1, Aliases: []string{"Ohm", "ohm"}},
+	{Symbol: "kΩ", Name: "kiloohm", Quantity: Resistance, Factor: 1e3, Aliases: []string{"kOhm"}},
+	{Symbol: "MΩ", Name: "megaohm", Quantity: Resistance, Factor: 1e6, Aliases: []string{"MOhm"}},
+
+	{Symbol: "Hz", Name: "hertz", Quantity: Frequency, Factor: 1},
+	{Symbol: "kHz", Name: "kilohertz", Quantity: Frequency, Factor: 1e3},
+
+	{Symbol: "lx", Name: "lux", Quantity: Illuminance, Factor: 1, Aliases: []string{"lux"}},
+}
+
+// bySymbol has the symbols and aliases of all units
+var bySymbol = func() map[string]Unit {
+	m := make(map[string]Unit)
+	for _, u := range catalogue {
+		m[u.Symbol] = u
+		for _, alias := range u.Aliases {
+			m[alias] = u
+		}
+	}
+	return m
+}()
+
+// All returns the catalogue, grouped by quantity with the canonical unit first
+func All() []Unit {
+	return slices.Clone(catalogue)
+}
+
+// Quantities returns the known quantities in catalogue order
+func Quantities() []string {
+	var quantities []string
+	for _, u := range catalogue {
+		if !slices.Contains(quantities, u.Quantity) {
+			quantities = append(quantities, u.Quantity)
+		}
+	}
+	return quantities
+}
+
+// Lookup finds a unit by its symbol, an alias or its name ("volt", in any case), surrounding spaces are ignored
+func Lookup(symbol string) (Unit, bool) {
+	symbol = strings.TrimSpace(symbol)
+	if u, ok := bySymbol[symbol]; ok {
+		return u, true
+	}
+	for _, u := range catalogue {
+		if strings.EqualFold(u.Name, symbol) || strings.EqualFold(u.Name+"s", symbol) {
+			return u, true
+		}
+	}
+	return Unit{}, false
+}
+
+// Canonical returns the unit values of the quantity are stored in
+func Canonical(quantity string) (Unit, bool) {
+	for _, u := range catalogue {
+		if u.Quantity == quantity {
+			return u, true
+		}
+	}
+	return Unit{}, false
+}
+
+func (u Unit) ToCanonical(value float64) float64 {
+	return value*u.Factor + u.Offset
+}
+
+func (u Unit) FromCanonical(value float64) float64 {
+	return (value - u.Offset) / u.Factor
+}
+
+// round drops the noise of the float arithmetic in converted output (300 K is 26.85 °C, not 26.850000000000023)
+func round(value float64) float64 {
+	rounded, err := strconv.ParseFloat(strconv.FormatFloat(value, 'g', 12, 64), 64)
+	if err != nil {
+		return value
+	}
+	return rounded
+}
+
+// Convert converts value from one unit into another of the same quantity for output, rounded to 12 digits.
+// The value is returned as is between the same units.
+func Convert(value float64, from, to Unit) (float64, error) {
+	if from.Quantity != to.Quantity {
+		return 0, fmt.Errorf("%s measures %s and can not be converted to %s (%s)", from.Symbol, from.Quantity, to.Symbol, to.Quantity)
+	}
+	if from.Symbol == to.Symbol {
+		return value, nil
+	}
+	return round(to.FromCanonical(from.ToCanonical(value))), nil
+}
@@ -1,8 +1,12 @@
 package util
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"log"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -18,3 +22,51 @@ func GetParamInt(c *gin.Context, param string) (int, error) {
 	}
 	return id, nil
 }
+
+// GetQueryInt returns fallback for a missing query parameter
+func GetQueryInt(c *gin.Context, name string, fallback int) (int, error) {
+	value := c.Query(name)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		return -1, fmt.Errorf("invalid value for %s", name)
+	}
+	return parsed, nil
+}
+
+// GetQueryTime checks the format of a time query parameter (YYYY-MM-DD HH:MM:SS), empty if missing
+func GetQueryTime(c *gin.Context, name string) (string, error) {
+	value := c.Query(name)
+	if value == "" {
+		return "", nil
+	}
+	if _, err := time.Parse(time.DateTime, value); err != nil {
+		return "", fmt.Errorf("invalid format of %s (%w)", name, err)
+	}
+	return value, nil
+}
+
+const requestIDKey = "requestID"
+
+// RequestID takes the X-Request-ID of the client or generates one and echoes it in the response
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader("X-Request-ID")
+		if requestID == "" {
+			buf := make([]byte, 8)
+			if _, err := rand.Read(buf); err != nil {
+				log.Println("error generating request id: ", err)
+			}
+			requestID = hex.EncodeToString(buf)
+		}
+		c.Set(requestIDKey, requestID)
+		c.Header("X-Request-ID", requestID)
+		c.Next()
+	}
+}
+
+func GetRequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
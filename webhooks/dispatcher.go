@@ -0,0 +1,290 @@
+// Webhook notifications: events are stored as deliveries in the database and sent with HMAC signatures,
+// failed deliveries are retried with exponential backoff
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/maintenance"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// deliveries sent at the same time
+const parallelDeliveries = 4
+
+// the backoff does not grow beyond this
+const maxBackoff = time.Hour
+
+// ErrInFlight is returned by Send for a delivery the background loop is sending
+var ErrInFlight = errors.New("delivery in flight")
+
+// Payload is the body of every delivery
+type Payload struct {
+	Event     string `json:"event"`
+	CreatedAt string `json:"created_at"`
+	Data      any    `json:"data"`
+}
+
+// Dispatcher stores events as deliveries for the subscribed webhooks when they happen, those of inserts
+// in the transaction of the insert, so a restart loses none of them. A background goroutine sends the
+// deliveries that are due, it pauses while a backup is restored.
+type Dispatcher struct {
+	db          *database.Database
+	mode        *maintenance.Mode
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+
+	mu       sync.Mutex
+	inFlight map[int64]bool // deliveries being sent, a test send and the background loop never send one twice
+	wake     chan struct{}
+}
+
+func NewDispatcher(db *database.Database, mode *maintenance.Mode, timeout time.Duration, maxAttempts int, backoff time.Duration) *Dispatcher {
+	return &Dispatcher{
+		db:          db,
+		mode:        mode,
+		client:      &http.Client{Timeout: timeout},
+		maxAttempts: max(maxAttempts, 1),
+		backoff:     backoff,
+		inFlight:    make(map[int64]bool),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Emit stores the event as a delivery for every subscribed webhook before it returns, events without
+// a subscribed webhook are dropped before they are serialized. The listeners run after the commit of
+// the change, an error is logged and does not undo it.
+func (d *Dispatcher) Emit(event string, data any) {
+	if err := d.store(event, time.Now().UTC(), data); err != nil {
+		log.Printf("error storing %s webhook event: %s", event, err)
+		return
+	}
+	d.wakeUp()
+}
+
+// MeasurementsCreated is registered with database.OnInsertTx, one event per insert stored with it
+func (d *Dispatcher) MeasurementsCreated(tx *sql.Tx, measurements []database.Measurement) error {
+	return d.db.QueueEvent(tx, database.EventMeasurementCreated, func() ([]byte, error) {
+		return marshalPayload(database.EventMeasurementCreated, time.Now().UTC(), map[string]any{"measurements": measurements})
+	})
+}
+
+// MeasurementsCommitted is registered with database.OnInsert, it wakes the background loop for the
+// deliveries of the insert without waiting for it
+func (d *Dispatcher) MeasurementsCommitted([]database.Measurement) {
+	if subscribed, err := d.db.Subscribed(database.EventMeasurementCreated); err == nil && subscribed {
+		d.wakeUp()
+	}
+}
+
+func (d *Dispatcher) wakeUp() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// AlertChanged is registered with the alert engine, pending alerts are no event
+func (d *Dispatcher) AlertChanged(event database.AlertEvent) {
+	switch {
+	case event.To == database.AlertFiring:
+		d.Emit(database.EventAlertFiring, event)
+	case event.To == database.AlertResolved && event.From == database.AlertFiring:
+		d.Emit(database.EventAlertResolved, event)
+	}
+}
+
+// ExperimentChanged is registered with database.OnExperimentChange
+func (d *Dispatcher) ExperimentChanged(change database.ExperimentChange) {
+	d.Emit(database.EventExperimentState, change)
+}
+
+// Run sends due deliveries until ctx is done, retries are checked every second
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-ticker.C:
+		}
+		d.mode.Hold(func() {
+			if err := d.sendDue(ctx); err != nil {
+				log.Printf("error sending webhook deliveries: %s", err)
+			}
+		})
+	}
+}
+
+func (d *Dispatcher) store(event string, createdAt time.Time, data any) error {
+	subscribed, err := d.db.Subscribed(event)
+	if err != nil || !subscribed {
+		return err
+	}
+	payload, err := marshalPayload(event, createdAt, data)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.CreateDeliveries([]database.WebhookEvent{{Event: event, Payload: payload}})
+	return err
+}
+
+func marshalPayload(event string, createdAt time.Time, data any) ([]byte, error) {
+	payload, err := json.Marshal(Payload{event, createdAt.Format(time.RFC3339Nano), data})
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling %s event: %w", event, err)
+	}
+	return payload, nil
+}
+
+func (d *Dispatcher) sendDue(ctx context.Context) error {
+	due, err := d.db.DueDeliveries(time.Now(), 100)
+	if err != nil {
+		return err
+	}
+	//a slow receiver only holds up one of the parallel slots
+	slots := make(chan struct{}, parallelDeliveries)
+	var wg sync.WaitGroup
+	for _, delivery := range due {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if _, err := d.attempt(ctx, &delivery); err != nil {
+				log.Printf("error saving delivery %v: %s", delivery.ID, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// Send attempts a pending delivery right now, for test events. A delivery that is already being sent is a
+// conflict, its outcome is not known yet.
+func (d *Dispatcher) Send(ctx context.Context, deliveryID int64) (*database.WebhookDelivery, error) {
+	due, err := d.db.GetDueDelivery(deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	sent, err := d.attempt(ctx, due)
+	if err != nil {
+		return nil, err
+	}
+	if !sent {
+		return nil, fmt.Errorf("%w: delivery %v is being sent", ErrInFlight, deliveryID)
+	}
+	return &due.WebhookDelivery, nil
+}
+
+// SendTest stores a test event for the webhook and sends it at once. If it fails it is retried like other deliveries.
+// The send is not cancelled with ctx, a client that goes away would otherwise leave a failed attempt behind,
+// the timeout of the client still applies.
+func (d *Dispatcher) SendTest(ctx context.Context, webhookID int64) (*database.WebhookDelivery, error) {
+	payload, err := marshalPayload(database.EventTest, time.Now().UTC(),
+		map[string]any{"webhook_id": webhookID, "message": "test event"})
+	if err != nil {
+		return nil, err
+	}
+	//the background loop leaves the delivery alone until the test send is over, the attempt sets the next one
+	id, err := d.db.CreateDelivery(webhookID, database.EventTest, payload, time.Now().Add(d.client.Timeout+time.Minute))
+	if err != nil {
+		return nil, err
+	}
+	return d.Send(context.WithoutCancel(ctx), id)
+}
+
+// Sign is the hex HMAC-SHA256 of "<timestamp>.<body>" with the secret of the webhook
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// attempt posts the delivery once and stores the outcome, a 2xx answer counts as delivered.
+// A delivery that is already being sent is skipped and sent is false.
+func (d *Dispatcher) attempt(ctx context.Context, delivery *database.DueDelivery) (sent bool, err error) {
+	d.mu.Lock()
+	if d.inFlight[delivery.ID] {
+		d.mu.Unlock()
+		return false, nil
+	}
+	d.inFlight[delivery.ID] = true
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.inFlight, delivery.ID)
+		d.mu.Unlock()
+	}()
+
+	w := &delivery.WebhookDelivery
+	w.Attempts++
+	w.ResponseCode, w.LastError = 0, ""
+
+	err = d.post(ctx, delivery)
+	now := time.Now()
+	switch {
+	case err == nil:
+		w.Status = database.DeliveryDelivered
+		deliveredAt := now.UTC().Format(time.DateTime)
+		w.DeliveredAt = &deliveredAt
+	case w.Attempts >= d.maxAttempts:
+		w.Status, w.LastError = database.DeliveryFailed, err.Error()
+	default:
+		w.LastError = err.Error()
+		w.NextAttemptAt = database.NewTimestamp(now.Add(d.backoffAfter(w.Attempts)))
+	}
+	return true, d.db.SaveDeliveryAttempt(w)
+}
+
+// backoffAfter doubles the wait with every failed attempt
+func (d *Dispatcher) backoffAfter(attempts int) time.Duration {
+	wait := d.backoff
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, maxBackoff)
+}
+
+func (d *Dispatcher) post(ctx context.Context, delivery *database.DueDelivery) error {
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "measurements-api-webhooks")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", "sha256="+Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	delivery.ResponseCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"measurements-api-stdlib-docker/database"
+	"measurements-api-stdlib-docker/maintenance"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type received struct {
+	event string
+	body  []byte
+}
+
+// receiver records the signed requests and answers 204
+func receiver(t *testing.T, secret string) (*httptest.Server, chan received) {
+	t.Helper()
+	requests := make(chan received, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		timestamp, err := strconv.ParseInt(r.Header.Get("X-Webhook-Timestamp"), 10, 64)
+		if err != nil {
+			t.Error(err)
+		}
+		if got, want := r.Header.Get("X-Webhook-Signature"), "sha256="+Sign(secret, timestamp, body); got != want {
+			t.Errorf("signature %q, want %q", got, want)
+		}
+		requests <- received{r.Header.Get("X-Webhook-Event"), body}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func setup(t *testing.T) (*database.Database, *Dispatcher, *database.Webhook, chan received) {
+	t.Helper()
+	db, err := database.InitDB(database.Options{Path: filepath.Join(t.TempDir(), "test.db"), ReadConns: 2, BusyTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	secret := "0123456789abcdef0123"
+	server, requests := receiver(t, secret)
+	w := &database.Webhook{URL: server.URL, Events: []string{database.EventMeasurementCreated}, Secret: secret}
+	if err := db.CreateWebhook(w, database.Actor{Name: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDispatcher(db, &maintenance.Mode{}, 5*time.Second, 3, time.Second)
+	db.OnInsertTx(d.MeasurementsCreated)
+	db.OnInsert(d.MeasurementsCommitted)
+	return db, d, w, requests
+}
+
+func TestEventIsStoredBeforeItIsSent(t *testing.T) {
+	db, d, w, requests := setup(t)
+	m := &database.Measurement{SensorsId: 1, Value: 1013, Unit: "hPa"}
+	if _, err := db.InsertMeasurement(m, database.Actor{Name: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	//nothing runs the dispatcher yet, the delivery must already be in the database
+	pending, err := db.GetWebhookDeliveries(w.ID, database.DeliveryPending, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Event != database.EventMeasurementCreated {
+		t.Fatalf("pending deliveries %+v, want one %s", pending, database.EventMeasurementCreated)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+	select {
+	case r := <-requests:
+		var payload struct {
+			Event string `json:"event"`
+			Data  struct {
+				Measurements []database.Measurement `json:"measurements"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(r.body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Event != database.EventMeasurementCreated || len(payload.Data.Measurements) != 1 {
+			t.Errorf("payload %s", r.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the delivery was not sent")
+	}
+}
+
+func TestSendTest(t *testing.T) {
+	_, d, w, requests := setup(t)
+	//a request context that is already gone must not fail the attempt
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	delivery, err := d.SendTest(ctx, w.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Status != database.DeliveryDelivered || delivery.ResponseCode != http.StatusNoContent {
+		t.Errorf("delivery %+v, want delivered with 204", delivery)
+	}
+	if r := <-requests; r.event != database.EventTest {
+		t.Errorf("event %q, want %q", r.event, database.EventTest)
+	}
+}
+
+func TestSubscriptionsFollowWebhooks(t *testing.T) {
+	db, _, w, _ := setup(t)
+	actor := database.Actor{Name: "test"}
+	if err := db.DeleteWebhook(w.ID, actor); err != nil {
+		t.Fatal(err)
+	}
+	//without a subscribed webhook the insert caches that there is none
+	if _, err := db.InsertMeasurement(&database.Measurement{SensorsId: 1, Value: 1013, Unit: "hPa"}, actor); err != nil {
+		t.Fatal(err)
+	}
+	created := &database.Webhook{URL: w.URL, Events: []string{database.EventMeasurementCreated}, Secret: "0123456789abcdef0123"}
+	if err := db.CreateWebhook(created, actor); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.InsertMeasurement(&database.Measurement{SensorsId: 1, Value: 1014, Unit: "hPa"}, actor); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := db.GetWebhookDeliveries(created.ID, database.DeliveryPending, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Errorf("%v pending deliveries of the new webhook, want 1", len(pending))
+	}
+}